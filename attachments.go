@@ -0,0 +1,460 @@
+package stare
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"go.uber.org/zap"
+)
+
+// Attachments are stored once per unique content in the Store's BlobStore,
+// keyed by content hash, and tracked with these keys:
+//
+//	attachment:<hash>                 marks the blob as in use
+//	attref:<hash>:<gid>:<cid>:<mid>   a message referencing the attachment,
+//	                                  the value is the guild's usage key
+//	attusage:<gid>:<time>:<hash>      the bytes a guild is charged for the
+//	                                  attachment, the value is the size
+//
+// Every key expires with the longest lived message referencing it. Blobs whose
+// marker is gone are removed right away when released, or by SweepBlobs once
+// the marker has expired.
+
+const (
+	// defaultAttachmentQuotaMB is how many megabytes of attachments are kept
+	// per guild, unless the operator sets a different quota
+	defaultAttachmentQuotaMB = 100
+	// blobSweepInterval is how often unreferenced blobs are removed
+	blobSweepInterval = time.Hour
+)
+
+// attachmentQuota returns how many bytes of attachments are kept per guild
+// before the oldest ones are evicted.
+func (b *Bot) attachmentQuota() int64 {
+	mb := b.config.GetInt("guild_attachment_quota_mb")
+	if mb <= 0 {
+		mb = defaultAttachmentQuotaMB
+	}
+	return int64(mb) * 1024 * 1024
+}
+
+func hashAttachment(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func attachmentKey(hash string) []byte {
+	return []byte("attachment:" + hash)
+}
+
+// putAttachments records the attachments of a message and charges them to
+// the guild's quota, evicting the guild's oldest attachments if needed.
+// Attachments larger than the quota are not stored. It returns the
+// attachments that were stored, whose data still has to be put in the blob
+// store, and the hashes of blobs that are no longer referenced. Changes to the
+// guild's usage are added to usage.
+func putAttachments(txn *badger.Txn, msg *DiscordMessage, ttl time.Duration, quota int64, usage *usageDelta) ([]*Attachment, []string, error) {
+	gid, cid, mid := msg.Message.GuildID, msg.Message.ChannelID, msg.Message.ID
+	expiresAt := uint64(time.Now().Add(ttl).Unix())
+
+	var stored []*Attachment
+	var released []string
+	for _, a := range msg.Attachments {
+		if a.Data == nil {
+			continue
+		}
+		if a.Hash == "" {
+			a.Hash = hashAttachment(a.Data)
+		}
+		size := int64(len(a.Data))
+
+		// the guild is only charged once for the same content
+		usageKey, err := findUsageKey(txn, a.Hash, gid)
+		if err != nil {
+			return nil, nil, err
+		}
+		if usageKey != nil {
+			if err := extendUsage(txn, usageKey, expiresAt, usage); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			if size > quota {
+				continue
+			}
+			evicted, err := evictAttachments(txn, gid, quota-size, usage)
+			if err != nil {
+				return nil, nil, err
+			}
+			released = append(released, evicted...)
+
+			usageKey = []byte(fmt.Sprintf("attusage:%v:%020d:%v", gid, time.Now().UnixNano(), a.Hash))
+			entry := badger.NewEntry(usageKey, []byte(strconv.FormatInt(size, 10)))
+			entry.ExpiresAt = expiresAt
+			if err := txn.SetEntry(entry); err != nil {
+				return nil, nil, err
+			}
+			usage.addAttachment(size, expiresAt)
+		}
+
+		refKey := fmt.Sprintf("attref:%v:%v:%v:%v", a.Hash, gid, cid, mid)
+		ref := badger.NewEntry([]byte(refKey), usageKey)
+		ref.ExpiresAt = expiresAt
+		if err := txn.SetEntry(ref); err != nil {
+			return nil, nil, err
+		}
+
+		if err := touchMarker(txn, a.Hash, expiresAt); err != nil {
+			return nil, nil, err
+		}
+		stored = append(stored, a)
+	}
+
+	// a blob released while evicting may be used again by this message
+	released = slices.DeleteFunc(released, func(hash string) bool {
+		return slices.ContainsFunc(stored, func(a *Attachment) bool { return a.Hash == hash })
+	})
+	return stored, released, nil
+}
+
+// storeBlobs puts the data of attachments in the blob store, unless it is
+// already there. It must be called after the transaction referencing them has
+// been committed.
+func (s *Store) storeBlobs(attachments []*Attachment) {
+	for _, a := range attachments {
+		mu := s.blobLock(a.Hash)
+		mu.Lock()
+		exists, err := s.blobs.Exists(a.Hash)
+		if err == nil && !exists {
+			err = s.blobs.Put(a.Hash, a.Data)
+		}
+		mu.Unlock()
+		if err != nil {
+			s.logger.Error("failed to store attachment", zap.String("hash", a.Hash), zap.Error(err))
+		}
+	}
+}
+
+// deleteBlobs removes blobs that are no longer referenced. A blob released by
+// one transaction may be referenced again by another one before it is
+// removed, so whether it is in use is checked again first. It returns how
+// many blobs were removed. Blobs that fail to be removed are picked up by
+// SweepBlobs later.
+func (s *Store) deleteBlobs(hashes []string) int {
+	removed := 0
+	for _, hash := range hashes {
+		mu := s.blobLock(hash)
+		mu.Lock()
+		inUse, err := s.blobInUse(hash)
+		if err == nil && !inUse {
+			err = s.blobs.Delete(hash)
+			if err == nil {
+				removed++
+			}
+		}
+		mu.Unlock()
+		if err != nil {
+			s.logger.Error("failed to delete attachment", zap.String("hash", hash), zap.Error(err))
+		}
+	}
+	return removed
+}
+
+// blobLock returns the lock held while a blob is put or deleted. As blobs are
+// only put once the marker of the blob is committed, and only deleted if there
+// is no marker, holding it keeps a blob that is used again from being deleted
+// after it was found to be stored already.
+func (s *Store) blobLock(hash string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(hash))
+	return &s.blobLocks[h.Sum32()%uint32(len(s.blobLocks))]
+}
+
+// blobInUse reports whether a cached message references the blob.
+func (s *Store) blobInUse(hash string) (bool, error) {
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(attachmentKey(hash))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// findUsageKey returns the usage key a guild is charged under for an
+// attachment, or nil if the guild does not reference it.
+func findUsageKey(txn *badger.Txn, hash, gid string) ([]byte, error) {
+	prefix := []byte(fmt.Sprintf("attref:%v:%v:", hash, gid))
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	it.Seek(prefix)
+	if !it.ValidForPrefix(prefix) {
+		return nil, nil
+	}
+	return it.Item().ValueCopy(nil)
+}
+
+// touchMarker creates the marker of an attachment, or makes it live until at
+// least expiresAt. The marker is written even if its expiry does not change,
+// so that a transaction releasing the attachment at the same time, which
+// reads the marker, conflicts with this one instead of missing its reference.
+func touchMarker(txn *badger.Txn, hash string, expiresAt uint64) error {
+	key := attachmentKey(hash)
+	value := []byte{}
+	item, err := txn.Get(key)
+	if err == nil {
+		if value, err = item.ValueCopy(nil); err != nil {
+			return err
+		}
+		expiresAt = max(expiresAt, item.ExpiresAt())
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	entry := badger.NewEntry(key, value)
+	entry.ExpiresAt = expiresAt
+	return txn.SetEntry(entry)
+}
+
+// extendUsage makes a guild's usage entry for an attachment live until at
+// least expiresAt, and moves its size to the hour it now expires in.
+func extendUsage(txn *badger.Txn, usageKey []byte, expiresAt uint64, usage *usageDelta) error {
+	item, err := txn.Get(usageKey)
+	if err != nil {
+		return err
+	}
+	if item.ExpiresAt() >= expiresAt {
+		return nil
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	entry := badger.NewEntry(usageKey, value)
+	entry.ExpiresAt = expiresAt
+	if err := txn.SetEntry(entry); err != nil {
+		return err
+	}
+
+	size, _ := strconv.ParseInt(string(value), 10, 64)
+	usage.removeAttachment(size, item.ExpiresAt())
+	usage.addAttachment(size, expiresAt)
+	return nil
+}
+
+// evictAttachments releases the oldest attachments of a guild until it uses
+// at most limit bytes, and returns the hashes of blobs no longer referenced.
+func evictAttachments(txn *badger.Txn, gid string, limit int64, usage *usageDelta) ([]string, error) {
+	type usageEntry struct {
+		key  []byte
+		size int64
+	}
+
+	prefix := []byte(fmt.Sprintf("attusage:%v:", gid))
+	var usages []usageEntry
+	var total int64
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		value, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		size, _ := strconv.ParseInt(string(value), 10, 64)
+		usages = append(usages, usageEntry{it.Item().KeyCopy(nil), size})
+		total += size
+	}
+	it.Close()
+
+	var released []string
+	for _, u := range usages {
+		if total <= limit {
+			break
+		}
+		hash, err := releaseAttachment(txn, u.key, usage)
+		if err != nil {
+			return nil, err
+		}
+		if hash != "" {
+			released = append(released, hash)
+		}
+		total -= u.size
+	}
+	return released, nil
+}
+
+// releaseAttachment removes a guild's usage entry and its references to the
+// attachment. If nothing else references the attachment, its marker is
+// removed and its hash is returned. The change to the guild's usage is added
+// to usage, if it is not nil.
+func releaseAttachment(txn *badger.Txn, usageKey []byte, usage *usageDelta) (string, error) {
+	// attusage:<gid>:<time>:<hash>
+	parts := strings.Split(string(usageKey), ":")
+	if len(parts) != 4 {
+		return "", fmt.Errorf("invalid attachment usage key %q", usageKey)
+	}
+	gid, hash := parts[1], parts[3]
+
+	if usage != nil {
+		item, err := txn.Get(usageKey)
+		if err != nil {
+			return "", err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return "", err
+		}
+		size, _ := strconv.ParseInt(string(value), 10, 64)
+		usage.removeAttachment(size, item.ExpiresAt())
+	}
+	if err := txn.Delete(usageKey); err != nil {
+		return "", err
+	}
+
+	// references added by other transactions are not seen while iterating, so
+	// the marker they write is read to make them conflict with this one
+	if _, err := txn.Get(attachmentKey(hash)); err != nil && err != badger.ErrKeyNotFound {
+		return "", err
+	}
+
+	prefix := []byte(fmt.Sprintf("attref:%v:", hash))
+	guildPrefix := []byte(fmt.Sprintf("attref:%v:%v:", hash, gid))
+	var refs [][]byte
+	referenced := false
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().KeyCopy(nil)
+		if bytes.HasPrefix(key, guildPrefix) {
+			refs = append(refs, key)
+		} else {
+			referenced = true
+		}
+	}
+	it.Close()
+
+	for _, key := range refs {
+		if err := txn.Delete(key); err != nil {
+			return "", err
+		}
+	}
+	if referenced {
+		return "", nil
+	}
+	return hash, txn.Delete(attachmentKey(hash))
+}
+
+// releaseGuildAttachments releases every attachment charged to a guild.
+func (s *Store) releaseGuildAttachments(gid string) error {
+	// released in batches to keep transactions small
+	const batchSize = 100
+	prefix := []byte(fmt.Sprintf("attusage:%v:", gid))
+	for {
+		var keys [][]byte
+		var released []string
+		err := s.db.Update(func(txn *badger.Txn) error {
+			keys, released = nil, nil
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			for it.Seek(prefix); it.ValidForPrefix(prefix) && len(keys) < batchSize; it.Next() {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+			it.Close()
+
+			for _, key := range keys {
+				// the guild's usage is forgotten with the rest of its data
+				hash, err := releaseAttachment(txn, key, nil)
+				if err != nil {
+					return err
+				}
+				if hash != "" {
+					released = append(released, hash)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		s.deleteBlobs(released)
+		if len(keys) < batchSize {
+			return nil
+		}
+	}
+}
+
+// SweepBlobs removes blobs that are no longer referenced by any cached
+// message, such as those whose messages have expired, and returns how many
+// were removed.
+func (s *Store) SweepBlobs() (int, error) {
+	var orphaned []string
+	err := s.blobs.Keys(func(hash string) error {
+		inUse, err := s.blobInUse(hash)
+		if err == nil && !inUse {
+			orphaned = append(orphaned, hash)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return s.deleteBlobs(orphaned), nil
+}
+
+// runBlobSweeps periodically removes unreferenced attachment blobs, until ctx
+// is done.
+func (b *Bot) runBlobSweeps(ctx context.Context) {
+	ticker := time.NewTicker(blobSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		n, err := b.store.SweepBlobs()
+		if err != nil {
+			b.logger.Error("failed to sweep attachments", zap.Error(err))
+			continue
+		}
+		if n > 0 {
+			b.logger.Info("removed unreferenced attachments", zap.Int("count", n))
+		}
+	}
+}
+
+// LoadAttachments reads the data of a message's attachments. Attachments that
+// have been evicted are left without data.
+func (s *Store) LoadAttachments(msg *DiscordMessage) error {
+	for _, a := range msg.Attachments {
+		if a.Data != nil || a.Hash == "" {
+			continue
+		}
+		data, err := s.blobs.Get(a.Hash)
+		if err == ErrBlobNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(data) > 0 {
+			a.Data = data
+		}
+	}
+	return nil
+}
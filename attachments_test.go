@@ -0,0 +1,151 @@
+package stare
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// attachmentState reports whether a cached message references an attachment,
+// and whether its blob is stored.
+func attachmentState(t *testing.T, s *Store, hash string) (referenced, stored bool) {
+	t.Helper()
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(fmt.Sprintf("attref:%v:", hash))
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		it.Seek(prefix)
+		referenced = it.ValidForPrefix(prefix)
+		it.Close()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View() error = %v", err)
+	}
+	stored, err = s.blobs.Exists(hash)
+	if err != nil {
+		t.Fatalf("Exists() error = %v", err)
+	}
+	return referenced, stored
+}
+
+func TestDeleteBlobsKeepsReferencedBlobs(t *testing.T) {
+	s := newTestStore(t, nil)
+	defer s.Close()
+
+	data := []byte("attachment")
+	msg := &DiscordMessage{
+		Message:     testMessage(0, "10", ""),
+		Attachments: []*Attachment{{Filename: "a.txt", Size: len(data), Data: data}},
+	}
+	if err := s.SetMessage(msg, 24*time.Hour, 1024); err != nil {
+		t.Fatalf("SetMessage() error = %v", err)
+	}
+	orphan := hashAttachment([]byte("orphan"))
+	if err := s.blobs.Put(orphan, []byte("orphan")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	// a blob released by an earlier transaction that is referenced again
+	if n := s.deleteBlobs([]string{msg.Attachments[0].Hash, orphan}); n != 1 {
+		t.Errorf("deleteBlobs() = %v, want 1", n)
+	}
+	if ok, err := s.blobs.Exists(msg.Attachments[0].Hash); err != nil || !ok {
+		t.Errorf("Exists() = %v, %v, a referenced blob must not be deleted", ok, err)
+	}
+	if ok, err := s.blobs.Exists(orphan); err != nil || ok {
+		t.Errorf("Exists() = %v, %v, want the orphaned blob deleted", ok, err)
+	}
+}
+
+func TestReleaseAttachmentConflictsWithNewReference(t *testing.T) {
+	s := newTestStore(t, nil)
+	defer s.Close()
+	data := []byte("attachment")
+	hash := hashAttachment(data)
+	set := func(gid string) {
+		t.Helper()
+		msg := &DiscordMessage{
+			Message:     testMessage(0, "10", ""),
+			Attachments: []*Attachment{{Filename: "a.txt", Size: len(data), Data: data}},
+		}
+		msg.Message.GuildID = gid
+		if err := s.SetMessage(msg, 24*time.Hour, 1024); err != nil {
+			t.Fatalf("SetMessage() error = %v", err)
+		}
+	}
+	set("1")
+
+	// guild 1 releases the only reference to the attachment, while guild 2
+	// references it for the first time
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+	usageKey, err := findUsageKey(txn, hash, "1")
+	if err != nil || usageKey == nil {
+		t.Fatalf("findUsageKey() = %q, %v, want the usage key of guild 1", usageKey, err)
+	}
+	if _, err := releaseAttachment(txn, usageKey, newUsageDelta()); err != nil {
+		t.Fatalf("releaseAttachment() error = %v", err)
+	}
+	set("2")
+	if err := txn.Commit(); err != badger.ErrConflict {
+		t.Errorf("Commit() error = %v, want %v", err, badger.ErrConflict)
+	}
+
+	if referenced, stored := attachmentState(t, s, hash); !referenced || !stored {
+		t.Errorf("attachment referenced = %v, stored = %v, want it kept for guild 2", referenced, stored)
+	}
+}
+
+func TestAttachmentsConcurrentReuse(t *testing.T) {
+	s := newTestStore(t, nil)
+	defer s.Close()
+
+	// every guild has room for one attachment, so caching one releases the
+	// other, while other guilds put the same content again
+	contents := [][]byte{[]byte("aaaaaa"), []byte("bbbbbb")}
+	const guilds, rounds = 4, 20
+	var wg sync.WaitGroup
+	for g := 0; g < guilds; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				data := contents[(g+i)%len(contents)]
+				msg := &DiscordMessage{
+					Message:     testMessage(i, "10", ""),
+					Attachments: []*Attachment{{Filename: "a.txt", Size: len(data), Data: data}},
+				}
+				msg.Message.GuildID = fmt.Sprint(g)
+				if err := s.SetMessage(msg, 24*time.Hour, 8); err != nil && err != badger.ErrConflict {
+					t.Errorf("SetMessage() error = %v", err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// every attachment that is still referenced must have its data
+	for _, data := range contents {
+		if referenced, stored := attachmentState(t, s, hashAttachment(data)); referenced && !stored {
+			t.Errorf("attachment %q is referenced, but its blob was deleted", data)
+		}
+	}
+
+	for g := 0; g < guilds; g++ {
+		msg, err := s.GetMessage(fmt.Sprint(g), "10", testMessage(rounds-1, "10", "").ID)
+		if err != nil {
+			continue
+		}
+		if err := s.LoadAttachments(msg); err != nil {
+			t.Fatalf("LoadAttachments() error = %v", err)
+		}
+		if msg.Attachments[0].Data == nil {
+			t.Errorf("guild %v: the attachment of the newest message has no data", g)
+		}
+	}
+}
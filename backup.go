@@ -0,0 +1,227 @@
+package stare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/intrntsrfr/meido/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultBackupKeep is how many backup files are kept, unless the
+	// operator sets a different number
+	defaultBackupKeep = 7
+	// maxPendingRestoreWrites is how many writes may be pending while a
+	// backup is loaded
+	maxPendingRestoreWrites = 256
+
+	backupFilePrefix = "stare-"
+	backupFileSuffix = ".bak"
+	backupTimeFormat = "20060102-150405"
+)
+
+var errBackupUnsupported = errors.New("the cache store does not support backups")
+
+// backupPath returns the directory backup files are written to.
+func backupPath(cfg *utils.Config) string {
+	if path := cfg.GetString("backup_path"); path != "" {
+		return path
+	}
+	return "./backups"
+}
+
+// backupKeep returns how many backup files are kept.
+func backupKeep(cfg *utils.Config) int {
+	if keep := cfg.GetInt("backup_keep"); keep > 0 {
+		return keep
+	}
+	return defaultBackupKeep
+}
+
+// backupInterval returns how often backups are made, or 0 if scheduled
+// backups are disabled.
+func (b *Bot) backupInterval() time.Duration {
+	str := b.config.GetString("backup_interval")
+	if str == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d < time.Minute {
+		b.logger.Warn("invalid backup interval, scheduled backups are disabled", zap.String("value", str))
+		return 0
+	}
+	return d
+}
+
+// runBackups periodically backs up the cache store, until ctx is done.
+func (b *Bot) runBackups(ctx context.Context) {
+	interval := b.backupInterval()
+	if interval == 0 {
+		return
+	}
+	if backupSkipsAttachments(b.store) {
+		b.logger.Warn("attachments are not kept in the cache database, so they are not backed up")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		path, err := backupStore(b.store, b.config)
+		if err != nil {
+			b.logger.Error("failed to back up store", zap.Error(err))
+			continue
+		}
+		b.logger.Info("backed up store", zap.String("path", path))
+	}
+}
+
+// backupStore backs up a cache store to a new file in the backup directory
+// set in the config, and removes the oldest backups beyond the number kept.
+// It returns the path of the new backup.
+func backupStore(store CacheStore, cfg *utils.Config) (string, error) {
+	s, ok := store.(*Store)
+	if !ok {
+		return "", errBackupUnsupported
+	}
+
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+
+	dir := backupPath(cfg)
+	path, err := s.BackupTo(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := pruneBackups(dir, backupKeep(cfg)); err != nil {
+		return path, err
+	}
+	return path, nil
+}
+
+// backupSkipsAttachments reports whether backups of a cache store leave out
+// attachment data, which they do when it is kept in a separate blob store.
+func backupSkipsAttachments(store CacheStore) bool {
+	s, ok := store.(*Store)
+	return ok && !s.blobsInDB
+}
+
+// Backup writes a full backup of the store to w. The store stays usable while
+// the backup is made, and the backup holds a consistent snapshot.
+func (s *Store) Backup(w io.Writer) error {
+	_, err := s.db.Backup(w, 0)
+	return err
+}
+
+// BackupTo writes a full backup of the store to a new timestamped file in dir,
+// and returns its path. The file only appears once the backup is complete.
+func (s *Store) BackupTo(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	name := backupFilePrefix + time.Now().UTC().Format(backupTimeFormat) + backupFileSuffix
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("backup %v already exists", path)
+	}
+
+	f, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if err := s.Backup(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// pruneBackups removes the oldest backup files in dir, keeping the newest
+// keep files.
+func pruneBackups(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.Type().IsRegular() && strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileSuffix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) <= keep {
+		return nil
+	}
+
+	// the names sort by the time they were made
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore loads a backup file into the store directory set in the config.
+// The directory must not hold any data yet, and the bot must not be running.
+func Restore(cfg *utils.Config, path string) error {
+	logger := newLogger("restore")
+
+	dir := storePath(cfg)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("store directory %v is not empty", dir)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	db, err := openBadger(logger, dir)
+	if err != nil {
+		return err
+	}
+	if err := db.Load(f, maxPendingRestoreWrites); err != nil {
+		db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	logger.Info("restored store", zap.String("backup", path), zap.String("path", dir))
+	return nil
+}
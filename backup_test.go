@@ -0,0 +1,160 @@
+package stare
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/intrntsrfr/meido/pkg/utils"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	src := newTestStore(t, nil)
+	defer src.Close()
+	if err := src.SetMember(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: "100", Username: "user"}}); err != nil {
+		t.Fatalf("SetMember() error = %v", err)
+	}
+	data := []byte("attachment")
+	err := src.SetMessage(&DiscordMessage{
+		Message:     testMessage(0, "10", "hello"),
+		Attachments: []*Attachment{{Filename: "a.txt", Size: len(data), Data: data}},
+	}, time.Hour, 1024)
+	if err != nil {
+		t.Fatalf("SetMessage() error = %v", err)
+	}
+
+	cfg := utils.NewConfig()
+	cfg.Set("backup_path", t.TempDir())
+	cfg.Set("store_path", filepath.Join(t.TempDir(), "restored"))
+	path, err := backupStore(src, cfg)
+	if err != nil {
+		t.Fatalf("backupStore() error = %v", err)
+	}
+	if err := Restore(cfg, path); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	// a store can only be restored into an empty directory
+	if err := Restore(cfg, path); err == nil {
+		t.Errorf("Restore() into a store with data error = nil, want an error")
+	}
+
+	s := openTestStore(t, storePath(cfg), nil)
+	defer s.Close()
+	if m, err := s.GetMember(testGuildID, "100"); err != nil || m.User.Username != "user" {
+		t.Errorf("GetMember() = %v, %v, want the backed up member", m, err)
+	}
+	msg, err := s.GetMessage(testGuildID, "10", testMessage(0, "10", "").ID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if err := s.LoadAttachments(msg); err != nil {
+		t.Fatalf("LoadAttachments() error = %v", err)
+	}
+	if msg.Message.Content != "hello" || string(msg.Attachments[0].Data) != "attachment" {
+		t.Errorf("GetMessage() = %q with attachment %q, want the backed up message", msg.Message.Content, msg.Attachments[0].Data)
+	}
+}
+
+func TestBackupStore(t *testing.T) {
+	blobs, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileBlobStore() error = %v", err)
+	}
+	withBlobs, err := NewStore(&ZapLogger{zaptest.NewLogger(t)}, t.TempDir(), blobs, nil)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	defer withBlobs.Close()
+	s := newTestStore(t, nil)
+	defer s.Close()
+
+	tests := []struct {
+		name            string
+		store           CacheStore
+		wantErr         error
+		skipAttachments bool
+	}{
+		{"Store", s, nil, false},
+		{"SeparateBlobs", withBlobs, nil, true},
+		{"MemoryStore", NewMemoryStore(), errBackupUnsupported, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := utils.NewConfig()
+			cfg.Set("backup_path", t.TempDir())
+			if _, err := backupStore(tt.store, cfg); !errors.Is(err, tt.wantErr) {
+				t.Errorf("backupStore() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := backupSkipsAttachments(tt.store); got != tt.skipAttachments {
+				t.Errorf("backupSkipsAttachments() = %v, want %v", got, tt.skipAttachments)
+			}
+		})
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	backups := []string{
+		"stare-20240101-000000.bak",
+		"stare-20240103-000000.bak",
+		"stare-20240102-000000.bak",
+	}
+	// files that are not backups are kept
+	others := []string{"notes.txt", "stare-20240101-000000.bak.123.tmp"}
+
+	tests := []struct {
+		name string
+		keep int
+		want []string
+	}{
+		{"KeepAll", 3, backups},
+		{"KeepMore", 5, backups},
+		{"KeepNewest", 2, backups[1:]},
+		{"KeepOne", 1, backups[1:2]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range append(slices.Clone(backups), others...) {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+					t.Fatalf("WriteFile() error = %v", err)
+				}
+			}
+			// a directory named like a backup is not removed
+			if err := os.Mkdir(filepath.Join(dir, "stare-20230101-000000.bak"), 0o700); err != nil {
+				t.Fatalf("Mkdir() error = %v", err)
+			}
+
+			if err := pruneBackups(dir, tt.keep); err != nil {
+				t.Fatalf("pruneBackups() error = %v", err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("ReadDir() error = %v", err)
+			}
+			var got []string
+			for _, e := range entries {
+				if e.Type().IsRegular() && strings.HasSuffix(e.Name(), backupFileSuffix) {
+					got = append(got, e.Name())
+				}
+			}
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("backups after pruneBackups() = %v, want %v", got, want)
+			}
+			if len(entries) != len(got)+len(others)+1 {
+				t.Errorf("pruneBackups() left %v entries, want the other files kept", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package stare
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+	"github.com/intrntsrfr/meido/pkg/utils"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ErrBlobNotFound is returned when a blob does not exist in a BlobStore.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores the data of cached attachments, keyed by content hash.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	// Get returns ErrBlobNotFound if there is no blob with the key.
+	Get(key string) ([]byte, error)
+	// Delete does not return an error if there is no blob with the key.
+	Delete(key string) error
+	Exists(key string) (bool, error)
+	// Keys calls fn with the key of every stored blob.
+	Keys(fn func(key string) error) error
+}
+
+// newBlobStore creates the blob store set in the config, or returns nil if
+// attachments should be kept in badger.
+func newBlobStore(cfg *utils.Config) (BlobStore, error) {
+	switch backend := cfg.GetString("attachment_backend"); backend {
+	case "", "badger":
+		return nil, nil
+	case "filesystem":
+		path := cfg.GetString("attachment_path")
+		if path == "" {
+			path = "./attachments"
+		}
+		return NewFileBlobStore(path)
+	case "s3":
+		return NewS3BlobStore(&S3Config{
+			Endpoint:  cfg.GetString("s3_endpoint"),
+			Region:    cfg.GetString("s3_region"),
+			Bucket:    cfg.GetString("s3_bucket"),
+			Prefix:    cfg.GetString("s3_prefix"),
+			AccessKey: cfg.GetString("s3_access_key"),
+			SecretKey: cfg.GetString("s3_secret_key"),
+			Insecure:  cfg.GetString("s3_insecure") == "true",
+		})
+	default:
+		return nil, fmt.Errorf("unsupported attachment backend %q", backend)
+	}
+}
+
+//
+// Badger
+//
+
+// badgerBlobStore keeps blobs in the badger database of the Store.
+type badgerBlobStore struct {
+	db *badger.DB
+}
+
+const badgerBlobPrefix = "blob:"
+
+func (b *badgerBlobStore) Put(key string, data []byte) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(badgerBlobPrefix+key), data)
+	})
+}
+
+func (b *badgerBlobStore) Get(key string) ([]byte, error) {
+	var data []byte
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(badgerBlobPrefix + key))
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (b *badgerBlobStore) Delete(key string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(badgerBlobPrefix + key))
+	})
+}
+
+func (b *badgerBlobStore) Exists(key string) (bool, error) {
+	err := b.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(badgerBlobPrefix + key))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *badgerBlobStore) Keys(fn func(key string) error) error {
+	prefix := []byte(badgerBlobPrefix)
+	return b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := strings.TrimPrefix(string(it.Item().Key()), badgerBlobPrefix)
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//
+// Filesystem
+//
+
+// FileBlobStore keeps every blob in its own file in a directory.
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// path returns where a blob is stored. Blobs are spread over subdirectories
+// by the first two characters of the key, to keep directories small.
+func (f *FileBlobStore) path(key string) (string, error) {
+	if len(key) < 2 || strings.ContainsAny(key, `/\.`) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(f.dir, key[:2], key), nil
+}
+
+func (f *FileBlobStore) Put(key string, data []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o644)
+}
+
+func (f *FileBlobStore) Get(key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (f *FileBlobStore) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileBlobStore) Exists(key string) (bool, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (f *FileBlobStore) Keys(fn func(key string) error) error {
+	return filepath.WalkDir(f.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// skip directories and temporary files from interrupted writes
+		if d.IsDir() || strings.Contains(d.Name(), ".") {
+			return nil
+		}
+		return fn(d.Name())
+	})
+}
+
+//
+// S3
+//
+
+// S3Config holds the settings of an S3 compatible object storage.
+type S3Config struct {
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every object key
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Insecure connects over plain HTTP, such as to a local test server
+	Insecure bool
+}
+
+// S3BlobStore keeps blobs as objects in an S3 compatible bucket.
+type S3BlobStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3BlobStore connects to the object storage and creates the bucket if it
+// does not exist yet.
+func NewS3BlobStore(cfg *S3Config) (*S3BlobStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 endpoint and bucket are required")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3BlobStore{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: cfg.Prefix,
+	}, nil
+}
+
+func (s *S3BlobStore) Put(key string, data []byte) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.prefix+key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+func (s *S3BlobStore) Get(key string) ([]byte, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	if isNoSuchKey(err) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3BlobStore) Exists(key string) (bool, error) {
+	_, err := s.client.StatObject(context.Background(), s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if isNoSuchKey(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *S3BlobStore) Keys(fn func(key string) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix,
+		Recursive: true,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := fn(strings.TrimPrefix(obj.Key, s.prefix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isNoSuchKey(err error) bool {
+	return err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
@@ -0,0 +1,283 @@
+package stare
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlobStores(t *testing.T) {
+	stores := []struct {
+		name     string
+		newStore func(t *testing.T) BlobStore
+	}{
+		{"Badger", func(t *testing.T) BlobStore {
+			db, err := openBadger(newLogger("test"), t.TempDir())
+			if err != nil {
+				t.Fatalf("openBadger() error = %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return &badgerBlobStore{db: db}
+		}},
+		{"Filesystem", func(t *testing.T) BlobStore {
+			s, err := NewFileBlobStore(t.TempDir())
+			if err != nil {
+				t.Fatalf("NewFileBlobStore() error = %v", err)
+			}
+			return s
+		}},
+		{"S3", func(t *testing.T) BlobStore {
+			srv := httptest.NewServer(newFakeS3())
+			t.Cleanup(srv.Close)
+			s, err := NewS3BlobStore(&S3Config{
+				Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+				Region:    "us-east-1",
+				Bucket:    "stare",
+				Prefix:    "attachments/",
+				AccessKey: "access",
+				SecretKey: "secret",
+				Insecure:  true,
+			})
+			if err != nil {
+				t.Fatalf("NewS3BlobStore() error = %v", err)
+			}
+			return s
+		}},
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s BlobStore)
+	}{
+		{"PutGet", testBlobPutGet},
+		{"GetNotFound", testBlobGetNotFound},
+		{"Delete", testBlobDelete},
+		{"DeleteNotFound", testBlobDeleteNotFound},
+		{"Keys", testBlobKeys},
+	}
+
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					tt.fn(t, st.newStore(t))
+				})
+			}
+		})
+	}
+}
+
+func mustPutBlob(t *testing.T, s BlobStore, key, data string) {
+	t.Helper()
+	if err := s.Put(key, []byte(data)); err != nil {
+		t.Fatalf("Put(%q) error = %v", key, err)
+	}
+}
+
+func testBlobPutGet(t *testing.T, s BlobStore) {
+	mustPutBlob(t, s, "aa01", "first")
+	mustPutBlob(t, s, "aa01", "second")
+
+	data, err := s.Get("aa01")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(data) != "second" {
+		t.Errorf("Get() = %q, want %q", data, "second")
+	}
+	if ok, err := s.Exists("aa01"); err != nil || !ok {
+		t.Errorf("Exists() = %v, %v, want true", ok, err)
+	}
+}
+
+func testBlobGetNotFound(t *testing.T, s BlobStore) {
+	if _, err := s.Get("aa01"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrBlobNotFound)
+	}
+	if ok, err := s.Exists("aa01"); err != nil || ok {
+		t.Errorf("Exists() = %v, %v, want false", ok, err)
+	}
+}
+
+func testBlobDelete(t *testing.T, s BlobStore) {
+	mustPutBlob(t, s, "aa01", "data")
+	mustPutBlob(t, s, "aa02", "data")
+	if err := s.Delete("aa01"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := s.Get("aa01"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrBlobNotFound)
+	}
+	if _, err := s.Get("aa02"); err != nil {
+		t.Errorf("Get() error = %v, other blobs must be kept", err)
+	}
+}
+
+func testBlobDeleteNotFound(t *testing.T, s BlobStore) {
+	if err := s.Delete("aa01"); err != nil {
+		t.Errorf("Delete() error = %v, want nil", err)
+	}
+}
+
+func testBlobKeys(t *testing.T, s BlobStore) {
+	want := []string{"aa01", "ab02", "bb03"}
+	for _, key := range want {
+		mustPutBlob(t, s, key, key)
+	}
+
+	var keys []string
+	if err := s.Keys(func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatalf("Keys() error = %v", err)
+	}
+	slices.Sort(keys)
+	if !slices.Equal(keys, want) {
+		t.Errorf("Keys() = %v, want %v", keys, want)
+	}
+
+	errStop := errors.New("stop")
+	if err := s.Keys(func(key string) error {
+		return errStop
+	}); !errors.Is(err, errStop) {
+		t.Errorf("Keys() error = %v, want the error of fn", err)
+	}
+}
+
+// fakeS3 is an in-memory stand-in for the parts of the S3 API used by
+// S3BlobStore.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{buckets: make(map[string]map[string][]byte)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	objects, ok := f.buckets[bucket]
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case key == "" && r.Method == http.MethodPut:
+		f.buckets[bucket] = make(map[string][]byte)
+	case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r, bucket, objects)
+	case !ok:
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+	case r.Method == http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string, objects map[string][]byte) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []content
+	}{Name: bucket, Prefix: r.URL.Query().Get("prefix"), MaxKeys: 1000}
+
+	for key, data := range objects {
+		if strings.HasPrefix(key, result.Prefix) {
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				LastModified: time.Unix(0, 0).UTC().Format(time.RFC3339),
+				ETag:         `"etag"`,
+				Size:         len(data),
+			})
+		}
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// readS3Body reads the body of an upload, which is sent in signed chunks over
+// plain HTTP.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		// <hex size>;chunk-signature=<signature>\r\n<data>\r\n
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		hexSize, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(hexSize, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message></Error>", code, code)
+}
@@ -9,11 +9,14 @@ import (
 )
 
 type Bot struct {
-	Bot    *bot.Bot
-	logger mio.Logger
-	config *utils.Config
-	db     DB
-	store  *Store
+	Bot      *bot.Bot
+	logger   mio.Logger
+	config   *utils.Config
+	db       DB
+	store    CacheStore
+	webhooks *webhookCache
+
+	lifecycle lifecycle
 }
 
 func NewBot(config *utils.Config, db DB) *Bot {
@@ -24,34 +27,40 @@ func NewBot(config *utils.Config, db DB) *Bot {
 		WithLogger(logger).
 		Build()
 
-	kvStore, err := NewStore(logger)
+	kvStore, err := newCacheStore(config, logger)
 	if err != nil {
-		panic("failed to create kvstore")
+		panic("failed to create kvstore: " + err.Error())
 	}
 
 	return &Bot{
-		Bot:    b,
-		db:     db,
-		logger: logger,
-		config: config,
-		store:  kvStore,
+		Bot:      b,
+		db:       db,
+		logger:   logger,
+		config:   config,
+		store:    kvStore,
+		webhooks: newWebhookCache(),
 	}
 }
 
+// Run connects to Discord and starts the background jobs. The bot runs until
+// Shutdown is called.
 func (b *Bot) Run(ctx context.Context) error {
+	b.checkMaxMessageRetention()
 	b.registerModules()
 	b.registerDiscordHandlers()
 	b.registerMioHandlers()
-	return b.Bot.Run(ctx)
-}
 
-func (b *Bot) Close() {
-	b.Bot.Close()
+	jobCtx, cancel := context.WithCancel(ctx)
+	b.lifecycle.stopJobs = cancel
+	b.goJob(jobCtx, b.runPurges)
+	b.goJob(jobCtx, b.runBlobSweeps)
+	b.goJob(jobCtx, b.runBackups)
+	return b.Bot.Run(ctx)
 }
 
 func (b *Bot) registerModules() {
 	modules := []bot.Module{
-		NewModule(b.Bot, b.db, b.logger),
+		NewModule(b.Bot, b.db, b.store, b.logger, &b.lifecycle),
 	}
 	for _, mod := range modules {
 		b.Bot.RegisterModule(mod)
@@ -59,18 +68,29 @@ func (b *Bot) registerModules() {
 }
 
 func (b *Bot) registerDiscordHandlers() {
-	b.Bot.Discord.AddEventHandler(disconnectHandler(b))
-	b.Bot.Discord.AddEventHandler(guildBanAddHandler(b))
-	b.Bot.Discord.AddEventHandler(guildBanRemoveHandler(b))
-	b.Bot.Discord.AddEventHandler(guildCreateHandler(b))
-	b.Bot.Discord.AddEventHandler(guildMemberAddHandler(b))
-	b.Bot.Discord.AddEventHandler(guildMemberRemoveHandler(b))
-	b.Bot.Discord.AddEventHandler(guildMemberUpdateHandler(b))
-	b.Bot.Discord.AddEventHandler(guildMembersChunkHandler(b))
-	b.Bot.Discord.AddEventHandler(messageCreateHandler(b))
-	b.Bot.Discord.AddEventHandler(messageDeleteBulkHandler(b))
-	b.Bot.Discord.AddEventHandler(messageDeleteHandler(b))
-	b.Bot.Discord.AddEventHandler(messageUpdateHandler(b))
+	b.Bot.Discord.AddEventHandler(tracked(b, channelCreateHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, channelDeleteHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, channelUpdateHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, disconnectHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildBanAddHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildBanRemoveHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildCreateHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildDeleteHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildMemberAddHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildMemberRemoveHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildMemberUpdateHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildMembersChunkHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildRoleCreateHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildRoleDeleteHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, guildRoleUpdateHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, messageCreateHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, messageDeleteBulkHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, messageDeleteHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, messageUpdateHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, threadCreateHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, threadDeleteHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, threadListSyncHandler(b)))
+	b.Bot.Discord.AddEventHandler(tracked(b, threadUpdateHandler(b)))
 }
 
 func (b *Bot) registerMioHandlers() {
@@ -3,39 +3,149 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/intrntsrfr/meido/pkg/utils"
 	"github.com/intrntsrfr/stare"
 )
 
 func main() {
+	rekey := flag.Bool("rekey", false, "re-encrypt the stored data with the current encryption key, then exit")
+	rotateDataKeys := flag.Bool("rotate-data-keys", false, "replace the data keys when re-encrypting")
+	restore := flag.String("restore", "", "load a backup file into an empty store directory before starting")
+	flag.Parse()
+
 	cfg := utils.NewConfig()
 	loadConfig(cfg, "./config.json")
 
-	jsonDb, err := stare.NewJsonDatabase("./data.json")
-	if err != nil {
-		panic(err)
+	if *rekey {
+		res, err := stare.Rekey(cfg, *rotateDataKeys)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("re-encrypted %v data keys, %v values and %v attachments\n", res.DataKeys, res.Values, res.Blobs)
+		return
+	}
+
+	if *restore != "" {
+		if err := stare.Restore(cfg, *restore); err != nil {
+			panic(err)
+		}
+		fmt.Printf("restored %v\n", *restore)
 	}
-	defer jsonDb.Close()
 
-	bot := stare.NewBot(cfg, jsonDb)
-	defer bot.Close()
+	os.Exit(run(cfg))
+}
+
+// shutdownTimeout is how long in-flight events may take to finish on
+// shutdown
+const shutdownTimeout = 30 * time.Second
 
-	if err := bot.Run(context.Background()); err != nil {
-		panic(err)
+const (
+	exitOK = iota
+	// exitStartFailed means the bot could not start
+	exitStartFailed
+	// exitShutdownFailed means the bot did not shut down cleanly, and may
+	// not have saved everything
+	exitShutdownFailed
+)
+
+// run runs the bot until SIGINT or SIGTERM, then shuts it down and returns the
+// exit status.
+func run(cfg *utils.Config) int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	backend, err := openDatabase(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to open database:", err)
+		return exitStartFailed
 	}
+	db := stare.NewCachedDB(backend)
 
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
-	<-sc
+	status := exitOK
+	bot := stare.NewBot(cfg, db)
+	if err := bot.Run(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to start bot:", err)
+		status = exitStartFailed
+	} else {
+		<-ctx.Done()
+	}
+	// a second signal stops the process right away
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := bot.Shutdown(shutdownCtx); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to shut down bot:", err)
+		status = max(status, exitShutdownFailed)
+		if errors.Is(err, stare.ErrShutdownTimeout) {
+			// handlers are still running and may use the database
+			return status
+		}
+	}
+	if err := db.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to close database:", err)
+		status = max(status, exitShutdownFailed)
+	}
+	return status
 }
 
 type config struct {
-	Token  string `json:"token"`
-	Shards int    `json:"shards"`
+	Token               string           `json:"token"`
+	Shards              int              `json:"shards"`
+	OwnerIDs            []string         `json:"owner_ids"`
+	Database            databaseConfig   `json:"database"`
+	PurgeGracePeriod    string           `json:"purge_grace_period"`
+	MaxMessageRetention string           `json:"max_message_retention"`
+	AttachmentQuotaMB   int              `json:"guild_attachment_quota_mb"`
+	Attachments         blobConfig       `json:"attachments"`
+	Encryption          encryptionConfig `json:"encryption"`
+	Store               storeConfig      `json:"store"`
+	Backup              backupConfig     `json:"backup"`
+}
+
+type databaseConfig struct {
+	Driver           string `json:"driver"`
+	ConnectionString string `json:"connection_string"`
+}
+
+type storeConfig struct {
+	Backend string `json:"backend"`
+	Path    string `json:"path"`
+}
+
+type backupConfig struct {
+	Path     string `json:"path"`
+	Interval string `json:"interval"`
+	Keep     int    `json:"keep"`
+}
+
+type blobConfig struct {
+	Backend string   `json:"backend"`
+	Path    string   `json:"path"`
+	S3      s3Config `json:"s3"`
+}
+
+type encryptionConfig struct {
+	Key     string `json:"key"`
+	KeyFile string `json:"key_file"`
+}
+
+type s3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Insecure  bool   `json:"insecure"`
 }
 
 func loadConfig(cfg *utils.Config, path string) {
@@ -51,4 +161,54 @@ func loadConfig(cfg *utils.Config, path string) {
 
 	cfg.Set("token", c.Token)
 	cfg.Set("shards", c.Shards)
+	cfg.Set("owner_ids", c.OwnerIDs)
+	cfg.Set("db_driver", c.Database.Driver)
+	cfg.Set("db_connection_string", c.Database.ConnectionString)
+	cfg.Set("purge_grace_period", c.PurgeGracePeriod)
+	cfg.Set("max_message_retention", c.MaxMessageRetention)
+	cfg.Set("guild_attachment_quota_mb", c.AttachmentQuotaMB)
+	cfg.Set("attachment_backend", c.Attachments.Backend)
+	cfg.Set("attachment_path", c.Attachments.Path)
+	cfg.Set("s3_endpoint", c.Attachments.S3.Endpoint)
+	cfg.Set("s3_region", c.Attachments.S3.Region)
+	cfg.Set("s3_bucket", c.Attachments.S3.Bucket)
+	cfg.Set("s3_prefix", c.Attachments.S3.Prefix)
+	cfg.Set("s3_access_key", c.Attachments.S3.AccessKey)
+	cfg.Set("s3_secret_key", c.Attachments.S3.SecretKey)
+	cfg.Set("s3_insecure", fmt.Sprint(c.Attachments.S3.Insecure))
+	cfg.Set("encryption_key", c.Encryption.Key)
+	cfg.Set("encryption_key_file", c.Encryption.KeyFile)
+	cfg.Set("store_backend", c.Store.Backend)
+	cfg.Set("store_path", c.Store.Path)
+	cfg.Set("backup_path", c.Backup.Path)
+	cfg.Set("backup_interval", c.Backup.Interval)
+	cfg.Set("backup_keep", c.Backup.Keep)
+}
+
+func openDatabase(cfg *utils.Config) (stare.DB, error) {
+	driver := cfg.GetString("db_driver")
+	connStr := cfg.GetString("db_connection_string")
+
+	switch driver {
+	case "", "json":
+		if connStr == "" {
+			connStr = "./data.json"
+		}
+		db, err := stare.NewJsonDatabase(connStr)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "sqlite3", "postgres":
+		db, err := stare.NewSqlDatabase(&stare.Config{
+			Driver:  driver,
+			ConnStr: connStr,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
 }
@@ -1,8 +1,10 @@
 package stare
 
 import (
+	"errors"
 	"fmt"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
 
@@ -10,21 +12,27 @@ import (
 	"github.com/intrntsrfr/meido/pkg/mio"
 	"github.com/intrntsrfr/meido/pkg/mio/bot"
 	"github.com/intrntsrfr/meido/pkg/mio/discord"
+	"github.com/intrntsrfr/meido/pkg/utils"
 	"github.com/intrntsrfr/meido/pkg/utils/builders"
+	"go.uber.org/zap"
 )
 
 type module struct {
 	*bot.ModuleBase
 	startTime time.Time
 	db        DB
+	store     CacheStore
+	lifecycle *lifecycle
 }
 
-func NewModule(b *bot.Bot, db DB, logger mio.Logger) *module {
+func NewModule(b *bot.Bot, db DB, store CacheStore, logger mio.Logger, lc *lifecycle) *module {
 	logger = logger.Named("commands")
 	return &module{
 		ModuleBase: bot.NewModule(b, "commands", logger),
 		db:         db,
+		store:      store,
 		startTime:  time.Now(),
+		lifecycle:  lc,
 	}
 }
 
@@ -36,6 +44,9 @@ func (m *module) Hook() error {
 		newInfoSlash(m),
 		newHelpSlash(m),
 		newSettingsSlash(m),
+		newHistorySlash(m),
+		newSearchSlash(m),
+		newAdminSlash(m),
 	); err != nil {
 		return err
 	}
@@ -58,9 +69,15 @@ func newHelpSlash(m *module) *bot.ModuleApplicationCommand {
 		text.WriteString("1. When a message is edited\n")
 		text.WriteString("1. When a user is banned\n")
 		text.WriteString("1. When a user is unbanned\n")
+		text.WriteString("1. When a role is created, changed or deleted\n")
+		text.WriteString("1. When a channel is created, changed or deleted\n")
 		text.WriteString("\n")
 		text.WriteString("To view the current settings, use the `/settings view` command\n")
 		text.WriteString("To set a log channel, use the `/settings set` command\n")
+		text.WriteString("To stop logging a channel, category, user or role, use the `/settings ignore add` command\n")
+		text.WriteString("To see who changed the settings, use the `/settings history` command\n")
+		text.WriteString("To get a transcript of what was said in a channel, use the `/history channel` command\n")
+		text.WriteString("To search cached messages, use the `/search` command\n")
 		text.WriteString("\n")
 
 		embed := builders.NewEmbedBuilder().
@@ -70,7 +87,7 @@ func newHelpSlash(m *module) *bot.ModuleApplicationCommand {
 		d.RespondEmbed(embed.Build())
 	}
 
-	return cmd.Execute(run).Build()
+	return cmd.Execute(trackedCommand(m.lifecycle, run)).Build()
 }
 
 func newInfoSlash(m *module) *bot.ModuleApplicationCommand {
@@ -85,30 +102,40 @@ func newInfoSlash(m *module) *bot.ModuleApplicationCommand {
 			AddField("Golang version", runtime.Version(), false).
 			AddField("Running since", fmt.Sprintf("<t:%v:R>", m.startTime.Unix()), false).
 			AddField("Total guilds", fmt.Sprintf("%v", d.Discord.GuildCount()), false)
+		if cache, ok := m.db.(*CachedDB); ok {
+			stats := cache.Stats()
+			embed.AddField("Settings cache", fmt.Sprintf("%v cached, %v hits, %v misses", stats.Size, stats.Hits, stats.Misses), false)
+		}
+		if usage, err := m.store.StorageStats(); err == nil {
+			var total GuildStorage
+			for _, gs := range usage {
+				total.Members += gs.Members
+				total.Messages += gs.Messages
+				total.AttachmentBytes += gs.AttachmentBytes
+				if gs.GuildID == d.GuildID() {
+					embed.AddField("Cached for this server", formatGuildStorage(gs), false)
+				}
+			}
+			embed.AddField("Cached in total", formatGuildStorage(total), false)
+		}
 		d.RespondEmbed(embed.Build())
 	}
 
-	return cmd.Execute(run).Build()
+	return cmd.Execute(trackedCommand(m.lifecycle, run)).Build()
 }
 
 func newSettingsSlash(m *module) *bot.ModuleApplicationCommand {
-	logTypes := map[string]string{
-		"join":      "User Join",
-		"leave":     "User Leave",
-		"msgdelete": "Message Delete",
-		"msgedit":   "Message Edit",
-		"ban":       "User Ban",
-		"unban":     "User Unban",
-	}
-
-	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(logTypes))
-	for k, v := range logTypes {
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(logTypeNames))
+	for _, t := range logTypeOrder {
 		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
-			Name:  v,
-			Value: k,
+			Name:  logTypeNames[t],
+			Value: string(t),
 		})
 	}
 
+	minPage, minVersion := 1.0, 0.0
+	minRetentionHours := minMessageRetention.Hours()
+	maxRetentionHours := maxMessageRetention(m.Bot.Config).Hours()
 	cmd := bot.NewModuleApplicationCommandBuilder(m, "settings").
 		Type(discordgo.ChatApplicationCommand).
 		Description("View or set the current settings").
@@ -137,6 +164,112 @@ func newSettingsSlash(m *module) *bot.ModuleApplicationCommand {
 					Description: "The channel to set the log to",
 					Required:    true,
 				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "action",
+					Description: "Whether to add or remove the channel as a destination, defaults to add",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "Add", Value: "add"},
+						{Name: "Remove", Value: "remove"},
+					},
+				},
+			},
+		}).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "history",
+			Description: "View the history of settings changes",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "page",
+					Description: "The page to view",
+					MinValue:    &minPage,
+				},
+			},
+		}).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "rollback",
+			Description: "Restore the settings to a previous version",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "version",
+					Description: "The version to restore, as shown in the history",
+					Required:    true,
+					MinValue:    &minVersion,
+				},
+			},
+		}).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "webhook",
+			Description: "Deliver a log type through webhooks instead of bot messages",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "type",
+					Description: "The type of log to configure",
+					Required:    true,
+					Choices:     choices,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "enabled",
+					Description: "Whether to use webhooks for this log type",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "name",
+					Description: "The name the webhook posts with",
+					MaxLength:   80,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "avatar",
+					Description: "The URL of the avatar the webhook posts with",
+				},
+			},
+		}).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "retention",
+			Description: "Set how long messages are kept for logging deletes, edits and bans",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "hours",
+					Description: fmt.Sprintf("The number of hours, up to %v", maxRetentionHours),
+					Required:    true,
+					MinValue:    &minRetentionHours,
+					MaxValue:    maxRetentionHours,
+				},
+			},
+		}).
+		AddSubcommandGroup(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+			Name:        "ignore",
+			Description: "Manage what is left out of the message logs",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "add",
+					Description: "Stop logging messages in a channel or category, or from a user or role",
+					Options:     ignoreTargetOptions(),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "remove",
+					Description: "Resume logging messages in a channel or category, or from a user or role",
+					Options:     ignoreTargetOptions(),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "View what is currently ignored",
+				},
 			},
 		})
 
@@ -170,52 +303,925 @@ func newSettingsSlash(m *module) *bot.ModuleApplicationCommand {
 				return
 			}
 
-			switch logTypeStr {
-			case "join":
-				gc.JoinLog = ch.ID
-			case "leave":
-				gc.LeaveLog = ch.ID
-			case "msgdelete":
-				gc.MsgDeleteLog = ch.ID
-			case "msgedit":
-				gc.MsgEditLog = ch.ID
-			case "ban":
-				gc.BanLog = ch.ID
-			case "unban":
-				gc.UnbanLog = ch.ID
+			remove := false
+			if actionOpt, ok := d.Options("set:action"); ok {
+				remove = actionOpt.StringValue() == "remove"
+			}
+
+			gc, err = m.db.ModifyGuild(d.GuildID(), d.AuthorID(), func(gc *Guild) error {
+				channels := gc.LogChannels(LogType(logTypeStr))
+				if channels == nil {
+					return fmt.Errorf("unknown log type %q", logTypeStr)
+				}
+				if remove {
+					channels.Remove(ch.ID)
+				} else {
+					channels.Add(ch.ID)
+				}
+				return nil
+			})
+			if err != nil {
+				d.Respond("Failed to update server config")
+				return
+			}
+
+			embed := generateLogSettingsEmbed(gc)
+			embed.Title = "Updated settings"
+
+			resp := &discordgo.InteractionResponseData{
+				Embeds: []*discordgo.MessageEmbed{embed},
+				Flags:  discordgo.MessageFlagsEphemeral,
+			}
+
+			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+			return
+		} else if _, ok := d.Options("history"); ok {
+			page := 1
+			if pageOpt, ok := d.Options("history:page"); ok {
+				page = int(pageOpt.IntValue())
+			}
+
+			history, err := m.db.GetGuildHistory(d.GuildID())
+			if err != nil {
+				d.Respond("Failed to get settings history")
+				return
+			}
+			d.RespondEmbed(generateSettingsHistoryEmbed(history, page))
+			return
+		} else if _, ok := d.Options("rollback"); ok {
+			versionOpt, ok := d.Options("rollback:version")
+			if !ok {
+				d.Respond("Version not found")
+				return
+			}
+			version := int(versionOpt.IntValue())
+
+			gc, err = m.db.RollbackGuild(d.GuildID(), d.AuthorID(), version)
+			if err != nil {
+				d.Respond(fmt.Sprintf("Failed to roll back settings: %v", err))
+				return
+			}
+
+			embed := generateLogSettingsEmbed(gc)
+			embed.Title = fmt.Sprintf("Rolled back settings to version %v", version)
+			resp := &discordgo.InteractionResponseData{
+				Embeds: []*discordgo.MessageEmbed{embed},
+				Flags:  discordgo.MessageFlagsEphemeral,
+			}
+
+			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+			return
+		} else if _, ok := d.Options("retention"); ok {
+			hoursOpt, ok := d.Options("retention:hours")
+			if !ok {
+				d.Respond("Hours not found")
+				return
+			}
+			hours := int(hoursOpt.IntValue())
+			if hours < int(minRetentionHours) || hours > int(maxRetentionHours) {
+				d.Respond(fmt.Sprintf("The retention must be between %v and %v hours", minRetentionHours, maxRetentionHours))
+				return
 			}
 
-			if err := m.db.UpdateGuild(d.GuildID(), gc); err != nil {
+			gc, err = m.db.ModifyGuild(d.GuildID(), d.AuthorID(), func(gc *Guild) error {
+				gc.MessageRetentionHours = hours
+				return nil
+			})
+			if err != nil {
 				d.Respond("Failed to update server config")
 				return
 			}
 
 			embed := generateLogSettingsEmbed(gc)
 			embed.Title = "Updated settings"
+			embed.Description = "The new retention applies to messages sent from now on"
+			resp := &discordgo.InteractionResponseData{
+				Embeds: []*discordgo.MessageEmbed{embed},
+				Flags:  discordgo.MessageFlagsEphemeral,
+			}
+			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+			return
+		} else if _, ok := d.Options("webhook"); ok {
+			logType, ok := d.Options("webhook:type")
+			if !ok {
+				d.Respond("Log type not found")
+				return
+			}
+			logTypeStr := logType.StringValue()
 
+			enabledOpt, ok := d.Options("webhook:enabled")
+			if !ok {
+				d.Respond("Enabled not found")
+				return
+			}
+
+			settings := LogWebhook{}
+			if nameOpt, ok := d.Options("webhook:name"); ok {
+				settings.Name = nameOpt.StringValue()
+			}
+			if avatarOpt, ok := d.Options("webhook:avatar"); ok {
+				settings.AvatarURL = avatarOpt.StringValue()
+				if !strings.HasPrefix(settings.AvatarURL, "https://") {
+					d.Respond("The avatar must be an https URL")
+					return
+				}
+			}
+
+			gc, err = m.db.ModifyGuild(d.GuildID(), d.AuthorID(), func(gc *Guild) error {
+				if gc.LogChannels(LogType(logTypeStr)) == nil {
+					return fmt.Errorf("unknown log type %q", logTypeStr)
+				}
+				if !enabledOpt.BoolValue() {
+					delete(gc.LogWebhooks, LogType(logTypeStr))
+					return nil
+				}
+				if gc.LogWebhooks == nil {
+					gc.LogWebhooks = make(LogWebhooks)
+				}
+				gc.LogWebhooks[LogType(logTypeStr)] = settings
+				return nil
+			})
+			if err != nil {
+				d.Respond("Failed to update server config")
+				return
+			}
+
+			embed := generateLogSettingsEmbed(gc)
+			embed.Title = "Updated settings"
 			resp := &discordgo.InteractionResponseData{
 				Embeds: []*discordgo.MessageEmbed{embed},
 				Flags:  discordgo.MessageFlagsEphemeral,
 			}
+			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+			return
+		} else if _, ok := d.Options("ignore:list"); ok {
+			d.RespondEmbed(generateIgnoreListEmbed(gc))
+			return
+		} else if _, ok := d.Options("ignore"); ok {
+			_, add := d.Options("ignore:add")
+			prefix := "ignore:remove:"
+			if add {
+				prefix = "ignore:add:"
+			}
 
+			var ch *discordgo.Channel
+			var userID, roleID string
+			if opt, ok := d.Options(prefix + "channel"); ok {
+				ch = opt.ChannelValue(d.Sess.Real())
+			}
+			if opt, ok := d.Options(prefix + "user"); ok {
+				userID = opt.UserValue(nil).ID
+			}
+			if opt, ok := d.Options(prefix + "role"); ok {
+				roleID = opt.RoleValue(nil, d.GuildID()).ID
+			}
+			if ch == nil && userID == "" && roleID == "" {
+				d.Respond("Provide a channel, category, user or role")
+				return
+			}
+
+			apply := func(l *StringList, id string) {
+				if add {
+					l.Add(id)
+				} else {
+					l.Remove(id)
+				}
+			}
+
+			gc, err = m.db.ModifyGuild(d.GuildID(), d.AuthorID(), func(gc *Guild) error {
+				if ch != nil {
+					if ch.Type == discordgo.ChannelTypeGuildCategory {
+						apply(&gc.IgnoredCategories, ch.ID)
+					} else {
+						apply(&gc.IgnoredChannels, ch.ID)
+					}
+				}
+				if userID != "" {
+					apply(&gc.IgnoredUsers, userID)
+				}
+				if roleID != "" {
+					apply(&gc.IgnoredRoles, roleID)
+				}
+				return nil
+			})
+			if err != nil {
+				d.Respond("Failed to update server config")
+				return
+			}
+
+			embed := generateIgnoreListEmbed(gc)
+			embed.Title = "Updated ignore list"
+			resp := &discordgo.InteractionResponseData{
+				Embeds: []*discordgo.MessageEmbed{embed},
+				Flags:  discordgo.MessageFlagsEphemeral,
+			}
 			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
 			return
 		}
 	}
 
-	return cmd.Execute(run).Build()
+	return cmd.Execute(trackedCommand(m.lifecycle, run)).Build()
+}
+
+func newAdminSlash(m *module) *bot.ModuleApplicationCommand {
+	cmd := bot.NewModuleApplicationCommandBuilder(m, "admin").
+		Type(discordgo.ChatApplicationCommand).
+		Description("Bot owner commands").
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "backup",
+			Description: "Back up the message cache",
+		}).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "storage",
+			Description: "View which servers use the most storage",
+		})
+
+	run := func(d *discord.DiscordApplicationCommand) {
+		if !m.Bot.IsOwner(d.AuthorID()) {
+			d.RespondEphemeral("This command is only for the bot owner")
+			return
+		}
+
+		if _, ok := d.Options("backup"); ok {
+			// a backup can take longer than an interaction may go unanswered
+			err := d.RespondComplex(&discordgo.InteractionResponseData{
+				Flags: discordgo.MessageFlagsEphemeral,
+			}, discordgo.InteractionResponseDeferredChannelMessageWithSource)
+			if err != nil {
+				return
+			}
+
+			text := ""
+			path, err := backupStore(m.store, m.Bot.Config)
+			if err != nil {
+				m.Logger.Error("failed to back up store", zap.Error(err))
+				text = fmt.Sprintf("Failed to back up the message cache: %v", err)
+			} else {
+				text = fmt.Sprintf("Backed up the message cache to `%v`", path)
+				if backupSkipsAttachments(m.store) {
+					text += ". Attachments are kept outside the cache database and were not backed up"
+				}
+			}
+			d.Sess.Real().InteractionResponseEdit(d.Interaction, &discordgo.WebhookEdit{Content: &text})
+		} else if _, ok := d.Options("storage"); ok {
+			usage, err := m.store.StorageStats()
+			if err != nil {
+				m.Logger.Error("failed to get storage stats", zap.Error(err))
+				d.RespondEphemeral("Failed to get storage stats")
+				return
+			}
+			resp := &discordgo.InteractionResponseData{
+				Embeds: []*discordgo.MessageEmbed{generateStorageEmbed(m, usage)},
+				Flags:  discordgo.MessageFlagsEphemeral,
+			}
+			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+		}
+	}
+
+	return cmd.Execute(trackedCommand(m.lifecycle, run)).Build()
+}
+
+// storageEmbedGuilds is how many servers the storage embed lists
+const storageEmbedGuilds = 15
+
+func generateStorageEmbed(m *module, usage []GuildStorage) *discordgo.MessageEmbed {
+	var total GuildStorage
+	for _, gs := range usage {
+		total.Members += gs.Members
+		total.Messages += gs.Messages
+		total.AttachmentBytes += gs.AttachmentBytes
+	}
+
+	text := strings.Builder{}
+	for i, gs := range usage {
+		if i == storageEmbedGuilds {
+			text.WriteString(fmt.Sprintf("\n...and %v more servers", len(usage)-i))
+			break
+		}
+		name := "Unknown server"
+		if g, err := m.Bot.Discord.Guild(gs.GuildID); err == nil {
+			name = g.Name
+		}
+		text.WriteString(fmt.Sprintf("**%v** (%v)\n%v\n", name, gs.GuildID, formatGuildStorage(gs)))
+	}
+	if len(usage) == 0 {
+		text.WriteString("Nothing is cached")
+	}
+
+	return builders.NewEmbedBuilder().
+		WithTitle("Storage").
+		WithOkColor().
+		WithDescription(text.String()).
+		AddField("Total", formatGuildStorage(total), false).
+		WithFooter("Messages and attachments that expired in the last hour may be included", "").
+		Build()
+}
+
+func formatGuildStorage(gs GuildStorage) string {
+	return fmt.Sprintf("%v messages, %v members, %v of attachments", gs.Messages, gs.Members, formatBytes(gs.AttachmentBytes))
+}
+
+// formatBytes formats a size in bytes with the largest unit it is at least
+// one of.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// historyTimeFormats are the formats accepted for times in history commands,
+// in UTC. Times without a date are the last time of day it was that time.
+var historyTimeFormats = []string{time.DateTime, "2006-01-02 15:04", time.RFC3339, time.TimeOnly, "15:04"}
+
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	for _, layout := range historyTimeFormats {
+		t, err := time.ParseInLocation(layout, strings.TrimSpace(value), time.UTC)
+		if err != nil {
+			continue
+		}
+		if layout == time.TimeOnly || layout == "15:04" {
+			y, mo, d := now.UTC().Date()
+			t = time.Date(y, mo, d, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+			if t.After(now) {
+				t = t.AddDate(0, 0, -1)
+			}
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use YYYY-MM-DD HH:MM or HH:MM in UTC", value)
+}
+
+// parseHistoryRange parses the start and end times of a history command. An
+// empty end time is now.
+func parseHistoryRange(fromValue, toValue string, now time.Time) (time.Time, time.Time, error) {
+	from, err := parseHistoryTime(fromValue, now)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	to := now
+	if toValue != "" {
+		if to, err = parseHistoryTime(toValue, now); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("the start time must be before the end time")
+	}
+	return from, to, nil
+}
+
+func newHistorySlash(m *module) *bot.ModuleApplicationCommand {
+	cmd := bot.NewModuleApplicationCommandBuilder(m, "history").
+		Type(discordgo.ChatApplicationCommand).
+		Description("Reconstruct cached conversations").
+		NoDM().
+		Permissions(discordgo.PermissionAdministrator).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "channel",
+			Description: "Get a transcript of what was said in a channel",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionChannel,
+					Name:        "channel",
+					Description: "The channel",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "from",
+					Description: "Start time in UTC, as YYYY-MM-DD HH:MM or HH:MM",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "to",
+					Description: "End time in UTC, as YYYY-MM-DD HH:MM or HH:MM. Defaults to now",
+				},
+			},
+		})
+
+	run := func(d *discord.DiscordApplicationCommand) {
+		if _, ok := d.Options("channel"); !ok {
+			return
+		}
+
+		chOpt, ok := d.Options("channel:channel")
+		if !ok {
+			d.Respond("Channel not found")
+			return
+		}
+		ch := chOpt.ChannelValue(d.Sess.Real())
+		if ch == nil {
+			d.Respond("Channel not found")
+			return
+		}
+
+		fromOpt, ok := d.Options("channel:from")
+		if !ok {
+			d.Respond("Start time not found")
+			return
+		}
+		toValue := ""
+		if toOpt, ok := d.Options("channel:to"); ok {
+			toValue = toOpt.StringValue()
+		}
+		from, to, err := parseHistoryRange(fromOpt.StringValue(), toValue, time.Now())
+		if err != nil {
+			d.Respond(err.Error())
+			return
+		}
+
+		transcript, total, truncated, err := renderChannelTranscript(m.store, d.GuildID(), ch, from, to)
+		if err != nil {
+			m.Logger.Error("failed to get channel history", zap.Error(err))
+			d.Respond("Failed to get channel history")
+			return
+		}
+		if total == 0 {
+			d.Respond("No cached messages were found in that time range")
+			return
+		}
+
+		text := fmt.Sprintf("%v cached messages in %v from <t:%v> to <t:%v>", total, ch.Mention(), from.Unix(), to.Unix())
+		if truncated {
+			text += "\nThe transcript was truncated to fit the upload limit"
+		}
+		resp := &discordgo.InteractionResponseData{
+			Content: text,
+			Files: []*discordgo.File{{
+				Name:        fmt.Sprintf("history_%v_%v_%v.txt", ch.ID, from.Unix(), to.Unix()),
+				ContentType: "text/plain",
+				Reader:      strings.NewReader(transcript),
+			}},
+			Flags: discordgo.MessageFlagsEphemeral,
+		}
+		d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+	}
+
+	return cmd.Execute(trackedCommand(m.lifecycle, run)).Build()
+}
+
+// transcriptPageSize is how many messages of a transcript are read at once
+const transcriptPageSize = 100
+
+// renderChannelTranscript renders the cached messages sent in a channel in a
+// time range as text. It returns how many messages it holds, and whether it
+// was truncated to fit the upload limit.
+func renderChannelTranscript(store CacheStore, gid string, ch *discordgo.Channel, from, to time.Time) (string, int, bool, error) {
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "Channel: #%v (%v)\nFrom: %v UTC\nTo: %v UTC\n\n",
+		ch.Name, ch.ID, from.UTC().Format(time.DateTime), to.UTC().Format(time.DateTime))
+
+	total := 0
+	q := ChannelQuery{GuildID: gid, ChannelID: ch.ID, After: from, Before: to, Limit: transcriptPageSize}
+	for {
+		// read a page first, so that the query is not kept open while it is
+		// rendered
+		var page []*DiscordMessage
+		cursor, err := store.QueryChannelLog(q, func(msg *DiscordMessage) error {
+			page = append(page, msg)
+			return nil
+		})
+		if err != nil {
+			return builder.String(), total, false, err
+		}
+
+		for _, msg := range page {
+			ts := utils.IDToTimestamp(msg.Message.ID).UTC().Format(time.DateTime)
+			edited := ""
+			if len(msg.Revisions) > 0 {
+				edited = " (edited)"
+			}
+			text := fmt.Sprintf("[%v] %v (%v)%v: %v\n", ts, msg.Message.Author.String(), msg.Message.Author.ID, edited, msg.Message.Content)
+			for _, a := range msg.Attachments {
+				text += fmt.Sprintf("    Attachment: %v (%v bytes)\n", a.Filename, a.Size)
+			}
+			if builder.Len()+len(text) > maxLogFileSize {
+				return builder.String(), total, true, nil
+			}
+			builder.WriteString(text)
+			total++
+		}
+
+		if cursor == "" {
+			return builder.String(), total, false, nil
+		}
+		q.Cursor = cursor
+	}
+}
+
+const (
+	// searchPageSize is the number of messages shown per page of search
+	// results
+	searchPageSize = 10
+	// maxSearchPages is the last page of search results that can be shown
+	maxSearchPages = 50
+	// searchSnippetLength is the most characters of a message shown in search
+	// results
+	searchSnippetLength = 200
+)
+
+func newSearchSlash(m *module) *bot.ModuleApplicationCommand {
+	minPage, maxPage := 1.0, float64(maxSearchPages)
+	cmd := bot.NewModuleApplicationCommandBuilder(m, "search").
+		Type(discordgo.ChatApplicationCommand).
+		Description("Search cached messages").
+		NoDM().
+		Permissions(discordgo.PermissionManageMessages).
+		AddOption(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "text",
+			Description: "Words the messages must contain",
+			Required:    true,
+		}).
+		AddOption(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionUser,
+			Name:        "author",
+			Description: "Only messages sent by this user",
+		}).
+		AddOption(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionChannel,
+			Name:        "channel",
+			Description: "Only messages sent in this channel",
+		}).
+		AddOption(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "from",
+			Description: "Start time in UTC, as YYYY-MM-DD HH:MM or HH:MM",
+		}).
+		AddOption(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "to",
+			Description: "End time in UTC, as YYYY-MM-DD HH:MM or HH:MM",
+		}).
+		AddOption(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "page",
+			Description: "The page of results to show",
+			MinValue:    &minPage,
+			MaxValue:    maxPage,
+		})
+
+	run := func(d *discord.DiscordApplicationCommand) {
+		textOpt, ok := d.Options("text")
+		if !ok {
+			d.Respond("Search text not found")
+			return
+		}
+		q := SearchQuery{GuildID: d.GuildID(), Text: textOpt.StringValue()}
+
+		if authorOpt, ok := d.Options("author"); ok {
+			q.AuthorID = authorOpt.UserValue(nil).ID
+		}
+
+		now := time.Now()
+		var err error
+		if fromOpt, ok := d.Options("from"); ok {
+			if q.After, err = parseHistoryTime(fromOpt.StringValue(), now); err != nil {
+				d.RespondEphemeral(err.Error())
+				return
+			}
+		}
+		if toOpt, ok := d.Options("to"); ok {
+			if q.Before, err = parseHistoryTime(toOpt.StringValue(), now); err != nil {
+				d.RespondEphemeral(err.Error())
+				return
+			}
+		}
+		if !q.After.IsZero() && !q.Before.IsZero() && !q.After.Before(q.Before) {
+			d.RespondEphemeral("The start time must be before the end time")
+			return
+		}
+
+		// results only come from channels the moderator can read
+		visible, err := visibleChannels(d.Sess.Real().State, m.store, d.GuildID(), d.Interaction.Member)
+		if err != nil {
+			m.Logger.Error("failed to get visible channels", zap.Error(err))
+			d.RespondEphemeral("Failed to search messages")
+			return
+		}
+		q.ChannelIDs = visible
+		if chOpt, ok := d.Options("channel"); ok {
+			cid := chOpt.Value.(string)
+			if !slices.Contains(visible, cid) {
+				d.RespondEphemeral("You cannot read the message history of that channel")
+				return
+			}
+			q.ChannelIDs = []string{cid}
+		}
+		if len(q.ChannelIDs) == 0 {
+			d.RespondEphemeral("You cannot read the message history of any channel")
+			return
+		}
+
+		page := 1
+		if pageOpt, ok := d.Options("page"); ok {
+			page = min(max(int(pageOpt.IntValue()), 1), maxSearchPages)
+		}
+
+		// the earlier pages are read and skipped
+		q.Limit = page * searchPageSize
+		skip := (page - 1) * searchPageSize
+		var results []*DiscordMessage
+		cursor, err := m.store.SearchMessages(q, func(msg *DiscordMessage) error {
+			if skip > 0 {
+				skip--
+				return nil
+			}
+			results = append(results, msg)
+			return nil
+		})
+		if err == ErrNoSearchTerms {
+			d.RespondEphemeral("The search text must have a word of at least 2 characters")
+			return
+		}
+		if err != nil {
+			m.Logger.Error("failed to search messages", zap.Error(err))
+			d.RespondEphemeral("Failed to search messages")
+			return
+		}
+
+		resp := &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{generateSearchEmbed(d.GuildID(), results, page, cursor != "")},
+			Flags:  discordgo.MessageFlagsEphemeral,
+		}
+		d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+	}
+
+	return cmd.Execute(trackedCommand(m.lifecycle, run)).Build()
+}
+
+// visibleChannels returns the channels and threads of a guild in which a member
+// can read the message history. Threads have the permissions of their parent
+// channel, and private threads are only visible to their members and to those
+// who can manage threads. Archived threads are no longer in the state, so the
+// cached threads are checked as well; their members are not known, so archived
+// private threads require managing threads.
+func visibleChannels(state *discordgo.State, channels ChannelStore, gid string, member *discordgo.Member) ([]string, error) {
+	g, err := state.Guild(gid)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := channels.GetChannels(gid)
+	if err != nil {
+		return nil, err
+	}
+
+	all := append(slices.Clone(g.Channels), g.Threads...)
+	seen := make(map[string]bool, len(all))
+	for _, ch := range all {
+		seen[ch.ID] = true
+	}
+	for _, ch := range cached {
+		if ch.IsThread() && !seen[ch.ID] {
+			all = append(all, ch)
+		}
+	}
+
+	const need = discordgo.PermissionViewChannel | discordgo.PermissionReadMessageHistory
+	var visible []string
+	for _, ch := range all {
+		cid := ch.ID
+		if ch.IsThread() {
+			cid = ch.ParentID
+		}
+		perms, err := state.MessagePermissions(&discordgo.Message{ChannelID: cid, Author: member.User, Member: member})
+		if err != nil {
+			continue
+		}
+		if perms&need != need {
+			continue
+		}
+		// discordgo leaves managing threads out of the permissions of
+		// administrators, so they are checked separately
+		const manage = discordgo.PermissionManageThreads | discordgo.PermissionAdministrator
+		if ch.Type == discordgo.ChannelTypeGuildPrivateThread && perms&manage == 0 &&
+			!slices.ContainsFunc(ch.Members, func(m *discordgo.ThreadMember) bool { return m.UserID == member.User.ID }) {
+			continue
+		}
+		visible = append(visible, ch.ID)
+	}
+	return visible, nil
+}
+
+func generateSearchEmbed(gid string, results []*DiscordMessage, page int, more bool) *discordgo.MessageEmbed {
+	embed := builders.NewEmbedBuilder().
+		WithTitle("Search results").
+		WithOkColor()
+
+	if len(results) == 0 {
+		if page > 1 {
+			return embed.WithDescription("There are no more cached messages that match").Build()
+		}
+		return embed.WithDescription("No cached messages match").Build()
+	}
+
+	text := strings.Builder{}
+	for _, msg := range results {
+		snippet := truncateText(strings.Join(strings.Fields(msg.Message.Content), " "), searchSnippetLength)
+		fmt.Fprintf(&text, "[Jump](https://discord.com/channels/%v/%v/%v) %v in <#%v> <t:%v:R>\n",
+			gid, msg.Message.ChannelID, msg.Message.ID, msg.Message.Author.Mention(), msg.Message.ChannelID,
+			utils.IDToTimestamp(msg.Message.ID).Unix())
+		if snippet != "" {
+			fmt.Fprintf(&text, "> %v\n", snippet)
+		}
+	}
+	embed.WithDescription(text.String())
+
+	footer := fmt.Sprintf("Page %v", page)
+	if more && page < maxSearchPages {
+		footer += fmt.Sprintf(" • Use page %v to see more", page+1)
+	}
+	embed.WithFooter(footer, "")
+	return embed.Build()
+}
+
+func ignoreTargetOptions() []*discordgo.ApplicationCommandOption {
+	return []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionChannel,
+			Name:        "channel",
+			Description: "A channel or category",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionUser,
+			Name:        "user",
+			Description: "A user",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionRole,
+			Name:        "role",
+			Description: "A role",
+		},
+	}
+}
+
+func generateIgnoreListEmbed(gc *Guild) *discordgo.MessageEmbed {
+	mentions := func(l StringList, format string) string {
+		if len(l) == 0 {
+			return "None"
+		}
+		var out []string
+		for _, id := range l {
+			m := fmt.Sprintf(format, id)
+			if len(strings.Join(append(out, m), ", ")) > 1000 {
+				break
+			}
+			out = append(out, m)
+		}
+
+		text := strings.Join(out, ", ")
+		if len(out) != len(l) {
+			text += fmt.Sprintf(" and %v more", len(l)-len(out))
+		}
+		return text
+	}
+
+	embed := builders.NewEmbedBuilder().
+		WithTitle("Ignore list").
+		WithOkColor().
+		AddField("Channels", mentions(gc.IgnoredChannels, "<#%v>"), false).
+		AddField("Categories", mentions(gc.IgnoredCategories, "<#%v>"), false).
+		AddField("Users", mentions(gc.IgnoredUsers, "<@%v>"), false).
+		AddField("Roles", mentions(gc.IgnoredRoles, "<@&%v>"), false)
+
+	return embed.Build()
+}
+
+const (
+	// historyPageSize is the number of versions shown per page of settings
+	// history
+	historyPageSize = 5
+	// historyValueLength is the most characters of an old or new value shown
+	// in the settings history. Each version is also cut off at the limit of an
+	// embed field, so a full page stays within the limit of an embed.
+	historyValueLength = 100
+)
+
+// truncateText shortens text to at most n characters, and marks it with an
+// ellipsis if it was cut.
+func truncateText(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "…"
+}
+
+func generateSettingsHistoryEmbed(history []*GuildChange, page int) *discordgo.MessageEmbed {
+	embed := builders.NewEmbedBuilder().
+		WithTitle("Settings history").
+		WithOkColor()
+
+	// group changes by version, newest first
+	var versions [][]*GuildChange
+	for i := len(history) - 1; i >= 0; i-- {
+		c := history[i]
+		if n := len(versions); n > 0 && versions[n-1][0].Version == c.Version {
+			versions[n-1] = append(versions[n-1], c)
+			continue
+		}
+		versions = append(versions, []*GuildChange{c})
+	}
+
+	if len(versions) == 0 {
+		return embed.WithDescription("No settings have been changed yet").Build()
+	}
+
+	pages := (len(versions) + historyPageSize - 1) / historyPageSize
+	page = min(max(page, 1), pages)
+	start := (page - 1) * historyPageSize
+	end := min(start+historyPageSize, len(versions))
+
+	for _, changes := range versions[start:end] {
+		first := changes[0]
+		actor := "System"
+		if first.ActorID != "" {
+			actor = fmt.Sprintf("<@%v>", first.ActorID)
+		}
+
+		text := strings.Builder{}
+		text.WriteString(fmt.Sprintf("By %v <t:%v:R>\n", actor, first.Timestamp.Unix()))
+		for i, c := range changes {
+			line := fmt.Sprintf("`%v`: %v → %v\n", c.Field,
+				truncateText(c.OldValue, historyValueLength), truncateText(c.NewValue, historyValueLength))
+			// leave room to say how many changes were left out
+			if text.Len()+len(line) > 1000 {
+				text.WriteString(fmt.Sprintf("and %v more", len(changes)-i))
+				break
+			}
+			text.WriteString(line)
+		}
+		embed.AddField(fmt.Sprintf("Version %v", first.Version), text.String(), false)
+	}
+
+	embed.WithFooter(fmt.Sprintf("Page %v/%v • Use /settings rollback to restore a version", page, pages), "")
+	return embed.Build()
+}
+
+// logTypeOrder is the order log types are shown in
+var logTypeOrder = []LogType{
+	LogTypeJoin,
+	LogTypeLeave,
+	LogTypeMsgDelete,
+	LogTypeMsgEdit,
+	LogTypeBan,
+	LogTypeUnban,
+	LogTypeRole,
+	LogTypeChannel,
+}
+
+var logTypeNames = map[LogType]string{
+	LogTypeJoin:      "User Join",
+	LogTypeLeave:     "User Leave",
+	LogTypeMsgDelete: "Message Delete",
+	LogTypeMsgEdit:   "Message Edit",
+	LogTypeBan:       "User Ban",
+	LogTypeUnban:     "User Unban",
+	LogTypeRole:      "Role Changes",
+	LogTypeChannel:   "Channel Changes",
 }
 
 func generateLogSettingsEmbed(gc *Guild) *discordgo.MessageEmbed {
 	embed := builders.NewEmbedBuilder().
 		WithTitle("Settings").
-		WithOkColor().
-		AddField("Join log", fmt.Sprintf("<#%v>", gc.JoinLog), true).
-		AddField("Leave log", fmt.Sprintf("<#%v>", gc.LeaveLog), true).
-		AddField("Message delete log", fmt.Sprintf("<#%v>", gc.MsgDeleteLog), true).
-		AddField("Message edit log", fmt.Sprintf("<#%v>", gc.MsgEditLog), true).
-		AddField("Ban log", fmt.Sprintf("<#%v>", gc.BanLog), true).
-		AddField("Unban log", fmt.Sprintf("<#%v>", gc.UnbanLog), true)
+		WithOkColor()
+
+	for _, t := range logTypeOrder {
+		channels := *gc.LogChannels(t)
+		text := "None"
+		if len(channels) > 0 {
+			var mentions []string
+			for _, id := range channels {
+				mentions = append(mentions, fmt.Sprintf("<#%v>", id))
+			}
+			text = strings.Join(mentions, "\n")
+		}
+		if wh, ok := gc.LogWebhooks[t]; ok {
+			name := wh.Name
+			if name == "" {
+				name = webhookName
+			}
+			text += fmt.Sprintf("\n*Via webhook as %v*", name)
+		}
+		embed.AddField(logTypeNames[t], text, true)
+	}
+
+	retention := formatRetention(defaultMessageRetention) + " (default)"
+	if gc.MessageRetentionHours > 0 {
+		retention = formatRetention(time.Duration(gc.MessageRetentionHours) * time.Hour)
+	}
+	embed.AddField("Message retention", retention, true)
 
 	return embed.Build()
 }
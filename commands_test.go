@@ -0,0 +1,321 @@
+package stare
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// embedLength returns the number of characters of an embed that count
+// towards Discord's limit.
+func embedLength(e *discordgo.MessageEmbed) int {
+	n := utf8.RuneCountInString(e.Title) + utf8.RuneCountInString(e.Description)
+	if e.Footer != nil {
+		n += utf8.RuneCountInString(e.Footer.Text)
+	}
+	for _, f := range e.Fields {
+		n += utf8.RuneCountInString(f.Name) + utf8.RuneCountInString(f.Value)
+	}
+	return n
+}
+
+func TestGenerateSettingsHistoryEmbed(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   int
+		value    string
+		contains string
+	}{
+		{"Short", 2, `["10"]`, `["10"]`},
+		{"LongValues", 2, `["` + strings.Repeat("1234567890", 200) + `"]`, "…"},
+		{"ManyChanges", 14, `["` + strings.Repeat("1234567890", 20) + `"]`, "more"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var history []*GuildChange
+			for v := 1; v <= historyPageSize; v++ {
+				for f := 0; f < tt.fields; f++ {
+					history = append(history, &GuildChange{
+						GuildID:   "1",
+						Version:   v,
+						Field:     "ignored_channels",
+						ActorID:   "100",
+						OldValue:  tt.value,
+						NewValue:  tt.value,
+						Timestamp: time.Unix(0, 0),
+					})
+				}
+			}
+
+			embed := generateSettingsHistoryEmbed(history, 1)
+			if len(embed.Fields) != historyPageSize {
+				t.Fatalf("len(Fields) = %v, want %v", len(embed.Fields), historyPageSize)
+			}
+			for _, f := range embed.Fields {
+				if n := utf8.RuneCountInString(f.Value); n > 1024 {
+					t.Errorf("field %q is %v characters long, want at most 1024", f.Name, n)
+				}
+				if !strings.Contains(f.Value, tt.contains) {
+					t.Errorf("field %q = %q, want it to contain %q", f.Name, f.Value, tt.contains)
+				}
+			}
+			if n := embedLength(embed); n > 6000 {
+				t.Errorf("embed is %v characters long, want at most 6000", n)
+			}
+		})
+	}
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"DateTime", "2024-01-01 10:20:30", time.Date(2024, 1, 1, 10, 20, 30, 0, time.UTC), false},
+		{"DateAndMinutes", "2024-01-01 10:20", time.Date(2024, 1, 1, 10, 20, 0, 0, time.UTC), false},
+		{"RFC3339", "2024-01-01T10:20:30+02:00", time.Date(2024, 1, 1, 8, 20, 30, 0, time.UTC), false},
+		{"Time", "10:20:30", time.Date(2024, 1, 2, 10, 20, 30, 0, time.UTC), false},
+		{"Minutes", "10:20", time.Date(2024, 1, 2, 10, 20, 0, 0, time.UTC), false},
+		{"LaterThanNow", "13:00", time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC), false},
+		{"Spaces", " 10:20 ", time.Date(2024, 1, 2, 10, 20, 0, 0, time.UTC), false},
+		{"Empty", "", time.Time{}, true},
+		{"Words", "yesterday", time.Time{}, true},
+		{"InvalidHour", "25:00", time.Time{}, true},
+		{"InvalidDate", "2024-13-01 10:20", time.Time{}, true},
+		{"TwelveHour", "10:20 pm", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHistoryTime(tt.value, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHistoryTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseHistoryTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHistoryRange(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		from, to string
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{"UntilNow", "10:00", "", time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), now, false},
+		{"Range", "2024-01-01 00:00", "2024-01-01 12:00", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), false},
+		{"StartYesterday", "13:00", "", time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC), now, false},
+		{"StartAfterEnd", "2024-01-01 12:00", "2024-01-01 00:00", time.Time{}, time.Time{}, true},
+		{"SameTimes", "2024-01-01 12:00", "2024-01-01 12:00", time.Time{}, time.Time{}, true},
+		{"StartInFuture", "2024-01-03 00:00", "", time.Time{}, time.Time{}, true},
+		{"InvalidStart", "noon", "", time.Time{}, time.Time{}, true},
+		{"InvalidEnd", "10:00", "noon", time.Time{}, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := parseHistoryRange(tt.from, tt.to, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHistoryRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo) {
+				t.Errorf("parseHistoryRange() = %v, %v, want %v, %v", from, to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestRenderChannelTranscript(t *testing.T) {
+	ch := &discordgo.Channel{ID: "10", Name: "general"}
+	base := testMessage(0, "10", "").Timestamp
+	large := strings.Repeat("a", 1024*1024)
+
+	tests := []struct {
+		name          string
+		messages      int
+		content       string
+		from, to      time.Time
+		wantTotal     int
+		wantTruncated bool
+	}{
+		{"Empty", 0, "hello", base, base.Add(time.Hour), 0, false},
+		{"All", 5, "hello", base, base.Add(time.Hour), 5, false},
+		{"TimeRange", 5, "hello", base.Add(time.Second), base.Add(4 * time.Second), 3, false},
+		{"ManyPages", 2*transcriptPageSize + 50, "hello", base, base.Add(time.Hour), 2*transcriptPageSize + 50, false},
+		{"Truncated", 10, large, base, base.Add(time.Hour), 7, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			for i := 0; i < tt.messages; i++ {
+				mustSetMessages(t, s, testMessage(i, "10", tt.content))
+			}
+			// messages in other channels are left out
+			mustSetMessages(t, s, testMessage(1, "11", "other"))
+
+			text, total, truncated, err := renderChannelTranscript(s, testGuildID, ch, tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("renderChannelTranscript() error = %v", err)
+			}
+			if total != tt.wantTotal || truncated != tt.wantTruncated {
+				t.Errorf("renderChannelTranscript() = %v messages, truncated %v, want %v, %v", total, truncated, tt.wantTotal, tt.wantTruncated)
+			}
+			if n := strings.Count(text, "\n["); n != total {
+				t.Errorf("renderChannelTranscript() rendered %v messages, want %v", n, total)
+			}
+			if len(text) > maxLogFileSize {
+				t.Errorf("renderChannelTranscript() is %v bytes, want at most %v", len(text), maxLogFileSize)
+			}
+			if strings.Contains(text, "other") {
+				t.Errorf("renderChannelTranscript() has a message of another channel")
+			}
+		})
+	}
+}
+
+func TestRenderChannelTranscriptMessage(t *testing.T) {
+	s := NewMemoryStore()
+	msg := testMessage(0, "10", "first")
+	data := []byte("attachment")
+	err := s.SetMessage(&DiscordMessage{
+		Message:     msg,
+		Attachments: []*Attachment{{Filename: "a.txt", Size: len(data), Data: data}},
+	}, time.Hour, 1024)
+	if err != nil {
+		t.Fatalf("SetMessage() error = %v", err)
+	}
+	if _, err := s.AddMessageRevision(testGuildID, "10", msg.ID, "second", msg.Timestamp.Add(time.Minute)); err != nil {
+		t.Fatalf("AddMessageRevision() error = %v", err)
+	}
+
+	ch := &discordgo.Channel{ID: "10", Name: "general"}
+	text, _, _, err := renderChannelTranscript(s, testGuildID, ch, msg.Timestamp, msg.Timestamp.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("renderChannelTranscript() error = %v", err)
+	}
+	for _, want := range []string{
+		"Channel: #general (10)",
+		"[2024-01-01 00:00:00] " + msg.Author.String() + " (100) (edited): second\n",
+		"    Attachment: a.txt (10 bytes)\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("renderChannelTranscript() = %q, want it to contain %q", text, want)
+		}
+	}
+}
+
+func TestVisibleChannels(t *testing.T) {
+	const (
+		view    = discordgo.PermissionViewChannel
+		history = discordgo.PermissionReadMessageHistory
+	)
+	everyone := func(allow, deny int64) *discordgo.PermissionOverwrite {
+		return &discordgo.PermissionOverwrite{ID: testGuildID, Type: discordgo.PermissionOverwriteTypeRole, Allow: allow, Deny: deny}
+	}
+	role := func(id string, allow, deny int64) *discordgo.PermissionOverwrite {
+		return &discordgo.PermissionOverwrite{ID: id, Type: discordgo.PermissionOverwriteTypeRole, Allow: allow, Deny: deny}
+	}
+	member := func(id string, allow, deny int64) *discordgo.PermissionOverwrite {
+		return &discordgo.PermissionOverwrite{ID: id, Type: discordgo.PermissionOverwriteTypeMember, Allow: allow, Deny: deny}
+	}
+	channel := func(id string, overwrites ...*discordgo.PermissionOverwrite) *discordgo.Channel {
+		return &discordgo.Channel{ID: id, GuildID: testGuildID, Type: discordgo.ChannelTypeGuildText, PermissionOverwrites: overwrites}
+	}
+	thread := func(id, parent string) *discordgo.Channel {
+		return &discordgo.Channel{ID: id, GuildID: testGuildID, ParentID: parent, Type: discordgo.ChannelTypeGuildPublicThread}
+	}
+	privateThread := func(id, parent string, members ...string) *discordgo.Channel {
+		th := &discordgo.Channel{ID: id, GuildID: testGuildID, ParentID: parent, Type: discordgo.ChannelTypeGuildPrivateThread}
+		for _, uid := range members {
+			th.Members = append(th.Members, &discordgo.ThreadMember{ID: id, UserID: uid})
+		}
+		return th
+	}
+
+	state := discordgo.NewState()
+	err := state.GuildAdd(&discordgo.Guild{
+		ID:      testGuildID,
+		OwnerID: "999",
+		Roles: []*discordgo.Role{
+			{ID: testGuildID, Permissions: view | history},
+			{ID: "30"},
+			{ID: "31", Permissions: discordgo.PermissionAdministrator},
+			{ID: "32", Permissions: discordgo.PermissionManageThreads},
+		},
+		Channels: []*discordgo.Channel{
+			channel("10"),
+			// hidden from everyone but the role
+			channel("11", everyone(0, view), role("30", view, 0)),
+			// hidden from everyone but the member, even with the role
+			channel("12", everyone(0, view), member("100", view, 0)),
+			// the role cannot read the history, unless the member can
+			channel("13", role("30", 0, history), member("100", history, 0)),
+			// the member is denied, even with the role allowed
+			channel("14", role("30", view, 0), member("100", 0, view)),
+		},
+		Threads: []*discordgo.Channel{
+			thread("20", "10"),
+			thread("21", "11"),
+			thread("22", "14"),
+			// private threads are visible to their members
+			privateThread("23", "10", "100"),
+			privateThread("24", "10"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("GuildAdd() error = %v", err)
+	}
+	// archived threads are only cached, with the parent's permissions
+	channels := NewMemoryStore()
+	for _, ch := range []*discordgo.Channel{thread("20", "10"), thread("25", "10"), thread("26", "11"), privateThread("27", "10")} {
+		if err := channels.SetChannel(ch); err != nil {
+			t.Fatalf("SetChannel() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		member *discordgo.Member
+		want   []string
+	}{
+		{"Everyone", &discordgo.Member{User: &discordgo.User{ID: "200"}}, []string{"10", "13", "14", "20", "22", "25"}},
+		{"Role", &discordgo.Member{User: &discordgo.User{ID: "200"}, Roles: []string{"30"}}, []string{"10", "11", "14", "20", "21", "22", "25", "26"}},
+		{"Member", &discordgo.Member{User: &discordgo.User{ID: "100"}}, []string{"10", "12", "13", "20", "23", "25"}},
+		{"MemberWithRole", &discordgo.Member{User: &discordgo.User{ID: "100"}, Roles: []string{"30"}}, []string{"10", "11", "12", "13", "20", "21", "23", "25", "26"}},
+		{"ManageThreads", &discordgo.Member{User: &discordgo.User{ID: "200"}, Roles: []string{"32"}}, []string{"10", "13", "14", "20", "22", "23", "24", "25", "27"}},
+		{"Administrator", &discordgo.Member{User: &discordgo.User{ID: "200"}, Roles: []string{"31"}}, []string{"10", "11", "12", "13", "14", "20", "21", "22", "23", "24", "25", "26", "27"}},
+		{"Owner", &discordgo.Member{User: &discordgo.User{ID: "999"}}, []string{"10", "11", "12", "13", "14", "20", "21", "22", "23", "24", "25", "26", "27"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.member.GuildID = testGuildID
+			got, err := visibleChannels(state, channels, testGuildID, tt.member)
+			if err != nil {
+				t.Fatalf("visibleChannels() error = %v", err)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("visibleChannels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := visibleChannels(state, channels, "2", &discordgo.Member{User: &discordgo.User{ID: "200"}}); err == nil {
+		t.Errorf("visibleChannels() of an unknown guild error = nil, want an error")
+	}
+}
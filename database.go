@@ -1,10 +1,17 @@
 package stare
 
 import (
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
@@ -15,57 +22,344 @@ type DB interface {
 	Close() error
 
 	CreateGuild(gid string) error
+	// UpdateGuild replaces the guild config. The change is recorded in the
+	// history without an actor.
 	UpdateGuild(gid string, gc *Guild) error
+	// GetGuild returns a copy of the guild config; changes to it are not
+	// stored unless passed to UpdateGuild.
 	GetGuild(gid string) (*Guild, error)
+	// ModifyGuild atomically applies fn to a copy of the guild config and
+	// stores the result, unless fn returns an error. The changed fields are
+	// recorded in the history as a new version attributed to actorID. The
+	// stored config is returned.
+	ModifyGuild(gid, actorID string, fn func(gc *Guild) error) (*Guild, error)
+	// GetGuildHistory returns every recorded change to the guild config,
+	// oldest first.
+	GetGuildHistory(gid string) ([]*GuildChange, error)
+	// RollbackGuild restores the guild config to how it was at version. The
+	// rollback itself is recorded as a new version.
+	RollbackGuild(gid, actorID string, version int) (*Guild, error)
+	// DeleteGuild removes the guild config and its history.
+	DeleteGuild(gid string) error
 }
 
+var (
+	// ErrGuildNotFound is returned when a guild has no config.
+	ErrGuildNotFound = errors.New("guild not found")
+	// ErrGuildExists is returned when creating a config for a guild that
+	// already has one.
+	ErrGuildExists = errors.New("guild already exists")
+)
+
 type Config struct {
 	Log     *zap.Logger
+	Driver  string
 	ConnStr string
 }
 
 type Guild struct {
-	ID           string `json:"id" db:"id"`
-	MsgEditLog   string `json:"msg_edit_log" db:"msg_edit_log"`
-	MsgDeleteLog string `json:"msg_delete_log" db:"msg_delete_log"`
-	BanLog       string `json:"ban_log" db:"ban_log"`
-	UnbanLog     string `json:"unban_log" db:"unban_log"`
-	JoinLog      string `json:"join_log" db:"join_log"`
-	LeaveLog     string `json:"leave_log" db:"leave_log"`
+	ID           string     `json:"id" db:"id"`
+	MsgEditLog   StringList `json:"msg_edit_log" db:"msg_edit_log"`
+	MsgDeleteLog StringList `json:"msg_delete_log" db:"msg_delete_log"`
+	BanLog       StringList `json:"ban_log" db:"ban_log"`
+	UnbanLog     StringList `json:"unban_log" db:"unban_log"`
+	JoinLog      StringList `json:"join_log" db:"join_log"`
+	LeaveLog     StringList `json:"leave_log" db:"leave_log"`
+	RoleLog      StringList `json:"role_log" db:"role_log"`
+	ChannelLog   StringList `json:"channel_log" db:"channel_log"`
+
+	IgnoredChannels   StringList `json:"ignored_channels" db:"ignored_channels"`
+	IgnoredCategories StringList `json:"ignored_categories" db:"ignored_categories"`
+	IgnoredUsers      StringList `json:"ignored_users" db:"ignored_users"`
+	IgnoredRoles      StringList `json:"ignored_roles" db:"ignored_roles"`
+
+	LogWebhooks LogWebhooks `json:"log_webhooks" db:"log_webhooks"`
+
+	// MessageRetentionHours is how long messages are cached for, 0 means the
+	// default
+	MessageRetentionHours int `json:"message_retention_hours" db:"message_retention_hours"`
+}
+
+// Clone returns a copy of the guild config that shares no memory with gc.
+func (gc *Guild) Clone() *Guild {
+	c := *gc
+	c.MsgEditLog = slices.Clone(gc.MsgEditLog)
+	c.MsgDeleteLog = slices.Clone(gc.MsgDeleteLog)
+	c.BanLog = slices.Clone(gc.BanLog)
+	c.UnbanLog = slices.Clone(gc.UnbanLog)
+	c.JoinLog = slices.Clone(gc.JoinLog)
+	c.LeaveLog = slices.Clone(gc.LeaveLog)
+	c.RoleLog = slices.Clone(gc.RoleLog)
+	c.ChannelLog = slices.Clone(gc.ChannelLog)
+	c.IgnoredChannels = slices.Clone(gc.IgnoredChannels)
+	c.IgnoredCategories = slices.Clone(gc.IgnoredCategories)
+	c.IgnoredUsers = slices.Clone(gc.IgnoredUsers)
+	c.IgnoredRoles = slices.Clone(gc.IgnoredRoles)
+	c.LogWebhooks = maps.Clone(gc.LogWebhooks)
+	return &c
+}
+
+// LogType is a kind of event that can be logged.
+type LogType string
+
+const (
+	LogTypeJoin      LogType = "join"
+	LogTypeLeave     LogType = "leave"
+	LogTypeMsgDelete LogType = "msgdelete"
+	LogTypeMsgEdit   LogType = "msgedit"
+	LogTypeBan       LogType = "ban"
+	LogTypeUnban     LogType = "unban"
+	LogTypeRole      LogType = "role"
+	LogTypeChannel   LogType = "channel"
+)
+
+// LogChannels returns the destinations configured for a log type, or nil if
+// the log type is unknown.
+func (gc *Guild) LogChannels(t LogType) *StringList {
+	switch t {
+	case LogTypeJoin:
+		return &gc.JoinLog
+	case LogTypeLeave:
+		return &gc.LeaveLog
+	case LogTypeMsgDelete:
+		return &gc.MsgDeleteLog
+	case LogTypeMsgEdit:
+		return &gc.MsgEditLog
+	case LogTypeBan:
+		return &gc.BanLog
+	case LogTypeUnban:
+		return &gc.UnbanLog
+	case LogTypeRole:
+		return &gc.RoleLog
+	case LogTypeChannel:
+		return &gc.ChannelLog
+	}
+	return nil
+}
+
+// IsIgnored reports whether activity by a user with the given roles, in a
+// channel or any of its parents, should be left out of the logs. parentIDs
+// holds the parent channel of a thread and the category of a channel.
+func (gc *Guild) IsIgnored(channelID string, parentIDs []string, userID string, roles []string) bool {
+	if gc.IgnoredChannels.Contains(channelID) || gc.IgnoredUsers.Contains(userID) {
+		return true
+	}
+	for _, id := range parentIDs {
+		if gc.IgnoredChannels.Contains(id) || gc.IgnoredCategories.Contains(id) {
+			return true
+		}
+	}
+	for _, id := range roles {
+		if gc.IgnoredRoles.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// StringList is a list of strings, stored as a JSON array in SQL databases.
+type StringList []string
+
+func (l StringList) Contains(s string) bool {
+	return slices.Contains(l, s)
+}
+
+// Add appends s if it is not already in the list, and reports whether it was
+// added.
+func (l *StringList) Add(s string) bool {
+	if l.Contains(s) {
+		return false
+	}
+	*l = append(*l, s)
+	return true
+}
+
+// Remove removes s from the list, and reports whether it was there.
+func (l *StringList) Remove(s string) bool {
+	i := slices.Index(*l, s)
+	if i < 0 {
+		return false
+	}
+	*l = slices.Delete(*l, i, i+1)
+	return true
+}
+
+func (l StringList) MarshalJSON() ([]byte, error) {
+	if l == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]string(l))
+}
+
+// UnmarshalJSON also accepts a single string, which is how log channels were
+// stored before they could have multiple destinations.
+func (l *StringList) UnmarshalJSON(d []byte) error {
+	var single string
+	if err := json.Unmarshal(d, &single); err == nil {
+		*l = nil
+		if single != "" {
+			*l = StringList{single}
+		}
+		return nil
+	}
+	return json.Unmarshal(d, (*[]string)(l))
+}
+
+func (l StringList) Value() (driver.Value, error) {
+	d, err := l.MarshalJSON()
+	return string(d), err
+}
+
+func (l *StringList) Scan(src interface{}) error {
+	var d []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		d = []byte(v)
+	case []byte:
+		d = v
+	default:
+		return fmt.Errorf("cannot scan %T into StringList", src)
+	}
+	if len(d) == 0 {
+		*l = nil
+		return nil
+	}
+	return l.UnmarshalJSON(d)
+}
+
+// LogWebhook configures how a log type is delivered through webhooks.
+type LogWebhook struct {
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+// LogWebhooks holds the log types that are delivered through webhooks instead
+// of being sent by the bot user. It is stored as a JSON object in SQL
+// databases.
+type LogWebhooks map[LogType]LogWebhook
+
+func (w LogWebhooks) MarshalJSON() ([]byte, error) {
+	if w == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[LogType]LogWebhook(w))
+}
+
+func (w LogWebhooks) Value() (driver.Value, error) {
+	d, err := w.MarshalJSON()
+	return string(d), err
+}
+
+func (w *LogWebhooks) Scan(src interface{}) error {
+	var d []byte
+	switch v := src.(type) {
+	case nil:
+		*w = nil
+		return nil
+	case string:
+		d = []byte(v)
+	case []byte:
+		d = v
+	default:
+		return fmt.Errorf("cannot scan %T into LogWebhooks", src)
+	}
+	if len(d) == 0 {
+		*w = nil
+		return nil
+	}
+	return json.Unmarshal(d, (*map[LogType]LogWebhook)(w))
 }
 
 //
 // JSON implementation DB
 //
 
+const (
+	// jsonFlushInterval is how often pending changes are written to disk
+	jsonFlushInterval = time.Second
+	// jsonBackupCount is the number of previous versions of the data file to keep
+	jsonBackupCount = 5
+	// jsonBackupInterval is how often the backups are rotated. They are also
+	// rotated by the first write after the database is opened.
+	jsonBackupInterval = time.Hour
+)
+
+// JsonDB is a MemoryDB that is persisted to a JSON file.
 type JsonDB struct {
-	path  string
-	state *state
-}
+	*MemoryDB
+	path string
 
-type state struct {
-	sync.Mutex
-	Guilds map[string]*Guild `json:"guilds"`
+	// saveMu serializes writes of the data file and its backups
+	saveMu sync.Mutex
+	// lastBackup is when the backups were last rotated, guarded by saveMu
+	lastBackup time.Time
+	dirty      atomic.Bool
+	quit       chan struct{}
+	done       chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
+// NewJsonDatabase opens the JSON database at path. Changes are flushed to disk
+// in the background shortly after they are made. If the file exists but cannot
+// be decoded, an error is returned instead of starting with an empty state.
 func NewJsonDatabase(path string) (*JsonDB, error) {
 	db := &JsonDB{
-		path: path,
-		state: &state{
-			Guilds: make(map[string]*Guild, 0),
-		},
+		MemoryDB: NewMemoryDB(),
+		path:     path,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	db.MemoryDB.onChange = db.markDirty
+	if err := db.load(path); err != nil {
+		return nil, err
 	}
-	err := db.load(path)
-	return db, err
+	go db.run()
+	return db, nil
 }
 
+// Close stops the background flush and writes any pending changes. Closing
+// more than once has no further effect.
 func (j *JsonDB) Close() error {
-	return j.save()
+	j.closeOnce.Do(func() {
+		close(j.quit)
+		<-j.done
+		j.closeErr = j.save()
+	})
+	return j.closeErr
+}
+
+func (j *JsonDB) run() {
+	defer close(j.done)
+	ticker := time.NewTicker(jsonFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !j.dirty.Swap(false) {
+				continue
+			}
+			if err := j.save(); err != nil {
+				// try again on the next tick
+				j.dirty.Store(true)
+			}
+		case <-j.quit:
+			return
+		}
+	}
 }
 
 func (j *JsonDB) load(path string) error {
 	if _, err := os.Stat(path); err != nil {
-		return nil
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
 
 	d, err := os.ReadFile(path)
@@ -73,61 +367,102 @@ func (j *JsonDB) load(path string) error {
 		return err
 	}
 
-	state := &state{}
+	state := newMemoryState()
 	err = json.Unmarshal(d, &state)
 	if err != nil {
-		return err
+		return fmt.Errorf("data file %v is corrupt (%w); restore it from one of the backups (%v.1 is the newest) or move it away to start fresh", path, err, path)
+	}
+	if state.Guilds == nil {
+		state.Guilds = make(map[string]*Guild)
+	}
+	if state.History == nil {
+		state.History = make(map[string][]*GuildChange)
 	}
 
 	j.state = state
 	return nil
 }
 
+// markDirty schedules the current state to be written to disk.
+func (j *JsonDB) markDirty() {
+	j.dirty.Store(true)
+}
+
 func (j *JsonDB) save() error {
+	j.saveMu.Lock()
+	defer j.saveMu.Unlock()
+
+	j.state.Lock()
 	d, err := json.Marshal(j.state)
+	j.state.Unlock()
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// rotating on every flush would leave backups only seconds apart
+	if j.lastBackup.IsZero() || time.Since(j.lastBackup) >= jsonBackupInterval {
+		if err := j.rotateBackups(); err != nil {
+			return err
+		}
+		j.lastBackup = time.Now()
+	}
+	return writeFileAtomic(j.path, d, 0644)
+}
+
+// rotateBackups shifts path.1 ... path.N-1 up by one and copies the current
+// data file into path.1.
+func (j *JsonDB) rotateBackups() error {
+	current, err := os.ReadFile(j.path)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
-	defer f.Close()
-	_, err = f.Write(d)
-	return err
-}
 
-func (j *JsonDB) GetConn() *sqlx.DB {
-	return nil
+	for i := jsonBackupCount - 1; i > 0; i-- {
+		from := fmt.Sprintf("%v.%v", j.path, i)
+		to := fmt.Sprintf("%v.%v", j.path, i+1)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeFileAtomic(j.path+".1", current, 0644)
 }
 
-func (j *JsonDB) CreateGuild(gid string) error {
-	j.state.Lock()
-	defer j.state.Unlock()
-	if _, ok := j.state.Guilds[gid]; ok {
-		return errors.New("key already exists")
+// writeFileAtomic writes data to a temporary file next to path, syncs it and
+// renames it over path, so readers only ever see the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
 	}
-	g := &Guild{ID: gid}
-	j.state.Guilds[gid] = g
-	return nil
-}
+	tmp := f.Name()
+	defer os.Remove(tmp)
 
-func (j *JsonDB) UpdateGuild(gid string, gc *Guild) error {
-	j.state.Lock()
-	defer j.state.Unlock()
-	if _, ok := j.state.Guilds[gid]; !ok {
-		return errors.New("key does not exist")
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
 	}
-	j.state.Guilds[gid] = gc
-	return nil
-}
 
-func (j *JsonDB) GetGuild(gid string) (*Guild, error) {
-	j.state.Lock()
-	defer j.state.Unlock()
-	if v, ok := j.state.Guilds[gid]; ok {
-		return v, nil
+	// make sure the rename itself is persisted
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
 	}
-	return nil, errors.New("key does not exist")
+	return nil
 }
@@ -0,0 +1,110 @@
+package stare
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//
+// Cached DB
+//
+
+// CachedDB keeps guild configs in memory in front of another DB. Reads are
+// served from memory when possible, and every write through it invalidates
+// the cached config of the guild.
+type CachedDB struct {
+	DB
+
+	mu     sync.RWMutex
+	guilds map[string]*Guild
+	// gen is bumped on every invalidation, so a read that raced with a write
+	// does not put a stale config back in the cache
+	gen uint64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// CacheStats holds the counters of a CachedDB.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+func NewCachedDB(db DB) *CachedDB {
+	return &CachedDB{
+		DB:     db,
+		guilds: make(map[string]*Guild),
+	}
+}
+
+// Stats returns the number of cache hits and misses so far, and the number of
+// guild configs currently cached.
+func (c *CachedDB) Stats() CacheStats {
+	c.mu.RLock()
+	size := len(c.guilds)
+	c.mu.RUnlock()
+
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   size,
+	}
+}
+
+func (c *CachedDB) GetGuild(gid string) (*Guild, error) {
+	c.mu.RLock()
+	gc, ok := c.guilds[gid]
+	gen := c.gen
+	c.mu.RUnlock()
+	if ok {
+		c.hits.Add(1)
+		return gc.Clone(), nil
+	}
+
+	c.misses.Add(1)
+	gc, err := c.DB.GetGuild(gid)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.gen == gen {
+		c.guilds[gid] = gc.Clone()
+	}
+	c.mu.Unlock()
+	return gc, nil
+}
+
+func (c *CachedDB) CreateGuild(gid string) error {
+	defer c.invalidate(gid)
+	return c.DB.CreateGuild(gid)
+}
+
+func (c *CachedDB) UpdateGuild(gid string, gc *Guild) error {
+	defer c.invalidate(gid)
+	return c.DB.UpdateGuild(gid, gc)
+}
+
+func (c *CachedDB) ModifyGuild(gid, actorID string, fn func(gc *Guild) error) (*Guild, error) {
+	defer c.invalidate(gid)
+	return c.DB.ModifyGuild(gid, actorID, fn)
+}
+
+func (c *CachedDB) RollbackGuild(gid, actorID string, version int) (*Guild, error) {
+	defer c.invalidate(gid)
+	return c.DB.RollbackGuild(gid, actorID, version)
+}
+
+func (c *CachedDB) DeleteGuild(gid string) error {
+	defer c.invalidate(gid)
+	return c.DB.DeleteGuild(gid)
+}
+
+func (c *CachedDB) invalidate(gid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.guilds, gid)
+	c.gen++
+}
@@ -0,0 +1,183 @@
+package stare_test
+
+import (
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/intrntsrfr/stare"
+	"github.com/intrntsrfr/stare/dbtest"
+)
+
+func TestCachedDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) stare.DB {
+		return stare.NewCachedDB(stare.NewMemoryDB())
+	})
+}
+
+// countingDB counts the guild configs read from the DB it wraps, and calls
+// afterGet, if set, once a config has been read.
+type countingDB struct {
+	stare.DB
+	gets     atomic.Int64
+	afterGet func()
+}
+
+func (c *countingDB) GetGuild(gid string) (*stare.Guild, error) {
+	c.gets.Add(1)
+	gc, err := c.DB.GetGuild(gid)
+	if c.afterGet != nil {
+		c.afterGet()
+	}
+	return gc, err
+}
+
+func TestCachedDBStats(t *testing.T) {
+	inner := &countingDB{DB: stare.NewMemoryDB()}
+	db := stare.NewCachedDB(inner)
+	if err := db.CreateGuild("1"); err != nil {
+		t.Fatalf("CreateGuild() error = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := db.GetGuild("1"); err != nil {
+			t.Fatalf("GetGuild() error = %v", err)
+		}
+	}
+	// guilds without a config are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := db.GetGuild("2"); !errors.Is(err, stare.ErrGuildNotFound) {
+			t.Fatalf("GetGuild() error = %v, want %v", err, stare.ErrGuildNotFound)
+		}
+	}
+
+	want := stare.CacheStats{Hits: 2, Misses: 3, Size: 1}
+	if got := db.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	if got := inner.gets.Load(); got != 3 {
+		t.Errorf("inner GetGuild() called %v times, want 3", got)
+	}
+}
+
+func TestCachedDBInvalidation(t *testing.T) {
+	setBanLog := func(ids ...string) func(gc *stare.Guild) error {
+		return func(gc *stare.Guild) error {
+			gc.BanLog = ids
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name    string
+		write   func(db *stare.CachedDB, inner stare.DB) error
+		want    stare.StringList
+		wantErr error
+	}{
+		{"CreateGuild", func(db *stare.CachedDB, inner stare.DB) error {
+			// the cached config is stale once it is removed behind the cache
+			if err := inner.DeleteGuild("1"); err != nil {
+				return err
+			}
+			return db.CreateGuild("1")
+		}, nil, nil},
+		{"UpdateGuild", func(db *stare.CachedDB, inner stare.DB) error {
+			return db.UpdateGuild("1", &stare.Guild{ID: "1", BanLog: stare.StringList{"12"}})
+		}, stare.StringList{"12"}, nil},
+		{"ModifyGuild", func(db *stare.CachedDB, inner stare.DB) error {
+			_, err := db.ModifyGuild("1", "100", setBanLog("12"))
+			return err
+		}, stare.StringList{"12"}, nil},
+		{"RollbackGuild", func(db *stare.CachedDB, inner stare.DB) error {
+			_, err := db.RollbackGuild("1", "100", 1)
+			return err
+		}, stare.StringList{"10"}, nil},
+		{"DeleteGuild", func(db *stare.CachedDB, inner stare.DB) error {
+			return db.DeleteGuild("1")
+		}, nil, stare.ErrGuildNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := stare.NewMemoryDB()
+			db := stare.NewCachedDB(inner)
+			if err := db.CreateGuild("1"); err != nil {
+				t.Fatalf("CreateGuild() error = %v", err)
+			}
+			for _, ids := range []stare.StringList{{"10"}, {"10", "11"}} {
+				if _, err := db.ModifyGuild("1", "100", setBanLog(ids...)); err != nil {
+					t.Fatalf("ModifyGuild() error = %v", err)
+				}
+			}
+			if _, err := db.GetGuild("1"); err != nil {
+				t.Fatalf("GetGuild() error = %v", err)
+			}
+			if size := db.Stats().Size; size != 1 {
+				t.Fatalf("Stats().Size = %v, want the config cached", size)
+			}
+
+			if err := tt.write(db, inner); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			if size := db.Stats().Size; size != 0 {
+				t.Errorf("Stats().Size after the write = %v, want the config evicted", size)
+			}
+			misses := db.Stats().Misses
+			gc, err := db.GetGuild("1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GetGuild() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !slices.Equal(gc.BanLog, tt.want) {
+				t.Errorf("GetGuild().BanLog = %v, want %v", gc.BanLog, tt.want)
+			}
+			if got := db.Stats().Misses; got != misses+1 {
+				t.Errorf("Stats().Misses = %v, want the read after the write to miss", got)
+			}
+		})
+	}
+}
+
+func TestCachedDBStaleRead(t *testing.T) {
+	inner := &countingDB{DB: stare.NewMemoryDB()}
+	db := stare.NewCachedDB(inner)
+	if err := db.CreateGuild("1"); err != nil {
+		t.Fatalf("CreateGuild() error = %v", err)
+	}
+
+	// hold a read of the old config until a write has gone through
+	read := make(chan struct{})
+	release := make(chan struct{})
+	inner.afterGet = func() {
+		close(read)
+		<-release
+	}
+	done := make(chan error)
+	go func() {
+		_, err := db.GetGuild("1")
+		done <- err
+	}()
+	<-read
+	inner.afterGet = nil
+	if _, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+		gc.BanLog.Add("10")
+		return nil
+	}); err != nil {
+		t.Fatalf("ModifyGuild() error = %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("GetGuild() error = %v", err)
+	}
+
+	if size := db.Stats().Size; size != 0 {
+		t.Errorf("Stats().Size = %v, want the stale read not cached", size)
+	}
+	gc, err := db.GetGuild("1")
+	if err != nil {
+		t.Fatalf("GetGuild() error = %v", err)
+	}
+	if !slices.Equal(gc.BanLog, stare.StringList{"10"}) {
+		t.Errorf("GetGuild().BanLog = %v, want %v", gc.BanLog, stare.StringList{"10"})
+	}
+}
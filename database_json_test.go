@@ -0,0 +1,201 @@
+package stare_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intrntsrfr/stare"
+	"github.com/intrntsrfr/stare/dbtest"
+)
+
+func TestJsonDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) stare.DB {
+		db, err := stare.NewJsonDatabase(filepath.Join(t.TempDir(), "data.json"))
+		if err != nil {
+			t.Fatalf("NewJsonDatabase() error = %v", err)
+		}
+		return db
+	})
+}
+
+// storedGuilds returns the sorted IDs of the guilds in a data file.
+func storedGuilds(t *testing.T, path string) []string {
+	t.Helper()
+	d, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var state struct {
+		Guilds map[string]json.RawMessage `json:"guilds"`
+	}
+	if err := json.Unmarshal(d, &state); err != nil {
+		t.Fatalf("data file %v is not valid JSON: %v", path, err)
+	}
+	var ids []string
+	for id := range state.Guilds {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// waitForFlush waits until the background flush has written gid to the data
+// file.
+func waitForFlush(t *testing.T, path, gid string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil && slices.Contains(storedGuilds(t, path), gid) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("guild %v was not flushed to %v", gid, path)
+}
+
+func openJsonDB(t *testing.T, path string) *stare.JsonDB {
+	t.Helper()
+	db, err := stare.NewJsonDatabase(path)
+	if err != nil {
+		t.Fatalf("NewJsonDatabase() error = %v", err)
+	}
+	return db
+}
+
+func TestJsonDBCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	corrupt := []byte(`{"guilds":{"1":`)
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if db, err := stare.NewJsonDatabase(path); err == nil {
+		db.Close()
+		t.Fatalf("NewJsonDatabase() of a corrupt file error = nil, want an error")
+	}
+	// the file is left for the user to restore
+	if d, err := os.ReadFile(path); err != nil || string(d) != string(corrupt) {
+		t.Errorf("data file = %q, %v, want it unchanged", d, err)
+	}
+}
+
+func TestJsonDBPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	db := openJsonDB(t, path)
+	if err := db.CreateGuild("1"); err != nil {
+		t.Fatalf("CreateGuild() error = %v", err)
+	}
+	if _, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+		gc.BanLog.Add("10")
+		return nil
+	}); err != nil {
+		t.Fatalf("ModifyGuild() error = %v", err)
+	}
+	// written in the background, without closing the database
+	waitForFlush(t, path, "1")
+
+	// pending changes are written on close
+	if err := db.CreateGuild("2"); err != nil {
+		t.Fatalf("CreateGuild() error = %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+
+	db = openJsonDB(t, path)
+	defer db.Close()
+	gc, err := db.GetGuild("1")
+	if err != nil {
+		t.Fatalf("GetGuild() error = %v", err)
+	}
+	if !slices.Equal(gc.BanLog, stare.StringList{"10"}) {
+		t.Errorf("GetGuild().BanLog = %v, want %v", gc.BanLog, stare.StringList{"10"})
+	}
+	if history, err := db.GetGuildHistory("1"); err != nil || len(history) != 1 {
+		t.Errorf("GetGuildHistory() = %v, %v, want the change", history, err)
+	}
+	if _, err := db.GetGuild("2"); err != nil {
+		t.Errorf("GetGuild() of a guild created before close error = %v", err)
+	}
+}
+
+func TestJsonDBAtomicWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+	db := openJsonDB(t, path)
+	for i := 0; i < 2; i++ {
+		gid := fmt.Sprint(i)
+		if err := db.CreateGuild(gid); err != nil {
+			t.Fatalf("CreateGuild() error = %v", err)
+		}
+		waitForFlush(t, path, gid)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// every write goes through a temporary file that is renamed over the
+	// data file, so none are left behind and the file is always complete
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("temporary file %v was left behind", e.Name())
+		}
+	}
+	if got := storedGuilds(t, path); !slices.Equal(got, []string{"0", "1"}) {
+		t.Errorf("stored guilds = %v, want %v", got, []string{"0", "1"})
+	}
+}
+
+func TestJsonDBBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+
+	// the backups are rotated by the first write after opening
+	const sessions = 7
+	var ids []string
+	for i := 1; i <= sessions; i++ {
+		db := openJsonDB(t, path)
+		gid := fmt.Sprint(i)
+		if err := db.CreateGuild(gid); err != nil {
+			t.Fatalf("CreateGuild() error = %v", err)
+		}
+		ids = append(ids, gid)
+		if i == sessions {
+			// and not again by later writes in the same hour
+			waitForFlush(t, path, gid)
+			if err := db.CreateGuild("8"); err != nil {
+				t.Fatalf("CreateGuild() error = %v", err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	}
+
+	if got, want := storedGuilds(t, path), append(slices.Clone(ids), "8"); !slices.Equal(got, want) {
+		t.Errorf("stored guilds = %v, want %v", got, want)
+	}
+	// data.json.1 is the newest backup, from before the last session
+	for i := 1; i <= 5; i++ {
+		backup := fmt.Sprintf("%v.%v", path, i)
+		if got, want := storedGuilds(t, backup), ids[:sessions-i]; !slices.Equal(got, want) {
+			t.Errorf("guilds in %v = %v, want %v", filepath.Base(backup), got, want)
+		}
+	}
+	if _, err := os.Stat(fmt.Sprintf("%v.6", path)); !os.IsNotExist(err) {
+		t.Errorf("Stat() of a sixth backup error = %v, want it to not exist", err)
+	}
+}
@@ -0,0 +1,163 @@
+package stare
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//
+// In-memory implementation DB
+//
+
+// MemoryDB is a DB that only keeps guild configs in memory. It is useful for
+// tests and as the base of file backed implementations.
+type MemoryDB struct {
+	state *memoryState
+	// onChange is called with the state locked after every mutation
+	onChange func()
+}
+
+type memoryState struct {
+	sync.Mutex
+	Guilds  map[string]*Guild         `json:"guilds"`
+	History map[string][]*GuildChange `json:"history"`
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{
+		Guilds:  make(map[string]*Guild),
+		History: make(map[string][]*GuildChange),
+	}
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		state: newMemoryState(),
+	}
+}
+
+func (m *MemoryDB) Close() error {
+	return nil
+}
+
+func (m *MemoryDB) changed() {
+	if m.onChange != nil {
+		m.onChange()
+	}
+}
+
+func (m *MemoryDB) GetConn() *sqlx.DB {
+	return nil
+}
+
+func (m *MemoryDB) CreateGuild(gid string) error {
+	m.state.Lock()
+	defer m.state.Unlock()
+	if _, ok := m.state.Guilds[gid]; ok {
+		return ErrGuildExists
+	}
+	g := &Guild{ID: gid}
+	m.state.Guilds[gid] = g
+	m.changed()
+	return nil
+}
+
+func (m *MemoryDB) UpdateGuild(gid string, gc *Guild) error {
+	_, err := m.ModifyGuild(gid, "", func(c *Guild) error {
+		*c = *gc.Clone()
+		return nil
+	})
+	return err
+}
+
+func (m *MemoryDB) ModifyGuild(gid, actorID string, fn func(gc *Guild) error) (*Guild, error) {
+	m.state.Lock()
+	defer m.state.Unlock()
+	v, ok := m.state.Guilds[gid]
+	if !ok {
+		return nil, ErrGuildNotFound
+	}
+
+	gc := v.Clone()
+	if err := fn(gc); err != nil {
+		return nil, err
+	}
+	gc.ID = gid
+	if err := m.commit(v, gc, actorID); err != nil {
+		return nil, err
+	}
+	return gc.Clone(), nil
+}
+
+// commit stores gc and records how it differs from old. The state lock must
+// be held.
+func (m *MemoryDB) commit(old, gc *Guild, actorID string) error {
+	changes, err := diffGuilds(old, gc)
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		history := m.state.History[gc.ID]
+		stampChanges(changes, latestVersion(history)+1, actorID, time.Now().UTC())
+		m.state.History[gc.ID] = append(history, changes...)
+	}
+	m.state.Guilds[gc.ID] = gc
+	m.changed()
+	return nil
+}
+
+func (m *MemoryDB) GetGuildHistory(gid string) ([]*GuildChange, error) {
+	m.state.Lock()
+	defer m.state.Unlock()
+	if _, ok := m.state.Guilds[gid]; !ok {
+		return nil, ErrGuildNotFound
+	}
+
+	history := make([]*GuildChange, 0, len(m.state.History[gid]))
+	for _, c := range m.state.History[gid] {
+		cc := *c
+		history = append(history, &cc)
+	}
+	return history, nil
+}
+
+func (m *MemoryDB) RollbackGuild(gid, actorID string, version int) (*Guild, error) {
+	m.state.Lock()
+	defer m.state.Unlock()
+	v, ok := m.state.Guilds[gid]
+	if !ok {
+		return nil, ErrGuildNotFound
+	}
+
+	gc := v.Clone()
+	if err := rollbackGuild(gc, m.state.History[gid], version); err != nil {
+		return nil, err
+	}
+	if err := m.commit(v, gc, actorID); err != nil {
+		return nil, err
+	}
+	return gc.Clone(), nil
+}
+
+func (m *MemoryDB) DeleteGuild(gid string) error {
+	m.state.Lock()
+	defer m.state.Unlock()
+	if _, ok := m.state.Guilds[gid]; !ok {
+		return ErrGuildNotFound
+	}
+	delete(m.state.Guilds, gid)
+	delete(m.state.History, gid)
+	m.changed()
+	return nil
+}
+
+func (m *MemoryDB) GetGuild(gid string) (*Guild, error) {
+	m.state.Lock()
+	defer m.state.Unlock()
+	if v, ok := m.state.Guilds[gid]; ok {
+		return v.Clone(), nil
+	}
+	return nil, ErrGuildNotFound
+}
@@ -0,0 +1,14 @@
+package stare_test
+
+import (
+	"testing"
+
+	"github.com/intrntsrfr/stare"
+	"github.com/intrntsrfr/stare/dbtest"
+)
+
+func TestMemoryDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) stare.DB {
+		return stare.NewMemoryDB()
+	})
+}
@@ -0,0 +1,343 @@
+package stare
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+//
+// SQL implementation DB
+//
+
+// SqlDB is a DB backed by an sqlx connection. It supports the sqlite3 and
+// postgres drivers, and applies the embedded migrations when opened.
+type SqlDB struct {
+	conn   *sqlx.DB
+	driver string
+	log    *zap.Logger
+}
+
+func NewSqlDatabase(cfg *Config) (*SqlDB, error) {
+	log := cfg.Log
+	if log == nil {
+		log = zap.NewNop()
+	}
+
+	switch cfg.Driver {
+	case "sqlite3", "postgres":
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", cfg.Driver)
+	}
+
+	conn, err := sqlx.Connect(cfg.Driver, cfg.ConnStr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Driver == "sqlite3" {
+		// sqlite only allows a single writer, so serialize access instead of
+		// failing with SQLITE_BUSY under load
+		conn.SetMaxOpenConns(1)
+	}
+
+	db := &SqlDB{
+		conn:   conn,
+		driver: cfg.Driver,
+		log:    log,
+	}
+	if err := db.migrate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, e := range entries {
+		name := e.Name()
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q: %w", name, err)
+		}
+
+		query, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, query: string(query)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version %v", migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+func (s *SqlDB) migrate() error {
+	return s.migrateTo(math.MaxInt)
+}
+
+// migrateTo applies the migrations that have not been applied yet, up to and
+// including version.
+func (s *SqlDB) migrateTo(version int) error {
+	if _, err := s.conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := s.conn.Get(&current, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"); err != nil {
+		return err
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if m.version > version {
+			break
+		}
+
+		tx, err := s.conn.Beginx()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(m.query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %v: %w", m.name, err)
+		}
+		if _, err := tx.Exec(tx.Rebind("INSERT INTO schema_migrations (version, name) VALUES (?, ?)"), m.version, m.name); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		s.log.Info("applied migration", zap.String("name", m.name))
+	}
+	return nil
+}
+
+func (s *SqlDB) GetConn() *sqlx.DB {
+	return s.conn
+}
+
+func (s *SqlDB) Close() error {
+	return s.conn.Close()
+}
+
+func (s *SqlDB) CreateGuild(gid string) error {
+	_, err := s.conn.Exec(s.conn.Rebind("INSERT INTO guilds (id) VALUES (?)"), gid)
+	if isUniqueViolation(err) {
+		return ErrGuildExists
+	}
+	return err
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	return false
+}
+
+func (s *SqlDB) UpdateGuild(gid string, gc *Guild) error {
+	_, err := s.ModifyGuild(gid, "", func(c *Guild) error {
+		*c = *gc.Clone()
+		return nil
+	})
+	return err
+}
+
+func updateGuild(e sqlx.Ext, gid string, gc *Guild) error {
+	gc.ID = gid
+	res, err := sqlx.NamedExec(e, `UPDATE guilds SET
+		msg_edit_log = :msg_edit_log,
+		msg_delete_log = :msg_delete_log,
+		ban_log = :ban_log,
+		unban_log = :unban_log,
+		join_log = :join_log,
+		leave_log = :leave_log,
+		role_log = :role_log,
+		channel_log = :channel_log,
+		ignored_channels = :ignored_channels,
+		ignored_categories = :ignored_categories,
+		ignored_users = :ignored_users,
+		ignored_roles = :ignored_roles,
+		log_webhooks = :log_webhooks,
+		message_retention_hours = :message_retention_hours
+		WHERE id = :id`, gc)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrGuildNotFound
+	}
+	return nil
+}
+
+func (s *SqlDB) GetGuild(gid string) (*Guild, error) {
+	return getGuild(s.conn, gid, false)
+}
+
+func getGuild(e sqlx.Ext, gid string, forUpdate bool) (*Guild, error) {
+	query := "SELECT * FROM guilds WHERE id = ?"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+
+	var g Guild
+	if err := sqlx.Get(e, &g, e.Rebind(query), gid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrGuildNotFound
+		}
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *SqlDB) ModifyGuild(gid, actorID string, fn func(gc *Guild) error) (*Guild, error) {
+	return s.modify(gid, actorID, func(tx *sqlx.Tx, gc *Guild) error {
+		return fn(gc)
+	})
+}
+
+func (s *SqlDB) RollbackGuild(gid, actorID string, version int) (*Guild, error) {
+	return s.modify(gid, actorID, func(tx *sqlx.Tx, gc *Guild) error {
+		history, err := getGuildHistory(tx, gid)
+		if err != nil {
+			return err
+		}
+		return rollbackGuild(gc, history, version)
+	})
+}
+
+// modify runs fn on the guild config inside a transaction, then stores the
+// result and records the changes made to it.
+func (s *SqlDB) modify(gid, actorID string, fn func(tx *sqlx.Tx, gc *Guild) error) (*Guild, error) {
+	tx, err := s.conn.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// sqlite serializes transactions on its single connection, while postgres
+	// needs the row to be locked explicitly
+	old, err := getGuild(tx, gid, s.driver == "postgres")
+	if err != nil {
+		return nil, err
+	}
+	gc := old.Clone()
+	if err := fn(tx, gc); err != nil {
+		return nil, err
+	}
+	if err := updateGuild(tx, gid, gc); err != nil {
+		return nil, err
+	}
+
+	changes, err := diffGuilds(old, gc)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) > 0 {
+		var version int
+		if err := tx.Get(&version, tx.Rebind("SELECT COALESCE(MAX(version), 0) FROM guild_history WHERE guild_id = ?"), gid); err != nil {
+			return nil, err
+		}
+		stampChanges(changes, version+1, actorID, time.Now().UTC())
+		if _, err := tx.NamedExec(`INSERT INTO guild_history (guild_id, version, field, actor_id, old_value, new_value, changed_at)
+			VALUES (:guild_id, :version, :field, :actor_id, :old_value, :new_value, :changed_at)`, changes); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return gc.Clone(), nil
+}
+
+func (s *SqlDB) DeleteGuild(gid string) error {
+	tx, err := s.conn.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// sqlite does not enforce the cascade unless foreign keys are enabled, so
+	// remove the history explicitly
+	if _, err := tx.Exec(tx.Rebind("DELETE FROM guild_history WHERE guild_id = ?"), gid); err != nil {
+		return err
+	}
+	res, err := tx.Exec(tx.Rebind("DELETE FROM guilds WHERE id = ?"), gid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrGuildNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *SqlDB) GetGuildHistory(gid string) ([]*GuildChange, error) {
+	if _, err := getGuild(s.conn, gid, false); err != nil {
+		return nil, err
+	}
+	return getGuildHistory(s.conn, gid)
+}
+
+func getGuildHistory(q sqlx.Ext, gid string) ([]*GuildChange, error) {
+	var history []*GuildChange
+	err := sqlx.Select(q, &history, q.Rebind("SELECT * FROM guild_history WHERE guild_id = ? ORDER BY version, field"), gid)
+	return history, err
+}
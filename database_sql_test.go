@@ -0,0 +1,18 @@
+package stare_test
+
+import (
+	"testing"
+
+	"github.com/intrntsrfr/stare"
+	"github.com/intrntsrfr/stare/dbtest"
+)
+
+func TestSqlDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) stare.DB {
+		db, err := stare.NewSqlDatabase(&stare.Config{Driver: "sqlite3", ConnStr: ":memory:"})
+		if err != nil {
+			t.Fatalf("NewSqlDatabase() error = %v", err)
+		}
+		return db
+	})
+}
@@ -0,0 +1,165 @@
+package stare_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/intrntsrfr/stare"
+)
+
+func TestGuildConcurrentAccess(t *testing.T) {
+	tests := []struct {
+		name  string
+		newDB func(t *testing.T) stare.DB
+	}{
+		{"MemoryDB", func(t *testing.T) stare.DB {
+			return stare.NewMemoryDB()
+		}},
+		{"JsonDB", func(t *testing.T) stare.DB {
+			db, err := stare.NewJsonDatabase(filepath.Join(t.TempDir(), "data.json"))
+			if err != nil {
+				t.Fatalf("NewJsonDatabase() error = %v", err)
+			}
+			return db
+		}},
+		{"SqlDB", func(t *testing.T) stare.DB {
+			db, err := stare.NewSqlDatabase(&stare.Config{Driver: "sqlite3", ConnStr: ":memory:"})
+			if err != nil {
+				t.Fatalf("NewSqlDatabase() error = %v", err)
+			}
+			return db
+		}},
+		{"CachedDB", func(t *testing.T) stare.DB {
+			return stare.NewCachedDB(stare.NewMemoryDB())
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := tt.newDB(t)
+			defer db.Close()
+			if err := db.CreateGuild("1"); err != nil {
+				t.Fatalf("CreateGuild() error = %v", err)
+			}
+
+			// settings commands change the config while event handlers read
+			// it, and handlers must be free to change the copy they get
+			const n = 20
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(3)
+				go func(i int) {
+					defer wg.Done()
+					if _, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+						gc.IgnoredChannels.Add(fmt.Sprint(i))
+						return nil
+					}); err != nil {
+						t.Errorf("ModifyGuild() error = %v", err)
+					}
+				}(i)
+				go func(i int) {
+					defer wg.Done()
+					gc, err := db.GetGuild("1")
+					if err != nil {
+						t.Errorf("GetGuild() error = %v", err)
+						return
+					}
+					gc.BanLog = stare.StringList{fmt.Sprint(i)}
+					if err := db.UpdateGuild("1", gc); err != nil {
+						t.Errorf("UpdateGuild() error = %v", err)
+					}
+				}(i)
+				go func() {
+					defer wg.Done()
+					gc, err := db.GetGuild("1")
+					if err != nil {
+						t.Errorf("GetGuild() error = %v", err)
+						return
+					}
+					_ = gc.IsIgnored("0", nil, "", nil)
+					_ = gc.LogChannels(stare.LogTypeBan)
+					gc.JoinLog.Add("reader")
+					gc.IgnoredChannels.Remove("0")
+				}()
+			}
+			wg.Wait()
+
+			gc, err := db.GetGuild("1")
+			if err != nil {
+				t.Fatalf("GetGuild() error = %v", err)
+			}
+			if gc.JoinLog.Contains("reader") {
+				t.Errorf("GetGuild().JoinLog = %v, changes to a returned config must not be stored", gc.JoinLog)
+			}
+			if len(gc.BanLog) != 1 {
+				t.Errorf("GetGuild().BanLog = %v, want one of the updates", gc.BanLog)
+			}
+		})
+	}
+}
+
+func TestStringListUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want stare.StringList
+	}{
+		{"List", `["10","11"]`, stare.StringList{"10", "11"}},
+		{"EmptyList", `[]`, stare.StringList{}},
+		{"Null", `null`, nil},
+		{"LegacyString", `"10"`, stare.StringList{"10"}},
+		{"LegacyEmptyString", `""`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got stare.StringList
+			if err := json.Unmarshal([]byte(tt.data), &got); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	var got stare.StringList
+	if err := json.Unmarshal([]byte(`10`), &got); err == nil {
+		t.Errorf("Unmarshal(10) error = nil, want an error")
+	}
+}
+
+func TestJsonDBLegacyLogChannels(t *testing.T) {
+	// a data file written before log types could have multiple destinations
+	path := filepath.Join(t.TempDir(), "data.json")
+	legacy := `{"guilds":{"1":{"id":"1","msg_edit_log":"10","msg_delete_log":"","ban_log":"11"}}}`
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	db, err := stare.NewJsonDatabase(path)
+	if err != nil {
+		t.Fatalf("NewJsonDatabase() error = %v", err)
+	}
+	defer db.Close()
+
+	gc, err := db.GetGuild("1")
+	if err != nil {
+		t.Fatalf("GetGuild() error = %v", err)
+	}
+	want := map[stare.LogType]stare.StringList{
+		stare.LogTypeMsgEdit:   {"10"},
+		stare.LogTypeMsgDelete: nil,
+		stare.LogTypeBan:       {"11"},
+		stare.LogTypeJoin:      nil,
+	}
+	for lt, w := range want {
+		if got := *gc.LogChannels(lt); !reflect.DeepEqual(got, w) {
+			t.Errorf("LogChannels(%v) = %#v, want %#v", lt, got, w)
+		}
+	}
+}
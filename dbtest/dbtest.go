@@ -0,0 +1,349 @@
+// Package dbtest provides a conformance test suite for implementations of
+// stare.DB.
+//
+// An implementation is tested by calling Run from a test in its own package:
+//
+//	func TestConformance(t *testing.T) {
+//		dbtest.Run(t, func(t *testing.T) stare.DB {
+//			return NewMyDB(t.TempDir())
+//		})
+//	}
+package dbtest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/intrntsrfr/stare"
+)
+
+// Run runs the conformance suite against databases created by newDB. Every
+// call to newDB must return a new, empty database. Databases are closed when
+// each test ends.
+func Run(t *testing.T, newDB func(t *testing.T) stare.DB) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, db stare.DB)
+	}{
+		{"CreateGuild", testCreateGuild},
+		{"CreateGuildExists", testCreateGuildExists},
+		{"GetGuildNotFound", testGetGuildNotFound},
+		{"GetGuildReturnsCopy", testGetGuildReturnsCopy},
+		{"UpdateGuild", testUpdateGuild},
+		{"UpdateGuildNotFound", testUpdateGuildNotFound},
+		{"ModifyGuild", testModifyGuild},
+		{"ModifyGuildAbort", testModifyGuildAbort},
+		{"ModifyGuildNotFound", testModifyGuildNotFound},
+		{"ModifyGuildConcurrent", testModifyGuildConcurrent},
+		{"History", testHistory},
+		{"HistorySkipsNoop", testHistorySkipsNoop},
+		{"RollbackGuild", testRollbackGuild},
+		{"RollbackGuildNothingToUndo", testRollbackGuildNothingToUndo},
+		{"DeleteGuild", testDeleteGuild},
+		{"DeleteGuildNotFound", testDeleteGuildNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newDB(t)
+			t.Cleanup(func() {
+				if err := db.Close(); err != nil {
+					t.Errorf("Close() error = %v", err)
+				}
+			})
+			tt.fn(t, db)
+		})
+	}
+}
+
+func mustCreate(t *testing.T, db stare.DB, gid string) {
+	t.Helper()
+	if err := db.CreateGuild(gid); err != nil {
+		t.Fatalf("CreateGuild(%q) error = %v", gid, err)
+	}
+}
+
+func mustGet(t *testing.T, db stare.DB, gid string) *stare.Guild {
+	t.Helper()
+	gc, err := db.GetGuild(gid)
+	if err != nil {
+		t.Fatalf("GetGuild(%q) error = %v", gid, err)
+	}
+	return gc
+}
+
+func testCreateGuild(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	gc := mustGet(t, db, "1")
+	if gc.ID != "1" {
+		t.Errorf("GetGuild().ID = %q, want %q", gc.ID, "1")
+	}
+	if len(gc.BanLog) != 0 || len(gc.IgnoredChannels) != 0 || len(gc.LogWebhooks) != 0 {
+		t.Errorf("GetGuild() = %+v, want empty config", gc)
+	}
+}
+
+func testCreateGuildExists(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	if err := db.CreateGuild("1"); !errors.Is(err, stare.ErrGuildExists) {
+		t.Errorf("CreateGuild() error = %v, want %v", err, stare.ErrGuildExists)
+	}
+}
+
+func testGetGuildNotFound(t *testing.T, db stare.DB) {
+	if _, err := db.GetGuild("1"); !errors.Is(err, stare.ErrGuildNotFound) {
+		t.Errorf("GetGuild() error = %v, want %v", err, stare.ErrGuildNotFound)
+	}
+}
+
+func testGetGuildReturnsCopy(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	if _, err := db.ModifyGuild("1", "", func(gc *stare.Guild) error {
+		gc.BanLog.Add("10")
+		return nil
+	}); err != nil {
+		t.Fatalf("ModifyGuild() error = %v", err)
+	}
+
+	gc := mustGet(t, db, "1")
+	gc.BanLog[0] = "20"
+	gc.JoinLog.Add("30")
+
+	gc = mustGet(t, db, "1")
+	if len(gc.BanLog) != 1 || gc.BanLog[0] != "10" || len(gc.JoinLog) != 0 {
+		t.Errorf("GetGuild() = %+v, changes to a returned config must not be stored", gc)
+	}
+}
+
+func testUpdateGuild(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	gc := mustGet(t, db, "1")
+	gc.MsgEditLog = stare.StringList{"10", "11"}
+	gc.IgnoredUsers = stare.StringList{"12"}
+	gc.LogWebhooks = stare.LogWebhooks{stare.LogTypeBan: {Name: "Bans"}}
+	if err := db.UpdateGuild("1", gc); err != nil {
+		t.Fatalf("UpdateGuild() error = %v", err)
+	}
+
+	gc = mustGet(t, db, "1")
+	if len(gc.MsgEditLog) != 2 || gc.MsgEditLog[0] != "10" || gc.MsgEditLog[1] != "11" {
+		t.Errorf("GetGuild().MsgEditLog = %v, want [10 11]", gc.MsgEditLog)
+	}
+	if !gc.IgnoredUsers.Contains("12") {
+		t.Errorf("GetGuild().IgnoredUsers = %v, want [12]", gc.IgnoredUsers)
+	}
+	if gc.LogWebhooks[stare.LogTypeBan].Name != "Bans" {
+		t.Errorf("GetGuild().LogWebhooks = %v, want ban webhook", gc.LogWebhooks)
+	}
+}
+
+func testUpdateGuildNotFound(t *testing.T, db stare.DB) {
+	if err := db.UpdateGuild("1", &stare.Guild{ID: "1"}); !errors.Is(err, stare.ErrGuildNotFound) {
+		t.Errorf("UpdateGuild() error = %v, want %v", err, stare.ErrGuildNotFound)
+	}
+}
+
+func testModifyGuild(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	got, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+		gc.BanLog.Add("10")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ModifyGuild() error = %v", err)
+	}
+	if !got.BanLog.Contains("10") {
+		t.Errorf("ModifyGuild() = %+v, want the stored config", got)
+	}
+	if gc := mustGet(t, db, "1"); !gc.BanLog.Contains("10") {
+		t.Errorf("GetGuild().BanLog = %v, want [10]", gc.BanLog)
+	}
+}
+
+func testModifyGuildAbort(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	errAbort := errors.New("abort")
+	_, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+		gc.BanLog.Add("10")
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Errorf("ModifyGuild() error = %v, want %v", err, errAbort)
+	}
+	if gc := mustGet(t, db, "1"); len(gc.BanLog) != 0 {
+		t.Errorf("GetGuild().BanLog = %v, aborted changes must not be stored", gc.BanLog)
+	}
+}
+
+func testModifyGuildNotFound(t *testing.T, db stare.DB) {
+	_, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+		return nil
+	})
+	if !errors.Is(err, stare.ErrGuildNotFound) {
+		t.Errorf("ModifyGuild() error = %v, want %v", err, stare.ErrGuildNotFound)
+	}
+}
+
+func testModifyGuildConcurrent(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+				gc.IgnoredChannels.Add(fmt.Sprint(i))
+				return nil
+			}); err != nil {
+				t.Errorf("ModifyGuild() error = %v", err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			if gc, err := db.GetGuild("1"); err == nil {
+				_ = gc.IsIgnored("0", nil, "", nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if gc := mustGet(t, db, "1"); len(gc.IgnoredChannels) != n {
+		t.Errorf("len(GetGuild().IgnoredChannels) = %v, want %v; concurrent changes were lost", len(gc.IgnoredChannels), n)
+	}
+}
+
+func testHistory(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	if _, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+		gc.BanLog.Add("10")
+		gc.JoinLog.Add("11")
+		return nil
+	}); err != nil {
+		t.Fatalf("ModifyGuild() error = %v", err)
+	}
+	if _, err := db.ModifyGuild("1", "200", func(gc *stare.Guild) error {
+		gc.BanLog.Remove("10")
+		return nil
+	}); err != nil {
+		t.Fatalf("ModifyGuild() error = %v", err)
+	}
+
+	history, err := db.GetGuildHistory("1")
+	if err != nil {
+		t.Fatalf("GetGuildHistory() error = %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("len(GetGuildHistory()) = %v, want 3", len(history))
+	}
+
+	versions := map[int]int{}
+	for _, c := range history {
+		versions[c.Version]++
+		if c.GuildID != "1" {
+			t.Errorf("GuildChange.GuildID = %q, want %q", c.GuildID, "1")
+		}
+		if c.Timestamp.IsZero() {
+			t.Errorf("GuildChange.Timestamp is zero")
+		}
+	}
+	if versions[1] != 2 || versions[2] != 1 {
+		t.Errorf("GetGuildHistory() versions = %v, want two changes in version 1 and one in version 2", versions)
+	}
+
+	last := history[len(history)-1]
+	if last.Version != 2 || last.ActorID != "200" || last.Field != "ban_log" {
+		t.Errorf("last change = %+v, want version 2 of ban_log by 200", last)
+	}
+}
+
+func testHistorySkipsNoop(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	if _, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+		return nil
+	}); err != nil {
+		t.Fatalf("ModifyGuild() error = %v", err)
+	}
+
+	history, err := db.GetGuildHistory("1")
+	if err != nil {
+		t.Fatalf("GetGuildHistory() error = %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("GetGuildHistory() = %v, want no changes recorded", history)
+	}
+}
+
+func testRollbackGuild(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	for _, id := range []string{"10", "11", "12"} {
+		if _, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+			gc.BanLog.Add(id)
+			return nil
+		}); err != nil {
+			t.Fatalf("ModifyGuild() error = %v", err)
+		}
+	}
+
+	gc, err := db.RollbackGuild("1", "200", 1)
+	if err != nil {
+		t.Fatalf("RollbackGuild() error = %v", err)
+	}
+	if len(gc.BanLog) != 1 || gc.BanLog[0] != "10" {
+		t.Errorf("RollbackGuild().BanLog = %v, want [10]", gc.BanLog)
+	}
+	if gc := mustGet(t, db, "1"); len(gc.BanLog) != 1 || gc.BanLog[0] != "10" {
+		t.Errorf("GetGuild().BanLog = %v, want [10]", gc.BanLog)
+	}
+
+	history, err := db.GetGuildHistory("1")
+	if err != nil {
+		t.Fatalf("GetGuildHistory() error = %v", err)
+	}
+	if last := history[len(history)-1]; last.Version != 4 || last.ActorID != "200" {
+		t.Errorf("last change = %+v, want the rollback recorded as version 4 by 200", last)
+	}
+}
+
+func testRollbackGuildNothingToUndo(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	if _, err := db.RollbackGuild("1", "200", 0); err == nil {
+		t.Errorf("RollbackGuild() error = nil, want error when there is nothing to roll back")
+	}
+}
+
+func testDeleteGuild(t *testing.T, db stare.DB) {
+	mustCreate(t, db, "1")
+	if _, err := db.ModifyGuild("1", "100", func(gc *stare.Guild) error {
+		gc.BanLog.Add("10")
+		return nil
+	}); err != nil {
+		t.Fatalf("ModifyGuild() error = %v", err)
+	}
+
+	if err := db.DeleteGuild("1"); err != nil {
+		t.Fatalf("DeleteGuild() error = %v", err)
+	}
+	if _, err := db.GetGuild("1"); !errors.Is(err, stare.ErrGuildNotFound) {
+		t.Errorf("GetGuild() error = %v, want %v", err, stare.ErrGuildNotFound)
+	}
+
+	// a guild that is added back starts from scratch
+	mustCreate(t, db, "1")
+	history, err := db.GetGuildHistory("1")
+	if err != nil {
+		t.Fatalf("GetGuildHistory() error = %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("GetGuildHistory() = %v, want history removed with the guild", history)
+	}
+}
+
+func testDeleteGuildNotFound(t *testing.T, db stare.DB) {
+	if err := db.DeleteGuild("1"); !errors.Is(err, stare.ErrGuildNotFound) {
+		t.Errorf("DeleteGuild() error = %v, want %v", err, stare.ErrGuildNotFound)
+	}
+}
@@ -0,0 +1,210 @@
+package stare
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+// webhookName is the name of the webhooks the bot creates in log channels
+const webhookName = "Stare Logs"
+
+// sendLog delivers a log message to every destination configured for the log
+// type, through webhooks if the guild has enabled that for the log type.
+func (b *Bot) sendLog(s *discordgo.Session, gc *Guild, t LogType, msg *discordgo.MessageSend) {
+	channels := gc.LogChannels(t)
+	if channels == nil || len(*channels) == 0 {
+		return
+	}
+
+	// file readers can only be consumed once, so buffer them to be able to
+	// attach them to every message
+	files, err := bufferFiles(msg.Files)
+	if err != nil {
+		b.logger.Error("failed to read log attachments", zap.Error(err))
+		return
+	}
+
+	settings, useWebhook := gc.LogWebhooks[t]
+	for _, channelID := range *channels {
+		if useWebhook {
+			err := b.sendWebhookLog(s, channelID, settings, msg, files)
+			if err == nil {
+				continue
+			}
+			b.logger.Warn("failed to send log through webhook, falling back to bot message",
+				zap.String("type", string(t)),
+				zap.String("channelID", channelID),
+				zap.Error(err),
+			)
+		}
+
+		m := *msg
+		m.Files = files.open()
+		if _, err := s.ChannelMessageSendComplex(channelID, &m); err != nil {
+			b.logger.Error("failed to send log",
+				zap.String("type", string(t)),
+				zap.String("channelID", channelID),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// sendWebhookLog executes the channel's webhook with the log message. If the
+// webhook has been deleted, a new one is created and the message is retried
+// once.
+func (b *Bot) sendWebhookLog(s *discordgo.Session, channelID string, settings LogWebhook, msg *discordgo.MessageSend, files bufferedFiles) error {
+	for attempt := 0; ; attempt++ {
+		wh, err := b.webhooks.get(s, channelID)
+		if err != nil {
+			return err
+		}
+
+		params := &discordgo.WebhookParams{
+			Content:         msg.Content,
+			Username:        settings.Name,
+			AvatarURL:       settings.AvatarURL,
+			Embeds:          msg.Embeds,
+			Files:           files.open(),
+			AllowedMentions: msg.AllowedMentions,
+		}
+		_, err = s.WebhookExecute(wh.ID, wh.Token, false, params)
+		if err == nil {
+			return nil
+		}
+
+		if !isUnknownWebhook(err) || attempt > 0 {
+			return err
+		}
+		b.webhooks.forget(channelID)
+	}
+}
+
+func isUnknownWebhook(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) {
+		return false
+	}
+	if restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownWebhook {
+		return true
+	}
+	return restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound
+}
+
+// webhookCache keeps track of the webhook the bot uses in each log channel.
+type webhookCache struct {
+	sync.Mutex
+	hooks map[string]*webhookEntry
+}
+
+// webhookEntry holds the webhook of a channel. Its lock is held while the
+// webhook is looked up or created, so that a channel gets only one webhook
+// without holding up deliveries to other channels.
+type webhookEntry struct {
+	sync.Mutex
+	webhook *discordgo.Webhook
+}
+
+func newWebhookCache() *webhookCache {
+	return &webhookCache{
+		hooks: make(map[string]*webhookEntry),
+	}
+}
+
+// entry returns the entry of a channel, adding it if there is none.
+func (c *webhookCache) entry(channelID string) *webhookEntry {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.hooks[channelID]
+	if !ok {
+		e = &webhookEntry{}
+		c.hooks[channelID] = e
+	}
+	return e
+}
+
+// get returns the bot's webhook for a channel, reusing one the bot created
+// earlier if it still exists, or creating a new one.
+func (c *webhookCache) get(s *discordgo.Session, channelID string) (*discordgo.Webhook, error) {
+	e := c.entry(channelID)
+	e.Lock()
+	defer e.Unlock()
+	if e.webhook != nil {
+		return e.webhook, nil
+	}
+
+	hooks, err := s.ChannelWebhooks(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	var wh *discordgo.Webhook
+	for _, h := range hooks {
+		if h.Token != "" && h.User != nil && h.User.ID == s.State.User.ID {
+			wh = h
+			break
+		}
+	}
+	if wh == nil {
+		wh, err = s.WebhookCreate(channelID, webhookName, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.webhook = wh
+	return wh, nil
+}
+
+func (c *webhookCache) forget(channelID string) {
+	e := c.entry(channelID)
+	e.Lock()
+	defer e.Unlock()
+	e.webhook = nil
+}
+
+type bufferedFile struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+type bufferedFiles []bufferedFile
+
+func bufferFiles(files []*discordgo.File) (bufferedFiles, error) {
+	buffered := make(bufferedFiles, 0, len(files))
+	for _, f := range files {
+		data, err := io.ReadAll(f.Reader)
+		if err != nil {
+			return nil, err
+		}
+		buffered = append(buffered, bufferedFile{
+			name:        f.Name,
+			contentType: f.ContentType,
+			data:        data,
+		})
+	}
+	return buffered, nil
+}
+
+// open returns a fresh set of files reading from the buffered data.
+func (bf bufferedFiles) open() []*discordgo.File {
+	if len(bf) == 0 {
+		return nil
+	}
+	files := make([]*discordgo.File, 0, len(bf))
+	for _, f := range bf {
+		files = append(files, &discordgo.File{
+			Name:        f.name,
+			ContentType: f.contentType,
+			Reader:      bytes.NewReader(f.data),
+		})
+	}
+	return files
+}
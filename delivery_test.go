@@ -0,0 +1,119 @@
+package stare
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newWebhookSession returns a session that answers the webhook requests of a
+// channel with no webhooks. Requests for a channel in blocked wait until it
+// is closed. It counts the webhooks created per channel.
+func newWebhookSession(t *testing.T, blocked map[string]chan struct{}) (*discordgo.Session, func(channelID string) int) {
+	t.Helper()
+	s, err := discordgo.New("Bot test")
+	if err != nil {
+		t.Fatalf("discordgo.New() error = %v", err)
+	}
+	s.State.User = &discordgo.User{ID: "999"}
+
+	var mu sync.Mutex
+	created := make(map[string]int)
+	s.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		// /api/v9/channels/<id>/webhooks
+		parts := strings.Split(req.URL.Path, "/")
+		if len(parts) != 6 || parts[5] != "webhooks" {
+			return nil, fmt.Errorf("unexpected request %v %v", req.Method, req.URL.Path)
+		}
+		cid := parts[4]
+		if ch, ok := blocked[cid]; ok {
+			<-ch
+		}
+
+		body := "[]"
+		if req.Method == http.MethodPost {
+			mu.Lock()
+			created[cid]++
+			mu.Unlock()
+			body = fmt.Sprintf(`{"id": "w%v", "token": "token", "channel_id": "%v", "user": {"id": "999"}}`, cid, cid)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})}
+
+	return s, func(channelID string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return created[channelID]
+	}
+}
+
+func TestWebhookCacheCreatesOncePerChannel(t *testing.T) {
+	s, created := newWebhookSession(t, nil)
+	c := newWebhookCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.get(s, "10"); err != nil {
+				t.Errorf("get() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := created("10"); n != 1 {
+		t.Errorf("created %v webhooks, want 1", n)
+	}
+
+	c.forget("10")
+	wh, err := c.get(s, "10")
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if wh.ID != "w10" || created("10") != 2 {
+		t.Errorf("get() after forget() = %+v with %v webhooks created, want a new webhook", wh, created("10"))
+	}
+}
+
+func TestWebhookCacheDoesNotBlockOtherChannels(t *testing.T) {
+	slow := make(chan struct{})
+	defer close(slow)
+	s, _ := newWebhookSession(t, map[string]chan struct{}{"10": slow})
+	c := newWebhookCache()
+
+	go c.get(s, "10")
+	// give the slow lookup time to start
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		_, err := c.get(s, "11")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("get() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("get() of a channel waited for the webhook lookup of another channel")
+	}
+}
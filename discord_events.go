@@ -2,13 +2,14 @@ package stare
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/dgraph-io/badger"
 	"github.com/intrntsrfr/meido/pkg/utils"
 	"github.com/intrntsrfr/meido/pkg/utils/builders"
 	"go.uber.org/zap"
@@ -24,6 +25,36 @@ const (
 	ColorOrange Color = 0xf57f54
 )
 
+// maxLogFileSize is the most text attached as a log file, to stay within the
+// upload limit.
+const maxLogFileSize = 8 * 1024 * 1024
+
+// isIgnored reports whether a message sent by userID in channelID should be
+// left out of logging and caching. roles may be nil, in which case the cached
+// member is used.
+func (b *Bot) isIgnored(gc *Guild, channelID, userID string, roles []string) bool {
+	if roles == nil {
+		if mem, err := b.store.GetMember(gc.ID, userID); err == nil {
+			roles = mem.Roles
+		}
+	}
+	return gc.IsIgnored(channelID, b.channelParents(channelID), userID, roles)
+}
+
+// channelParents returns the IDs of the channels above channelID; the parent
+// channel of a thread, and the category.
+func (b *Bot) channelParents(channelID string) []string {
+	var parents []string
+	for id := channelID; ; {
+		ch, err := b.Bot.Discord.Channel(id)
+		if err != nil || ch.ParentID == "" {
+			return parents
+		}
+		parents = append(parents, ch.ParentID)
+		id = ch.ParentID
+	}
+}
+
 func disconnectHandler(b *Bot) func(*discordgo.Session, *discordgo.Disconnect) {
 	return func(s *discordgo.Session, d *discordgo.Disconnect) {
 		b.logger.Info("disconnected")
@@ -52,23 +83,43 @@ func guildBanAddHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildBanAdd)
 			WithColor(int(ColorRed))
 
 		if _, err = b.store.GetMember(d.GuildID, d.User.ID); err != nil {
-			if err != badger.ErrKeyNotFound {
+			if err != ErrNotCached {
 				b.logger.Error("failed to get member", zap.Error(err))
 			}
 			embed.WithDescription("User was not in the server")
 		}
 
-		// fetch their messages and attachments
-		messages, err := b.store.GetMessageLog(d.GuildID, d.User.ID)
+		// collect their messages first, so that the query is not kept open
+		// while channels are looked up. Once their content alone is over the
+		// upload limit, the rest would be truncated anyway.
+		var msgs []*DiscordMessage
+		size := 0
+		_, err = b.store.QueryMessageLog(MessageQuery{GuildID: d.GuildID, UserID: d.User.ID}, func(msg *DiscordMessage) error {
+			msgs = append(msgs, msg)
+			size += len(msg.Message.Content)
+			if size > maxLogFileSize {
+				return ErrStopQuery
+			}
+			return nil
+		})
 		if err != nil {
 			b.logger.Error("failed to get message log", zap.Error(err))
 		}
 
+		// format the log, looking up each channel once
+		channels := make(map[string]*discordgo.Channel)
 		builder := strings.Builder{}
-		for _, msg := range messages {
-			ch, err := b.Bot.Discord.Channel(msg.Message.ChannelID)
-			if err != nil {
-				b.logger.Error("failed to fetch channel", zap.Error(err))
+		total, truncated := 0, false
+		for _, msg := range msgs {
+			ch, ok := channels[msg.Message.ChannelID]
+			if !ok {
+				ch, err = b.Bot.Discord.Channel(msg.Message.ChannelID)
+				if err != nil {
+					b.logger.Error("failed to fetch channel", zap.Error(err))
+				}
+				channels[msg.Message.ChannelID] = ch
+			}
+			if ch == nil {
 				continue
 			}
 
@@ -77,18 +128,30 @@ func guildBanAddHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildBanAdd)
 			if len(msg.Attachments) > 0 {
 				text += "Info: Message had attachment\n"
 			}
+			if builder.Len()+len(text) > maxLogFileSize {
+				truncated = true
+				break
+			}
 			builder.WriteString(text)
+			total++
+		}
+		if truncated {
+			builder.WriteString("\nInfo: Message log was truncated\n")
 		}
 
-		if len(messages) > 0 {
-			embed.WithDescription(embed.Description + "\n24 hour message log is attached")
-			embed.AddField("Total messages", fmt.Sprint(len(messages)), false)
+		retention := formatRetention(b.messageRetention(gc))
+		if total > 0 {
+			embed.WithDescription(embed.Description + fmt.Sprintf("\n%v message log is attached", retention))
+			embed.AddField("Total messages", fmt.Sprint(total), false)
+			if truncated {
+				embed.AddField("Info", "Message log was truncated to fit the upload limit", false)
+			}
 		}
 
 		reply := builders.NewMessageSendBuilder().
-			AddTextFile(fmt.Sprintf("24h_ban_log_%v_%v.txt", d.User.ID, time.Now().Unix()), builder.String()).
+			AddTextFile(fmt.Sprintf("%v_ban_log_%v_%v.txt", retention, d.User.ID, time.Now().Unix()), builder.String()).
 			Embed(embed.Build())
-		_, _ = s.ChannelMessageSendComplex(gc.BanLog, reply.Build())
+		b.sendLog(s, gc, LogTypeBan, reply.Build())
 	}
 }
 
@@ -111,17 +174,36 @@ func guildBanRemoveHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildBanR
 			AddField("User", fmt.Sprintf("%v\n%v", d.User.Mention(), d.User.String()), false).
 			WithFooter(fmt.Sprintf("User ID: %v", d.User.ID), "").
 			WithColor(int(ColorGreen))
-		_, _ = s.ChannelMessageSendEmbed(gc.UnbanLog, embed.Build())
+		b.sendLog(s, gc, LogTypeUnban, &discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{embed.Build()}})
 	}
 }
 
 func guildCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildCreate) {
 	return func(s *discordgo.Session, d *discordgo.GuildCreate) {
-		if _, err := b.db.GetGuild(d.ID); err != nil {
+		if err := b.store.CancelPurge(d.ID); err != nil {
+			b.logger.Error("failed to cancel purge", zap.Error(err))
+		}
+
+		if _, err := b.db.GetGuild(d.ID); errors.Is(err, ErrGuildNotFound) {
 			err = b.db.CreateGuild(d.ID)
-			if err != nil {
+			if err != nil && !errors.Is(err, ErrGuildExists) {
 				b.logger.Error("failed to create new guild", zap.Error(err))
 			}
+		} else if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+		}
+
+		for _, r := range d.Roles {
+			if err := b.store.SetRole(d.ID, r); err != nil {
+				b.logger.Error("failed to set role", zap.Error(err))
+			}
+		}
+		for _, ch := range append(slices.Clone(d.Channels), d.Threads...) {
+			c := *ch
+			c.GuildID = d.ID
+			if err := b.store.SetChannel(&c); err != nil {
+				b.logger.Error("failed to set channel", zap.Error(err))
+			}
 		}
 
 		if len(d.Members) != d.MemberCount {
@@ -139,6 +221,26 @@ func guildCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildCreate)
 	}
 }
 
+func guildDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildDelete) {
+	return func(s *discordgo.Session, d *discordgo.GuildDelete) {
+		// the guild is only temporarily unavailable because of an outage
+		if d.Unavailable {
+			b.logger.Info("guild unavailable", zap.String("guildID", d.ID))
+			return
+		}
+
+		at := time.Now().Add(b.purgeGracePeriod())
+		if err := b.store.SchedulePurge(d.ID, at); err != nil {
+			b.logger.Error("failed to schedule purge", zap.Error(err))
+			return
+		}
+		b.logger.Info("removed from guild, scheduled data purge",
+			zap.String("guildID", d.ID),
+			zap.Time("at", at),
+		)
+	}
+}
+
 func guildMemberAddHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildMemberAdd) {
 	return func(s *discordgo.Session, d *discordgo.GuildMemberAdd) {
 		err := b.store.SetMember(d.Member)
@@ -165,7 +267,7 @@ func guildMemberAddHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildMemb
 			AddField("Creation date", fmt.Sprintf("<t:%v:R>", ts.Unix()), false).
 			WithFooter(fmt.Sprintf("User ID: %v", d.User.ID), "").
 			WithColor(int(ColorBlue))
-		_, _ = s.ChannelMessageSendEmbed(gc.JoinLog, embed.Build())
+		b.sendLog(s, gc, LogTypeJoin, &discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{embed.Build()}})
 	}
 }
 
@@ -217,7 +319,7 @@ func guildMemberRemoveHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildM
 			embed.AddField("Roles", embedStr, false)
 		}
 
-		_, _ = s.ChannelMessageSendEmbed(gc.LeaveLog, embed.Build())
+		b.sendLog(s, gc, LogTypeLeave, &discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{embed.Build()}})
 		err = b.store.DeleteMember(d.GuildID, d.User.ID)
 		if err != nil {
 			b.logger.Error("failed to delete member", zap.Error(err))
@@ -247,14 +349,384 @@ func guildMemberUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildM
 	}
 }
 
+// addTextField adds a field to a log embed, or attaches the text as a file if
+// it is too long for a field.
+func addTextField(embed *builders.EmbedBuilder, reply *builders.MessageSendBuilder, name, text, filename string) {
+	if len(text) > 1024 {
+		embed.AddField(name, "Too long, so it's put in the attached .txt file", false)
+		reply.AddTextFile(filename, text)
+		return
+	}
+	embed.AddField(name, text, false)
+}
+
+func formatBool(v bool) string {
+	if v {
+		return "Yes"
+	}
+	return "No"
+}
+
+func formatRoleColor(color int) string {
+	if color == 0 {
+		return "Default"
+	}
+	return fmt.Sprintf("#%06x", color)
+}
+
+// addRoleFields adds the settings of a role to a log embed.
+func addRoleFields(embed *builders.EmbedBuilder, reply *builders.MessageSendBuilder, r *discordgo.Role) {
+	embed.AddField("Name", r.Name, true).
+		AddField("Color", formatRoleColor(r.Color), true).
+		AddField("Hoisted", formatBool(r.Hoist), true).
+		AddField("Mentionable", formatBool(r.Mentionable), true)
+	addTextField(embed, reply, "Permissions", formatPermissions(r.Permissions), "permissions.txt")
+}
+
+// addRoleDiff adds the changes between two versions of a role to a log embed,
+// and reports whether there were any. Changes to the position of a role are
+// left out, as moving one role moves many others.
+func addRoleDiff(embed *builders.EmbedBuilder, reply *builders.MessageSendBuilder, old, new *discordgo.Role) bool {
+	changed := false
+	change := func(name, old, new string) {
+		if old != new {
+			embed.AddField(name, fmt.Sprintf("%v → %v", old, new), false)
+			changed = true
+		}
+	}
+	change("Name", old.Name, new.Name)
+	change("Color", formatRoleColor(old.Color), formatRoleColor(new.Color))
+	change("Hoisted", formatBool(old.Hoist), formatBool(new.Hoist))
+	change("Mentionable", formatBool(old.Mentionable), formatBool(new.Mentionable))
+	if diff := formatPermissionDiff(old.Permissions, new.Permissions); diff != "" {
+		addTextField(embed, reply, "Permissions", "```diff\n"+diff+"```", "permissions.txt")
+		changed = true
+	}
+	return changed
+}
+
+func guildRoleCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildRoleCreate) {
+	return func(s *discordgo.Session, d *discordgo.GuildRoleCreate) {
+		if err := b.store.SetRole(d.GuildID, d.Role); err != nil {
+			b.logger.Error("failed to set role", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+
+		reply := builders.NewMessageSendBuilder()
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Role Created").
+			AddField("Role", fmt.Sprintf("<@&%v>", d.Role.ID), false).
+			WithFooter(fmt.Sprintf("Role ID: %v", d.Role.ID), "").
+			WithColor(int(ColorGreen))
+		addRoleFields(embed, reply, d.Role)
+		b.sendLog(s, gc, LogTypeRole, reply.Embed(embed.Build()).Build())
+	}
+}
+
+func guildRoleUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildRoleUpdate) {
+	return func(s *discordgo.Session, d *discordgo.GuildRoleUpdate) {
+		old, err := b.store.GetRole(d.GuildID, d.Role.ID)
+		if err != nil && err != ErrNotCached {
+			b.logger.Error("failed to get role", zap.Error(err))
+			return
+		}
+		if err := b.store.SetRole(d.GuildID, d.Role); err != nil {
+			b.logger.Error("failed to set role", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+
+		reply := builders.NewMessageSendBuilder()
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Role Updated").
+			AddField("Role", fmt.Sprintf("<@&%v>", d.Role.ID), false).
+			WithFooter(fmt.Sprintf("Role ID: %v", d.Role.ID), "").
+			WithColor(int(ColorBlue))
+		if old == nil {
+			embed.WithDescription("The previous settings of the role were not cached")
+			addRoleFields(embed, reply, d.Role)
+		} else if !addRoleDiff(embed, reply, old, d.Role) {
+			return
+		}
+		b.sendLog(s, gc, LogTypeRole, reply.Embed(embed.Build()).Build())
+	}
+}
+
+func guildRoleDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildRoleDelete) {
+	return func(s *discordgo.Session, d *discordgo.GuildRoleDelete) {
+		old, err := b.store.GetRole(d.GuildID, d.RoleID)
+		if err != nil && err != ErrNotCached {
+			b.logger.Error("failed to get role", zap.Error(err))
+			return
+		}
+		if err := b.store.DeleteRole(d.GuildID, d.RoleID); err != nil {
+			b.logger.Error("failed to delete role", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+
+		reply := builders.NewMessageSendBuilder()
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Role Deleted").
+			WithFooter(fmt.Sprintf("Role ID: %v", d.RoleID), "").
+			WithColor(int(ColorRed))
+		if old == nil {
+			embed.WithDescription("The settings of the role were not cached")
+		} else {
+			addRoleFields(embed, reply, old)
+		}
+		b.sendLog(s, gc, LogTypeRole, reply.Embed(embed.Build()).Build())
+	}
+}
+
+var channelTypeNames = map[discordgo.ChannelType]string{
+	discordgo.ChannelTypeGuildText:       "Text",
+	discordgo.ChannelTypeGuildVoice:      "Voice",
+	discordgo.ChannelTypeGuildCategory:   "Category",
+	discordgo.ChannelTypeGuildNews:       "Announcement",
+	discordgo.ChannelTypeGuildStageVoice: "Stage",
+	discordgo.ChannelTypeGuildDirectory:  "Directory",
+	discordgo.ChannelTypeGuildForum:      "Forum",
+	discordgo.ChannelTypeGuildMedia:      "Media",
+}
+
+func formatChannelType(t discordgo.ChannelType) string {
+	if name, ok := channelTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Type %v", int(t))
+}
+
+func formatSlowmode(seconds int) string {
+	if seconds == 0 {
+		return "Off"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func formatCategory(parentID string) string {
+	if parentID == "" {
+		return "None"
+	}
+	return fmt.Sprintf("<#%v>", parentID)
+}
+
+func formatTopic(topic string) string {
+	if topic == "" {
+		return "None"
+	}
+	return topic
+}
+
+// addChannelFields adds the settings of a channel to a log embed.
+func addChannelFields(embed *builders.EmbedBuilder, reply *builders.MessageSendBuilder, ch *discordgo.Channel) {
+	embed.AddField("Name", ch.Name, true).
+		AddField("Type", formatChannelType(ch.Type), true).
+		AddField("Category", formatCategory(ch.ParentID), true)
+	if ch.Type != discordgo.ChannelTypeGuildCategory {
+		embed.AddField("Slowmode", formatSlowmode(ch.RateLimitPerUser), true).
+			AddField("NSFW", formatBool(ch.NSFW), true)
+	}
+	if ch.Topic != "" {
+		addTextField(embed, reply, "Topic", ch.Topic, "topic.txt")
+	}
+	addTextField(embed, reply, "Permission overwrites", formatOverwrites(ch.GuildID, ch.PermissionOverwrites), "overwrites.txt")
+}
+
+// addChannelDiff adds the changes between two versions of a channel to a log
+// embed, and reports whether there were any. Changes to the position of a
+// channel are left out, as moving one channel moves many others.
+func addChannelDiff(embed *builders.EmbedBuilder, reply *builders.MessageSendBuilder, old, new *discordgo.Channel) bool {
+	changed := false
+	change := func(name, old, new string) {
+		if old != new {
+			addTextField(embed, reply, name, fmt.Sprintf("%v → %v", old, new), strings.ToLower(name)+".txt")
+			changed = true
+		}
+	}
+	change("Name", old.Name, new.Name)
+	change("Topic", formatTopic(old.Topic), formatTopic(new.Topic))
+	change("Slowmode", formatSlowmode(old.RateLimitPerUser), formatSlowmode(new.RateLimitPerUser))
+	change("NSFW", formatBool(old.NSFW), formatBool(new.NSFW))
+	change("Category", formatCategory(old.ParentID), formatCategory(new.ParentID))
+	if diff := formatOverwriteDiff(new.GuildID, old.PermissionOverwrites, new.PermissionOverwrites); diff != "" {
+		addTextField(embed, reply, "Permission overwrites", diff, "overwrites.txt")
+		changed = true
+	}
+	return changed
+}
+
+func channelCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.ChannelCreate) {
+	return func(s *discordgo.Session, d *discordgo.ChannelCreate) {
+		if d.GuildID == "" {
+			return
+		}
+		if err := b.store.SetChannel(d.Channel); err != nil {
+			b.logger.Error("failed to set channel", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+
+		reply := builders.NewMessageSendBuilder()
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Channel Created").
+			AddField("Channel", fmt.Sprintf("<#%v>", d.ID), false).
+			WithFooter(fmt.Sprintf("Channel ID: %v", d.ID), "").
+			WithColor(int(ColorGreen))
+		addChannelFields(embed, reply, d.Channel)
+		b.sendLog(s, gc, LogTypeChannel, reply.Embed(embed.Build()).Build())
+	}
+}
+
+func channelUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.ChannelUpdate) {
+	return func(s *discordgo.Session, d *discordgo.ChannelUpdate) {
+		if d.GuildID == "" {
+			return
+		}
+		old, err := b.store.GetChannel(d.GuildID, d.ID)
+		if err != nil && err != ErrNotCached {
+			b.logger.Error("failed to get channel", zap.Error(err))
+			return
+		}
+		if err := b.store.SetChannel(d.Channel); err != nil {
+			b.logger.Error("failed to set channel", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+
+		reply := builders.NewMessageSendBuilder()
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Channel Updated").
+			AddField("Channel", fmt.Sprintf("<#%v>", d.ID), false).
+			WithFooter(fmt.Sprintf("Channel ID: %v", d.ID), "").
+			WithColor(int(ColorBlue))
+		if old == nil {
+			embed.WithDescription("The previous settings of the channel were not cached")
+			addChannelFields(embed, reply, d.Channel)
+		} else if !addChannelDiff(embed, reply, old, d.Channel) {
+			return
+		}
+		b.sendLog(s, gc, LogTypeChannel, reply.Embed(embed.Build()).Build())
+	}
+}
+
+func channelDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.ChannelDelete) {
+	return func(s *discordgo.Session, d *discordgo.ChannelDelete) {
+		if d.GuildID == "" {
+			return
+		}
+		// the event holds the channel as it was deleted, so the cached
+		// snapshot only fills in what the event left out
+		ch := *d.Channel
+		if old, err := b.store.GetChannel(d.GuildID, d.ID); err == nil {
+			if ch.Name == "" {
+				ch.Name = old.Name
+			}
+			if ch.PermissionOverwrites == nil {
+				ch.PermissionOverwrites = old.PermissionOverwrites
+			}
+		} else if err != ErrNotCached {
+			b.logger.Error("failed to get channel", zap.Error(err))
+		}
+		if err := b.store.DeleteChannel(d.GuildID, d.ID); err != nil {
+			b.logger.Error("failed to delete channel", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+
+		reply := builders.NewMessageSendBuilder()
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Channel Deleted").
+			WithFooter(fmt.Sprintf("Channel ID: %v", d.ID), "").
+			WithColor(int(ColorRed))
+		addChannelFields(embed, reply, &ch)
+		b.sendLog(s, gc, LogTypeChannel, reply.Embed(embed.Build()).Build())
+	}
+}
+
+// Threads are cached like channels, but not logged. Archived threads leave the
+// session state, so the cache is what keeps their messages searchable.
+
+func threadCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.ThreadCreate) {
+	return func(s *discordgo.Session, d *discordgo.ThreadCreate) {
+		if err := b.store.SetChannel(d.Channel); err != nil {
+			b.logger.Error("failed to set thread", zap.Error(err))
+		}
+	}
+}
+
+func threadUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.ThreadUpdate) {
+	return func(s *discordgo.Session, d *discordgo.ThreadUpdate) {
+		if err := b.store.SetChannel(d.Channel); err != nil {
+			b.logger.Error("failed to set thread", zap.Error(err))
+		}
+	}
+}
+
+func threadDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.ThreadDelete) {
+	return func(s *discordgo.Session, d *discordgo.ThreadDelete) {
+		if err := b.store.DeleteChannel(d.GuildID, d.ID); err != nil {
+			b.logger.Error("failed to delete thread", zap.Error(err))
+		}
+	}
+}
+
+func threadListSyncHandler(b *Bot) func(*discordgo.Session, *discordgo.ThreadListSync) {
+	return func(s *discordgo.Session, d *discordgo.ThreadListSync) {
+		for _, th := range d.Threads {
+			t := *th
+			t.GuildID = d.GuildID
+			if err := b.store.SetChannel(&t); err != nil {
+				b.logger.Error("failed to set thread", zap.Error(err))
+			}
+		}
+	}
+}
+
 func messageCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageCreate) {
 	return func(s *discordgo.Session, d *discordgo.MessageCreate) {
 		if d.Author.Bot {
 			return
 		}
 
+		gc, err := b.db.GetGuild(d.GuildID)
+		if err == nil {
+			var roles []string
+			if d.Member != nil {
+				roles = d.Member.Roles
+			}
+			if b.isIgnored(gc, d.ChannelID, d.Author.ID, roles) {
+				return
+			}
+		}
+
 		// max size 10mb
-		_ = b.store.SetMessage(NewDiscordMessage(d.Message, 1024*1024*10))
+		_ = b.store.SetMessage(NewDiscordMessage(d.Message, 1024*1024*10), b.messageRetention(gc), b.attachmentQuota())
 	}
 }
 
@@ -276,6 +748,10 @@ func messageDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageDel
 			return
 		}
 
+		if b.isIgnored(gc, d.ChannelID, msg.Message.Author.ID, nil) {
+			return
+		}
+
 		embed := builders.NewEmbedBuilder().
 			WithTitle("Message Deleted").
 			AddField("User", fmt.Sprintf("%v\n%v\n%v", msg.Message.Author.Mention(), msg.Message.Author.String(), msg.Message.Author.ID), true).
@@ -294,22 +770,52 @@ func messageDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageDel
 			embed.WithDescription(descStr)
 		}
 
-		if len(msg.Attachments) > 0 {
-			embed.AddField("Total fetched attachments", fmt.Sprint(len(msg.Attachments)), false)
-			embed.WithDescription(embed.Description + "\n**Disclaimer:** Only attachments smaller than 10mb may be fetched")
+		if history := msg.History(); len(history) > 1 {
+			text := formatRevisions(history)
+			if len(text) > 1024 {
+				embed.AddField("Revision history", fmt.Sprintf("%v revisions, put in the attached .txt file", len(history)), false)
+				reply.AddTextFile("revisions.txt", text)
+			} else {
+				embed.AddField("Revision history", text, false)
+			}
+		}
+
+		if err := b.store.LoadAttachments(msg); err != nil {
+			b.logger.Error("failed to load attachments", zap.Error(err))
 		}
 
 		var files []*discordgo.File
 		for _, a := range msg.Attachments {
+			// evicted or never stored because of the guild's quota
+			if a.Data == nil {
+				continue
+			}
 			files = append(files, &discordgo.File{
 				Name:        a.Filename,
 				ContentType: "application/octet-stream",
 				Reader:      bytes.NewReader(a.Data),
 			})
 		}
+		if len(msg.Attachments) > 0 {
+			embed.AddField("Total fetched attachments", fmt.Sprintf("%v of %v", len(files), len(msg.Attachments)), false)
+			embed.WithDescription(embed.Description + "\n**Disclaimer:** Only attachments smaller than 10mb may be fetched, and the oldest are removed when the server's storage quota is full")
+		}
+
 		reply.WithFiles(files).Embed(embed.Build())
-		_, _ = s.ChannelMessageSendComplex(gc.MsgDeleteLog, reply.Build())
+		b.sendLog(s, gc, LogTypeMsgDelete, reply.Build())
+	}
+}
+
+// formatRevisions formats every version of a message's content, oldest first.
+func formatRevisions(history []*MessageRevision) string {
+	builder := strings.Builder{}
+	for i, r := range history {
+		if i > 0 {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(fmt.Sprintf("Revision %v (%v):\n%v\n", i+1, r.Timestamp.UTC().Format(time.DateTime), r.Content))
 	}
+	return builder.String()
 }
 
 func messageDeleteBulkHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageDeleteBulk) {
@@ -325,6 +831,11 @@ func messageDeleteBulkHandler(b *Bot) func(*discordgo.Session, *discordgo.Messag
 			return
 		}
 
+		// skip the whole purge if the channel itself is ignored
+		if gc.IsIgnored(d.ChannelID, b.channelParents(d.ChannelID), "", nil) {
+			return
+		}
+
 		embed := builders.NewEmbedBuilder().
 			WithTitle(fmt.Sprintf("Bulk Message Delete - (%v) messages", len(d.Messages))).
 			AddField("Channel", fmt.Sprintf("<#%v>", d.ChannelID), true).
@@ -336,6 +847,9 @@ func messageDeleteBulkHandler(b *Bot) func(*discordgo.Session, *discordgo.Messag
 			if err != nil {
 				continue
 			}
+			if b.isIgnored(gc, d.ChannelID, msg.Message.Author.ID, nil) {
+				continue
+			}
 			messages = append(messages, msg)
 		}
 
@@ -356,7 +870,7 @@ func messageDeleteBulkHandler(b *Bot) func(*discordgo.Session, *discordgo.Messag
 			AddTextFile(fmt.Sprintf("deleted_%v_%v.txt", d.ChannelID, time.Now().Unix()), builder.String()).
 			Embed(embed.Build())
 
-		_, _ = s.ChannelMessageSendComplex(gc.MsgDeleteLog, reply.Build())
+		b.sendLog(s, gc, LogTypeMsgDelete, reply.Build())
 	}
 }
 
@@ -379,6 +893,14 @@ func messageUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageUpd
 			return
 		}
 
+		var roles []string
+		if d.Member != nil {
+			roles = d.Member.Roles
+		}
+		if b.isIgnored(gc, d.ChannelID, d.Author.ID, roles) {
+			return
+		}
+
 		oldMsg, err := b.store.GetMessage(d.GuildID, d.ChannelID, d.ID)
 		if err != nil || (oldMsg.Message.Author != nil && oldMsg.Message.Author.Bot) {
 			return
@@ -388,21 +910,39 @@ func messageUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageUpd
 			return
 		}
 
+		editedAt := time.Now()
+		if d.EditedTimestamp != nil {
+			editedAt = *d.EditedTimestamp
+		}
+		msg, err := b.store.AddMessageRevision(d.GuildID, d.ChannelID, d.ID, d.Content, editedAt)
+		if err != nil {
+			b.logger.Error("failed to update message", zap.Error(err))
+			return
+		}
+		// the previous revision is the old content, unless the store returned
+		// the message without one
+		history := msg.History()
+		oldContent := oldMsg.Message.Content
+		if len(history) > 1 {
+			oldContent = history[len(history)-2].Content
+		}
+
 		embed := builders.NewEmbedBuilder().
 			WithTitle("Message Edited").
 			AddField("User", fmt.Sprintf("%v\n%v\n%v", d.Author.Mention(), d.Author.String(), d.Author.ID), true).
 			AddField("Channel", fmt.Sprintf("<#%v> (%v)", d.ChannelID, d.ChannelID), false).
+			AddField("Revision", fmt.Sprint(len(history)), true).
 			WithFooter(fmt.Sprintf("Message ID: %v", d.ID), "").
 			WithColor(int(ColorBlue))
 
 		reply := builders.NewMessageSendBuilder()
 
 		// check old content
-		if len(oldMsg.Message.Content) > 1024 {
+		if len(oldContent) > 1024 {
 			embed.AddField("Old content", "Content too long, so it's put in the attached .txt file", false)
-			reply.AddTextFile("old_content.txt", oldMsg.Message.Content)
+			reply.AddTextFile("old_content.txt", oldContent)
 		} else {
-			embed.AddField("Old content", oldMsg.Message.Content, false)
+			embed.AddField("Old content", oldContent, false)
 		}
 
 		// check new content
@@ -414,14 +954,6 @@ func messageUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageUpd
 		}
 
 		reply.Embed(embed.Build())
-		_, _ = s.ChannelMessageSendComplex(gc.MsgEditLog, reply.Build())
-
-		// I think this should be put in its own function and not at the end of this one lol
-		oldMsg.Message.Content = d.Content
-		err = b.store.SetMessage(oldMsg)
-		if err != nil {
-			b.logger.Error("failed to update message", zap.Error(err))
-			return
-		}
+		b.sendLog(s, gc, LogTypeMsgEdit, reply.Build())
 	}
 }
@@ -0,0 +1,641 @@
+package stare
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/intrntsrfr/meido/pkg/mio/bot"
+	"github.com/intrntsrfr/meido/pkg/utils"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// testGuildID is the guild the bots made by newTestBot are in.
+const testGuildID = "1"
+
+// newTestBot returns a bot that keeps its settings and cache in memory, and
+// is in the guild testGuildID with the default settings.
+func newTestBot(t *testing.T) *Bot {
+	t.Helper()
+	cfg := utils.NewConfig()
+	cfg.Set("token", "test")
+	cfg.Set("shards", 1)
+	logger := &ZapLogger{zaptest.NewLogger(t)}
+
+	b := &Bot{
+		Bot:      bot.NewBotBuilder(cfg).WithLogger(logger).Build(),
+		logger:   logger,
+		config:   cfg,
+		db:       NewMemoryDB(),
+		store:    NewMemoryStore(),
+		webhooks: newWebhookCache(),
+	}
+	if err := b.Bot.Discord.Sess.State().GuildAdd(&discordgo.Guild{ID: testGuildID}); err != nil {
+		t.Fatalf("GuildAdd() error = %v", err)
+	}
+	if err := b.db.CreateGuild(testGuildID); err != nil {
+		t.Fatalf("CreateGuild() error = %v", err)
+	}
+	return b
+}
+
+// setLogChannel sends the log type of testGuildID to channelID.
+func setLogChannel(t *testing.T, b *Bot, lt LogType, channelID string) {
+	t.Helper()
+	if _, err := b.db.ModifyGuild(testGuildID, "", func(gc *Guild) error {
+		gc.LogChannels(lt).Add(channelID)
+		return nil
+	}); err != nil {
+		t.Fatalf("ModifyGuild() error = %v", err)
+	}
+}
+
+// sentMessages records the requests made to the Discord API by a session
+// from newTestSession, instead of sending them.
+type sentMessages struct {
+	mu sync.Mutex
+	// bodies holds the bodies of the messages sent, by channel
+	bodies map[string][]string
+}
+
+func (r *sentMessages) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	// /api/v9/channels/<id>/messages
+	parts := strings.Split(req.URL.Path, "/")
+	if req.Method == http.MethodPost && len(parts) == 6 && parts[3] == "channels" && parts[5] == "messages" {
+		r.mu.Lock()
+		r.bodies[parts[4]] = append(r.bodies[parts[4]], string(body))
+		r.mu.Unlock()
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"id": "1"}`)),
+		Request:    req,
+	}, nil
+}
+
+// sent returns the bodies of the messages sent to a channel.
+func (r *sentMessages) sent(channelID string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.bodies[channelID]...)
+}
+
+// newTestSession returns a session whose requests are recorded instead of
+// sent to Discord.
+func newTestSession(t *testing.T) (*discordgo.Session, *sentMessages) {
+	t.Helper()
+	s, err := discordgo.New("Bot test")
+	if err != nil {
+		t.Fatalf("discordgo.New() error = %v", err)
+	}
+	rec := &sentMessages{bodies: make(map[string][]string)}
+	s.Client = &http.Client{Transport: rec}
+	return s, rec
+}
+
+// testMessage returns a message sent to testGuildID at the i-th second of
+// 2024.
+func testMessage(i int, channelID, content string) *discordgo.Message {
+	ts := time.Date(2024, 1, 1, 0, 0, i, 0, time.UTC)
+	id := snowflakeAt(ts) + uint64(i)
+	return &discordgo.Message{
+		ID:        strconv.FormatUint(id, 10),
+		GuildID:   testGuildID,
+		ChannelID: channelID,
+		Content:   content,
+		Author:    &discordgo.User{ID: "100", Username: "user"},
+		Timestamp: ts,
+	}
+}
+
+func TestMessageHandlersConcurrent(t *testing.T) {
+	b := newTestBot(t)
+	s, _ := newTestSession(t)
+	setLogChannel(t, b, LogTypeMsgEdit, "20")
+	setLogChannel(t, b, LogTypeMsgDelete, "21")
+
+	create := messageCreateHandler(b)
+	update := messageUpdateHandler(b)
+	del := messageDeleteHandler(b)
+
+	// messages are cached, edited and deleted while the settings change
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		msg := testMessage(i, "10", fmt.Sprintf("message %v", i))
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			create(s, &discordgo.MessageCreate{Message: msg})
+		}()
+		go func() {
+			defer wg.Done()
+			edited := *msg
+			edited.Content = "edited"
+			update(s, &discordgo.MessageUpdate{Message: &edited})
+		}()
+		go func() {
+			defer wg.Done()
+			del(s, &discordgo.MessageDelete{Message: &discordgo.Message{ID: msg.ID, GuildID: testGuildID, ChannelID: "10"}})
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if _, err := b.db.ModifyGuild(testGuildID, "", func(gc *Guild) error {
+				gc.IgnoredUsers.Add(fmt.Sprint(1000 + i))
+				return nil
+			}); err != nil {
+				t.Errorf("ModifyGuild() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		msg := testMessage(i, "10", "")
+		got, err := b.store.GetMessage(testGuildID, "10", msg.ID)
+		if err != nil {
+			t.Errorf("GetMessage(%v) error = %v", msg.ID, err)
+			continue
+		}
+		if c := got.Message.Content; c != fmt.Sprintf("message %v", i) && c != "edited" {
+			t.Errorf("GetMessage(%v).Content = %q, want the original or edited content", msg.ID, c)
+		}
+	}
+}
+
+func TestGuildCreateHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+	}{
+		{"NewGuild", false},
+		{"KnownGuild", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			s, _ := newTestSession(t)
+			const gid = "2"
+			if tt.existing {
+				if err := b.db.CreateGuild(gid); err != nil {
+					t.Fatalf("CreateGuild() error = %v", err)
+				}
+				if _, err := b.db.ModifyGuild(gid, "", func(gc *Guild) error {
+					gc.BanLog.Add("20")
+					return nil
+				}); err != nil {
+					t.Fatalf("ModifyGuild() error = %v", err)
+				}
+			}
+
+			mem := &discordgo.Member{GuildID: gid, User: &discordgo.User{ID: "100"}, Roles: []string{"30"}}
+			guildCreateHandler(b)(s, &discordgo.GuildCreate{Guild: &discordgo.Guild{
+				ID:          gid,
+				Roles:       []*discordgo.Role{{ID: "30", Name: "mods"}},
+				Channels:    []*discordgo.Channel{{ID: "10", Name: "general"}},
+				Threads:     []*discordgo.Channel{{ID: "20", ParentID: "10", Type: discordgo.ChannelTypeGuildPublicThread}},
+				Members:     []*discordgo.Member{mem},
+				MemberCount: 1,
+			}})
+
+			gc, err := b.db.GetGuild(gid)
+			if err != nil {
+				t.Fatalf("GetGuild() error = %v", err)
+			}
+			if got := gc.BanLog.Contains("20"); got != tt.existing {
+				t.Errorf("GetGuild().BanLog = %v, the settings of a known guild must be kept", gc.BanLog)
+			}
+			if r, err := b.store.GetRole(gid, "30"); err != nil || r.Name != "mods" {
+				t.Errorf("GetRole() = %v, %v, want the role cached", r, err)
+			}
+			if ch, err := b.store.GetChannel(gid, "10"); err != nil || ch.Name != "general" || ch.GuildID != gid {
+				t.Errorf("GetChannel() = %v, %v, want the channel cached", ch, err)
+			}
+			if th, err := b.store.GetChannel(gid, "20"); err != nil || th.ParentID != "10" {
+				t.Errorf("GetChannel() = %v, %v, want the thread cached", th, err)
+			}
+			if m, err := b.store.GetMember(gid, "100"); err != nil || len(m.Roles) != 1 {
+				t.Errorf("GetMember() = %v, %v, want the member cached", m, err)
+			}
+		})
+	}
+}
+
+func TestMessageCreateHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(gc *Guild)
+		author *discordgo.User
+		cached bool
+	}{
+		{"Cached", func(gc *Guild) {}, &discordgo.User{ID: "100"}, true},
+		{"IgnoredChannel", func(gc *Guild) { gc.IgnoredChannels.Add("10") }, &discordgo.User{ID: "100"}, false},
+		{"IgnoredUser", func(gc *Guild) { gc.IgnoredUsers.Add("100") }, &discordgo.User{ID: "100"}, false},
+		{"Bot", func(gc *Guild) {}, &discordgo.User{ID: "100", Bot: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			s, _ := newTestSession(t)
+			if _, err := b.db.ModifyGuild(testGuildID, "", func(gc *Guild) error {
+				tt.modify(gc)
+				return nil
+			}); err != nil {
+				t.Fatalf("ModifyGuild() error = %v", err)
+			}
+
+			msg := testMessage(0, "10", "hello")
+			msg.Author = tt.author
+			messageCreateHandler(b)(s, &discordgo.MessageCreate{Message: msg})
+
+			_, err := b.store.GetMessage(testGuildID, "10", msg.ID)
+			if got := err == nil; got != tt.cached {
+				t.Errorf("GetMessage() error = %v, want cached = %v", err, tt.cached)
+			}
+		})
+	}
+}
+
+func TestMessageDeleteHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(gc *Guild)
+		cache  bool
+		want   []string
+	}{
+		{"Logged", func(gc *Guild) { gc.MsgDeleteLog.Add("20") }, true, []string{"Message Deleted", "hello"}},
+		{"NotCached", func(gc *Guild) { gc.MsgDeleteLog.Add("20") }, false, nil},
+		{"NoLogChannel", func(gc *Guild) {}, true, nil},
+		{"IgnoredAfterCaching", func(gc *Guild) {
+			gc.MsgDeleteLog.Add("20")
+			gc.IgnoredUsers.Add("100")
+		}, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			s, rec := newTestSession(t)
+
+			msg := testMessage(0, "10", "hello")
+			if tt.cache {
+				messageCreateHandler(b)(s, &discordgo.MessageCreate{Message: msg})
+			}
+			if _, err := b.db.ModifyGuild(testGuildID, "", func(gc *Guild) error {
+				tt.modify(gc)
+				return nil
+			}); err != nil {
+				t.Fatalf("ModifyGuild() error = %v", err)
+			}
+			messageDeleteHandler(b)(s, &discordgo.MessageDelete{Message: &discordgo.Message{ID: msg.ID, GuildID: testGuildID, ChannelID: "10"}})
+
+			sent := rec.sent("20")
+			if tt.want == nil {
+				if len(sent) != 0 {
+					t.Errorf("sent %v, want no log", sent)
+				}
+				return
+			}
+			if len(sent) != 1 {
+				t.Fatalf("sent %v logs, want 1", len(sent))
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(sent[0], w) {
+					t.Errorf("sent %v, want it to contain %q", sent[0], w)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageUpdateHandler(t *testing.T) {
+	b := newTestBot(t)
+	s, rec := newTestSession(t)
+	setLogChannel(t, b, LogTypeMsgEdit, "20")
+
+	msg := testMessage(0, "10", "first")
+	messageCreateHandler(b)(s, &discordgo.MessageCreate{Message: msg})
+	for _, content := range []string{"second", "second", "third"} {
+		edited := *msg
+		edited.Content = content
+		messageUpdateHandler(b)(s, &discordgo.MessageUpdate{Message: &edited})
+	}
+
+	got, err := b.store.GetMessage(testGuildID, "10", msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	var history []string
+	for _, r := range got.History() {
+		history = append(history, r.Content)
+	}
+	if strings.Join(history, ",") != "first,second,third" {
+		t.Errorf("History() = %v, want [first second third]", history)
+	}
+
+	// an update that does not change the content is not logged
+	sent := rec.sent("20")
+	if len(sent) != 2 {
+		t.Fatalf("sent %v logs, want 2", len(sent))
+	}
+	if !strings.Contains(sent[1], "second") || !strings.Contains(sent[1], "third") {
+		t.Errorf("sent %v, want the old and new content", sent[1])
+	}
+}
+
+// unrevisedStore is a cache store that returns edited messages without their
+// earlier revisions.
+type unrevisedStore struct {
+	CacheStore
+}
+
+func (s unrevisedStore) AddMessageRevision(gid, cid, mid, content string, editedAt time.Time) (*DiscordMessage, error) {
+	msg, err := s.GetMessage(gid, cid, mid)
+	if err != nil {
+		return nil, err
+	}
+	msg.Message.Content = content
+	msg.Revisions = nil
+	return msg, nil
+}
+
+func TestMessageUpdateHandlerWithoutRevisions(t *testing.T) {
+	b := newTestBot(t)
+	b.store = unrevisedStore{b.store}
+	s, rec := newTestSession(t)
+	setLogChannel(t, b, LogTypeMsgEdit, "20")
+
+	msg := testMessage(0, "10", "first")
+	messageCreateHandler(b)(s, &discordgo.MessageCreate{Message: msg})
+	edited := *msg
+	edited.Content = "second"
+	messageUpdateHandler(b)(s, &discordgo.MessageUpdate{Message: &edited})
+
+	sent := rec.sent("20")
+	if len(sent) != 1 {
+		t.Fatalf("sent %v logs, want 1", len(sent))
+	}
+	if !strings.Contains(sent[0], "first") || !strings.Contains(sent[0], "second") {
+		t.Errorf("sent %v, want the old and new content", sent[0])
+	}
+}
+
+func TestGuildMemberRemoveHandler(t *testing.T) {
+	b := newTestBot(t)
+	s, rec := newTestSession(t)
+	setLogChannel(t, b, LogTypeLeave, "20")
+
+	user := &discordgo.User{ID: "100", Username: "user"}
+	guildMemberAddHandler(b)(s, &discordgo.GuildMemberAdd{Member: &discordgo.Member{GuildID: testGuildID, User: user, Roles: []string{"30"}}})
+	guildMemberRemoveHandler(b)(s, &discordgo.GuildMemberRemove{Member: &discordgo.Member{GuildID: testGuildID, User: user}})
+
+	sent := rec.sent("20")
+	if len(sent) != 1 || !strings.Contains(sent[0], "\\u003c@\\u002630\\u003e") {
+		t.Errorf("sent %v, want one log with the member's roles", sent)
+	}
+	if _, err := b.store.GetMember(testGuildID, "100"); err == nil {
+		t.Errorf("GetMember() error = nil, want the member removed from the cache")
+	}
+}
+
+func TestGuildBanAddHandler(t *testing.T) {
+	b := newTestBot(t)
+	s, rec := newTestSession(t)
+	setLogChannel(t, b, LogTypeBan, "20")
+	if err := b.Bot.Discord.Sess.State().ChannelAdd(&discordgo.Channel{ID: "10", GuildID: testGuildID, Name: "general"}); err != nil {
+		t.Fatalf("ChannelAdd() error = %v", err)
+	}
+
+	// messages in channels that cannot be looked up are left out
+	mustSetMessages(t, b.store, testMessage(0, "10", "first"), testMessage(1, "11", "hidden"), testMessage(2, "10", "second"))
+	guildBanAddHandler(b)(s, &discordgo.GuildBanAdd{GuildID: testGuildID, User: &discordgo.User{ID: "100", Username: "user"}})
+
+	sent := rec.sent("20")
+	if len(sent) != 1 {
+		t.Fatalf("sent %v logs, want 1", len(sent))
+	}
+	for _, w := range []string{"Channel: general (10)", "Content: first", "Content: second", `"value":"2"`} {
+		if !strings.Contains(sent[0], w) {
+			t.Errorf("sent %v, want it to contain %q", sent[0], w)
+		}
+	}
+	if strings.Contains(sent[0], "hidden") {
+		t.Errorf("sent %v, want the message of an unknown channel left out", sent[0])
+	}
+}
+
+func TestChannelDeleteHandler(t *testing.T) {
+	overwrites := []*discordgo.PermissionOverwrite{
+		{ID: testGuildID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionSendMessages},
+	}
+	tests := []struct {
+		name    string
+		cached  *discordgo.Channel
+		deleted *discordgo.Channel
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "NotCached",
+			deleted: &discordgo.Channel{ID: "10", GuildID: testGuildID, Name: "general", Topic: "talk"},
+			want:    []string{"general", "talk"},
+		},
+		{
+			name:    "EventIsNewer",
+			cached:  &discordgo.Channel{ID: "10", GuildID: testGuildID, Name: "old-name", Topic: "old topic"},
+			deleted: &discordgo.Channel{ID: "10", GuildID: testGuildID, Name: "general", PermissionOverwrites: overwrites},
+			want:    []string{"general", "@everyone: allow None; deny Send Messages"},
+			notWant: []string{"old-name", "old topic"},
+		},
+		{
+			name:    "MissingFieldsFromCache",
+			cached:  &discordgo.Channel{ID: "10", GuildID: testGuildID, Name: "general", PermissionOverwrites: overwrites},
+			deleted: &discordgo.Channel{ID: "10", GuildID: testGuildID},
+			want:    []string{"general", "@everyone: allow None; deny Send Messages"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			s, rec := newTestSession(t)
+			setLogChannel(t, b, LogTypeChannel, "20")
+			if tt.cached != nil {
+				if err := b.store.SetChannel(tt.cached); err != nil {
+					t.Fatalf("SetChannel() error = %v", err)
+				}
+			}
+
+			channelDeleteHandler(b)(s, &discordgo.ChannelDelete{Channel: tt.deleted})
+
+			sent := rec.sent("20")
+			if len(sent) != 1 {
+				t.Fatalf("sent %v logs, want 1", len(sent))
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(sent[0], w) {
+					t.Errorf("sent %v, want it to contain %q", sent[0], w)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(sent[0], w) {
+					t.Errorf("sent %v, want it not to contain %q", sent[0], w)
+				}
+			}
+			if _, err := b.store.GetChannel(testGuildID, "10"); err != ErrNotCached {
+				t.Errorf("GetChannel() error = %v, want the channel removed from the cache", err)
+			}
+		})
+	}
+}
+
+// failingStore is a cache store whose role and channel lookups fail.
+type failingStore struct {
+	CacheStore
+}
+
+var errStoreFailed = errors.New("store failed")
+
+func (failingStore) GetRole(gid, rid string) (*discordgo.Role, error) {
+	return nil, errStoreFailed
+}
+
+func (failingStore) GetChannel(gid, cid string) (*discordgo.Channel, error) {
+	return nil, errStoreFailed
+}
+
+func TestThreadHandlers(t *testing.T) {
+	b := newTestBot(t)
+	s, _ := newTestSession(t)
+	thread := func(id, name string) *discordgo.Channel {
+		return &discordgo.Channel{ID: id, GuildID: testGuildID, ParentID: "10", Name: name, Type: discordgo.ChannelTypeGuildPublicThread}
+	}
+
+	threadCreateHandler(b)(s, &discordgo.ThreadCreate{Channel: thread("20", "new")})
+	threadUpdateHandler(b)(s, &discordgo.ThreadUpdate{Channel: thread("20", "renamed")})
+	// the threads of a sync do not have their guild set
+	synced := thread("21", "synced")
+	synced.GuildID = ""
+	threadListSyncHandler(b)(s, &discordgo.ThreadListSync{GuildID: testGuildID, Threads: []*discordgo.Channel{synced}})
+
+	for id, name := range map[string]string{"20": "renamed", "21": "synced"} {
+		if th, err := b.store.GetChannel(testGuildID, id); err != nil || th.Name != name || th.ParentID != "10" {
+			t.Errorf("GetChannel(%v) = %v, %v, want the thread cached as %q", id, th, err, name)
+		}
+	}
+
+	threadDeleteHandler(b)(s, &discordgo.ThreadDelete{Channel: thread("20", "")})
+	if _, err := b.store.GetChannel(testGuildID, "20"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetChannel() of a deleted thread error = %v, want %v", err, ErrNotCached)
+	}
+}
+
+func TestHandlersLogStoreErrors(t *testing.T) {
+	role := &discordgo.Role{ID: "30", Name: "mods"}
+	channel := &discordgo.Channel{ID: "10", GuildID: testGuildID, Name: "general"}
+	tests := []struct {
+		name   string
+		handle func(b *Bot, s *discordgo.Session)
+	}{
+		{"GuildRoleUpdate", func(b *Bot, s *discordgo.Session) {
+			guildRoleUpdateHandler(b)(s, &discordgo.GuildRoleUpdate{GuildRole: &discordgo.GuildRole{GuildID: testGuildID, Role: role}})
+		}},
+		{"GuildRoleDelete", func(b *Bot, s *discordgo.Session) {
+			guildRoleDeleteHandler(b)(s, &discordgo.GuildRoleDelete{GuildID: testGuildID, RoleID: role.ID})
+		}},
+		{"ChannelUpdate", func(b *Bot, s *discordgo.Session) {
+			channelUpdateHandler(b)(s, &discordgo.ChannelUpdate{Channel: channel})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			core, logs := observer.New(zapcore.ErrorLevel)
+			b.logger = &ZapLogger{zap.New(core)}
+			b.store = failingStore{b.store}
+			s, rec := newTestSession(t)
+			setLogChannel(t, b, LogTypeRole, "20")
+			setLogChannel(t, b, LogTypeChannel, "20")
+
+			tt.handle(b, s)
+
+			if logs.Len() != 1 {
+				t.Errorf("logged %v errors, want 1", logs.Len())
+			}
+			if sent := rec.sent("20"); len(sent) != 0 {
+				t.Errorf("sent %v logs, want none", len(sent))
+			}
+		})
+	}
+}
+
+func TestIsIgnored(t *testing.T) {
+	b := newTestBot(t)
+	state := b.Bot.Discord.Sess.State()
+	// category 5 holds channel 10, which has thread 11
+	for _, ch := range []*discordgo.Channel{
+		{ID: "5", GuildID: testGuildID, Type: discordgo.ChannelTypeGuildCategory},
+		{ID: "10", GuildID: testGuildID, ParentID: "5"},
+		{ID: "11", GuildID: testGuildID, ParentID: "10", Type: discordgo.ChannelTypeGuildPublicThread},
+		{ID: "12", GuildID: testGuildID},
+	} {
+		if err := state.ChannelAdd(ch); err != nil {
+			t.Fatalf("ChannelAdd() error = %v", err)
+		}
+	}
+	if err := b.store.SetMember(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: "100"}, Roles: []string{"30"}}); err != nil {
+		t.Fatalf("SetMember() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		gc        *Guild
+		channelID string
+		userID    string
+		roles     []string
+		want      bool
+	}{
+		{"NotIgnored", &Guild{IgnoredChannels: StringList{"12"}}, "10", "100", nil, false},
+		{"Channel", &Guild{IgnoredChannels: StringList{"10"}}, "10", "100", nil, true},
+		{"Category", &Guild{IgnoredCategories: StringList{"5"}}, "10", "100", nil, true},
+		{"ThreadOfIgnoredChannel", &Guild{IgnoredChannels: StringList{"10"}}, "11", "100", nil, true},
+		{"ThreadInIgnoredCategory", &Guild{IgnoredCategories: StringList{"5"}}, "11", "100", nil, true},
+		{"User", &Guild{IgnoredUsers: StringList{"100"}}, "12", "100", nil, true},
+		{"Role", &Guild{IgnoredRoles: StringList{"31"}}, "12", "100", []string{"31"}, true},
+		{"CachedMemberRole", &Guild{IgnoredRoles: StringList{"30"}}, "12", "100", nil, true},
+		{"RolesOverrideCache", &Guild{IgnoredRoles: StringList{"30"}}, "12", "100", []string{}, false},
+		{"UncachedMember", &Guild{IgnoredRoles: StringList{"30"}}, "12", "200", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.gc.ID = testGuildID
+			if got := b.isIgnored(tt.gc, tt.channelID, tt.userID, tt.roles); got != tt.want {
+				t.Errorf("isIgnored() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
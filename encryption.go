@@ -0,0 +1,365 @@
+package stare
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/intrntsrfr/meido/pkg/utils"
+)
+
+// The cached data the Store persists is encrypted with AES-GCM using a data
+// key per guild, and attachment blobs with a data key shared by every guild.
+// Data keys are stored in badger, encrypted with the current master key:
+//
+//	dek:<scope>:<id>   a data key, where scope is a guild ID or sharedKeyScope
+//
+// Rotating the master key only requires the data keys to be encrypted again,
+// which the offline rekey tool does. It can also replace the data keys
+// themselves, re-encrypting everything.
+//
+// Sealed data is laid out as:
+//
+//	sealedMagic | key ID length | key ID | nonce | ciphertext
+//
+// The scope and the key a value is stored under are bound as additional data,
+// so a value copied to another key or guild fails to decrypt. Data without
+// the prefix is plaintext written before encryption was enabled, and is read
+// as is.
+//
+// Only the contents of the cache are encrypted: members, roles, channels,
+// messages, attachments and search keys. The values of index:, chindex:,
+// fts:, attref:, attusage:, purge: and stats: keys are left as is; they hold
+// message keys, sizes, times and counts, which are no more than the IDs and
+// hashes already in the keys themselves.
+
+// sealedMagic prefixes every encrypted value
+var sealedMagic = []byte("\xecSE2")
+
+// sharedKeyScope is the scope of the data key of attachment blobs, which are
+// shared between guilds
+const sharedKeyScope = "shared"
+
+var errNoEncryptionKey = errors.New("data is encrypted, but no encryption key is configured")
+
+// Keyring holds the master keys used to encrypt data keys. New data keys are
+// encrypted with the current key; older keys are only used for decryption.
+type Keyring struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// NewKeyring creates a keyring from 32 byte master keys, the last of which is
+// the current one.
+func NewKeyring(keys [][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+
+	kr := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption keys must be 32 bytes, got %v", len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:8])
+		kr.keys[id] = aead
+		kr.current = id
+	}
+	return kr, nil
+}
+
+// loadKeyring reads the master keys set in the config, or returns nil if
+// encryption is not enabled. The key file holds one base64 encoded key per
+// line, oldest first; the key set directly in the config is used after them.
+func loadKeyring(cfg *utils.Config) (*Keyring, error) {
+	var encoded []string
+	if path := cfg.GetString("encryption_key_file"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			encoded = append(encoded, line)
+		}
+	}
+	if key := cfg.GetString("encryption_key"); key != "" {
+		encoded = append(encoded, key)
+	}
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	keys := make([][]byte, 0, len(encoded))
+	for _, e := range encoded {
+		key, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedMagic)
+}
+
+// additionalData returns the additional data a value stored under key in a
+// scope is sealed with.
+func additionalData(scope string, key []byte) []byte {
+	ad := make([]byte, 0, len(scope)+1+len(key))
+	ad = append(ad, scope...)
+	ad = append(ad, 0)
+	return append(ad, key...)
+}
+
+func sealWith(aead cipher.AEAD, keyID string, data, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(sealedMagic)+1+len(keyID)+len(nonce)+len(data)+aead.Overhead())
+	out = append(out, sealedMagic...)
+	out = append(out, byte(len(keyID)))
+	out = append(out, keyID...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, ad), nil
+}
+
+// parseSealed returns the key ID and the remaining nonce and ciphertext of
+// sealed data.
+func parseSealed(data []byte) (string, []byte, error) {
+	data = data[len(sealedMagic):]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, errors.New("invalid encrypted data")
+	}
+	n := int(data[0])
+	return string(data[1 : 1+n]), data[1+n:], nil
+}
+
+func openWith(aead cipher.AEAD, rest, ad []byte) ([]byte, error) {
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("invalid encrypted data")
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// seal encrypts a data key stored under key with the current master key.
+func (kr *Keyring) seal(scope string, key, data []byte) ([]byte, error) {
+	return sealWith(kr.keys[kr.current], kr.current, data, additionalData(scope, key))
+}
+
+// open decrypts a data key stored under key with the master key it was
+// sealed with.
+func (kr *Keyring) open(scope string, key, data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return nil, errors.New("data key is not encrypted")
+	}
+	id, rest, err := parseSealed(data)
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := kr.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", id)
+	}
+	return openWith(aead, rest, additionalData(scope, key))
+}
+
+// dataKeys caches the decrypted data keys of a Store.
+type dataKeys struct {
+	sync.Mutex
+	keys map[string]*scopeKeys
+}
+
+type scopeKeys struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+func dataKeyPrefix(scope string) []byte {
+	return []byte(fmt.Sprintf("dek:%v:", scope))
+}
+
+// loadDataKeys reads and decrypts the data keys of a scope. The newest key is
+// the current one.
+func (s *Store) loadDataKeys(txn *badger.Txn, scope string) (*scopeKeys, error) {
+	sk := &scopeKeys{keys: make(map[string]cipher.AEAD)}
+	prefix := dataKeyPrefix(scope)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		value, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		key, err := s.keyring.open(scope, it.Item().Key(), value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt data key of %v: %w", scope, err)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		id := strings.TrimPrefix(string(it.Item().Key()), string(prefix))
+		sk.keys[id] = aead
+		sk.current = id
+	}
+	return sk, nil
+}
+
+// newDataKey creates a data key for a scope, which becomes its current key.
+func (s *Store) newDataKey(txn *badger.Txn, scope string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	// IDs sort by creation time, so the newest key is iterated last
+	id := fmt.Sprintf("%016x", time.Now().UnixNano())
+	dekKey := append(dataKeyPrefix(scope), id...)
+	wrapped, err := s.keyring.seal(scope, dekKey, key)
+	if err != nil {
+		return err
+	}
+	return txn.Set(dekKey, wrapped)
+}
+
+// scopeKeys returns the data keys of a scope, creating the first one if the
+// scope has none. If refresh is set, the keys are read from the database
+// again.
+func (s *Store) scopeKeys(scope string, refresh bool) (*scopeKeys, error) {
+	s.dataKeys.Lock()
+	defer s.dataKeys.Unlock()
+	if sk, ok := s.dataKeys.keys[scope]; ok && !refresh {
+		return sk, nil
+	}
+
+	var sk *scopeKeys
+	var err error
+	for attempt := 0; attempt < maxConflictRetries; attempt++ {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			var err error
+			if sk, err = s.loadDataKeys(txn, scope); err != nil || sk.current != "" {
+				return err
+			}
+			if err := s.newDataKey(txn, scope); err != nil {
+				return err
+			}
+			sk, err = s.loadDataKeys(txn, scope)
+			return err
+		})
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.dataKeys.keys[scope] = sk
+	return sk, nil
+}
+
+// forgetDataKeys drops the cached data keys of a scope.
+func (s *Store) forgetDataKeys(scope string) {
+	s.dataKeys.Lock()
+	defer s.dataKeys.Unlock()
+	delete(s.dataKeys.keys, scope)
+}
+
+// seal encrypts data to be stored under key with the current data key of a
+// scope, or returns it as is if encryption is not enabled.
+func (s *Store) seal(scope string, key, data []byte) ([]byte, error) {
+	if s.keyring == nil {
+		return data, nil
+	}
+	sk, err := s.scopeKeys(scope, false)
+	if err != nil {
+		return nil, err
+	}
+	return sealWith(sk.keys[sk.current], sk.current, data, additionalData(scope, key))
+}
+
+// open decrypts data stored under key, sealed with a data key of a scope.
+// Plaintext data is returned as is.
+func (s *Store) open(scope string, key, data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	if s.keyring == nil {
+		return nil, errNoEncryptionKey
+	}
+
+	id, rest, err := parseSealed(data)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := s.scopeKeys(scope, false)
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := sk.keys[id]
+	if !ok {
+		// the key may have been created after the scope was cached
+		if sk, err = s.scopeKeys(scope, true); err != nil {
+			return nil, err
+		}
+		if aead, ok = sk.keys[id]; !ok {
+			return nil, fmt.Errorf("unknown data key %q for %v", id, scope)
+		}
+	}
+	return openWith(aead, rest, additionalData(scope, key))
+}
+
+// sealedBlobStore encrypts blobs with the shared data key before they are
+// put in the underlying BlobStore.
+type sealedBlobStore struct {
+	BlobStore
+	store *Store
+}
+
+func (b *sealedBlobStore) Put(key string, data []byte) error {
+	sealed, err := b.store.seal(sharedKeyScope, []byte(key), data)
+	if err != nil {
+		return err
+	}
+	return b.BlobStore.Put(key, sealed)
+}
+
+func (b *sealedBlobStore) Get(key string) ([]byte, error) {
+	data, err := b.BlobStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.store.open(sharedKeyScope, []byte(key), data)
+}
@@ -0,0 +1,304 @@
+package stare
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dgraph-io/badger"
+	"go.uber.org/zap/zaptest"
+)
+
+func testKeyring(t *testing.T, seeds ...byte) *Keyring {
+	t.Helper()
+	var keys [][]byte
+	for _, seed := range seeds {
+		keys = append(keys, bytes.Repeat([]byte{seed}, 32))
+	}
+	kr, err := NewKeyring(keys)
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	return kr
+}
+
+// openTestStore opens the store at path, which can be opened again once it
+// is closed.
+func openTestStore(t *testing.T, path string, keyring *Keyring) *Store {
+	t.Helper()
+	s, err := NewStore(&ZapLogger{zaptest.NewLogger(t)}, path, nil, keyring)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	return s
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    [][]byte
+		wantErr bool
+	}{
+		{"NoKeys", nil, true},
+		{"ShortKey", [][]byte{make([]byte, 16)}, true},
+		{"OneShortKey", [][]byte{make([]byte, 32), make([]byte, 31)}, true},
+		{"Keys", [][]byte{make([]byte, 32), bytes.Repeat([]byte{1}, 32)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyring(tt.keys); (err != nil) != tt.wantErr {
+				t.Errorf("NewKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	old := testKeyring(t, 1)
+	rotated := testKeyring(t, 1, 2)
+	key := []byte("dek:1:a")
+	sealed, err := old.seal("1", key, []byte("data key"))
+	if err != nil {
+		t.Fatalf("seal() error = %v", err)
+	}
+	sealedRotated, err := rotated.seal("1", key, []byte("data key"))
+	if err != nil {
+		t.Fatalf("seal() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		kr      *Keyring
+		scope   string
+		key     []byte
+		data    []byte
+		wantErr bool
+	}{
+		{"SameKey", old, "1", key, sealed, false},
+		{"OlderKey", rotated, "1", key, sealed, false},
+		{"NewerKey", old, "1", key, sealedRotated, true},
+		{"OtherKey", rotated, "1", []byte("dek:1:b"), sealed, true},
+		{"OtherScope", rotated, "2", key, sealed, true},
+		{"Plaintext", rotated, "1", key, []byte("data key"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.kr.open(tt.scope, tt.key, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != "data key" {
+				t.Errorf("open() = %q, want %q", got, "data key")
+			}
+		})
+	}
+}
+
+func TestStoreSeal(t *testing.T) {
+	s := newTestStore(t, testKeyring(t, 1))
+	defer s.Close()
+	plain := newTestStore(t, nil)
+	defer plain.Close()
+
+	key := []byte("member:1:100")
+	sealed, err := s.seal(testGuildID, key, []byte("value"))
+	if err != nil {
+		t.Fatalf("seal() error = %v", err)
+	}
+	if !isSealed(sealed) || bytes.Contains(sealed, []byte("value")) {
+		t.Fatalf("seal() = %q, want the value encrypted", sealed)
+	}
+	unsealed, err := plain.seal(testGuildID, key, []byte("value"))
+	if err != nil || string(unsealed) != "value" {
+		t.Fatalf("seal() without a keyring = %q, %v, want the value as is", unsealed, err)
+	}
+
+	tests := []struct {
+		name    string
+		s       *Store
+		scope   string
+		key     []byte
+		data    []byte
+		wantErr bool
+	}{
+		{"Sealed", s, testGuildID, key, sealed, false},
+		{"Plaintext", s, testGuildID, key, []byte("value"), false},
+		{"PlaintextWithoutKeyring", plain, testGuildID, key, []byte("value"), false},
+		{"OtherKey", s, testGuildID, []byte("member:1:200"), sealed, true},
+		{"OtherScope", s, "2", key, sealed, true},
+		{"NoKeyring", plain, testGuildID, key, sealed, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.s.open(tt.scope, tt.key, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != "value" {
+				t.Errorf("open() = %q, want %q", got, "value")
+			}
+		})
+	}
+
+	if _, err := plain.open(testGuildID, key, sealed); !errors.Is(err, errNoEncryptionKey) {
+		t.Errorf("open() without a keyring error = %v, want %v", err, errNoEncryptionKey)
+	}
+}
+
+// writeEncryptedStore caches a member, and a message with an attachment, in a
+// new store encrypted with keyring, and returns its path.
+func writeEncryptedStore(t *testing.T, keyring *Keyring) string {
+	t.Helper()
+	path := t.TempDir()
+	s := openTestStore(t, path, keyring)
+	if err := s.SetMember(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: "100", Username: "user"}}); err != nil {
+		t.Fatalf("SetMember() error = %v", err)
+	}
+	data := []byte("attachment")
+	err := s.SetMessage(&DiscordMessage{
+		Message:     testMessage(0, "10", "hello"),
+		Attachments: []*Attachment{{Filename: "a.txt", Size: len(data), Data: data}},
+	}, time.Hour, 1024)
+	if err != nil {
+		t.Fatalf("SetMessage() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return path
+}
+
+// checkEncryptedStore checks that the data written by writeEncryptedStore can
+// be read.
+func checkEncryptedStore(t *testing.T, s *Store) {
+	t.Helper()
+	if m, err := s.GetMember(testGuildID, "100"); err != nil || m.User.Username != "user" {
+		t.Errorf("GetMember() = %v, %v, want the cached member", m, err)
+	}
+	msg, err := s.GetMessage(testGuildID, "10", testMessage(0, "10", "").ID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if err := s.LoadAttachments(msg); err != nil {
+		t.Fatalf("LoadAttachments() error = %v", err)
+	}
+	if msg.Message.Content != "hello" || string(msg.Attachments[0].Data) != "attachment" {
+		t.Errorf("GetMessage() = %q with attachment %q, want the cached message", msg.Message.Content, msg.Attachments[0].Data)
+	}
+}
+
+func TestStoreMasterKeys(t *testing.T) {
+	path := writeEncryptedStore(t, testKeyring(t, 1))
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		wantErr bool
+	}{
+		{"SameKey", testKeyring(t, 1), false},
+		{"RotatedKey", testKeyring(t, 1, 2), false},
+		{"WrongKey", testKeyring(t, 3), true},
+		{"NoKey", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t, path, tt.keyring)
+			defer s.Close()
+			if !tt.wantErr {
+				checkEncryptedStore(t, s)
+				return
+			}
+
+			if _, err := s.GetMember(testGuildID, "100"); err == nil || errors.Is(err, ErrNotCached) {
+				t.Errorf("GetMember() error = %v, want decrypting to fail", err)
+			}
+			if _, err := s.GetMessage(testGuildID, "10", testMessage(0, "10", "").ID); err == nil || errors.Is(err, ErrNotCached) {
+				t.Errorf("GetMessage() error = %v, want decrypting to fail", err)
+			}
+		})
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	tests := []struct {
+		name           string
+		rotateDataKeys bool
+	}{
+		{"MasterKey", false},
+		{"DataKeys", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeEncryptedStore(t, testKeyring(t, 1))
+
+			// a member written before encryption was enabled, which the rekey
+			// encrypts
+			s := openTestStore(t, path, testKeyring(t, 1, 2))
+			plainKey := []byte("member:1:200")
+			enc, err := encodeMember(&discordgo.Member{User: &discordgo.User{ID: "200", Username: "plain"}})
+			if err != nil {
+				t.Fatalf("encodeMember() error = %v", err)
+			}
+			if err := s.db.Update(func(txn *badger.Txn) error {
+				return txn.Set(plainKey, enc)
+			}); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			oldKeys, _, err := s.dataKeyIDs()
+			if err != nil {
+				t.Fatalf("dataKeyIDs() error = %v", err)
+			}
+
+			res, err := s.Reencrypt(tt.rotateDataKeys)
+			if err != nil {
+				t.Fatalf("Reencrypt() error = %v", err)
+			}
+			if res.DataKeys == 0 || res.Values == 0 || res.Blobs != 1 {
+				t.Errorf("Reencrypt() = %+v, want data keys, values and one blob", res)
+			}
+			newKeys, _, err := s.dataKeyIDs()
+			if err != nil {
+				t.Fatalf("dataKeyIDs() error = %v", err)
+			}
+			replaced := !slices.ContainsFunc(newKeys, func(k []byte) bool {
+				return slices.ContainsFunc(oldKeys, func(o []byte) bool { return bytes.Equal(k, o) })
+			})
+			if len(newKeys) != len(oldKeys) || replaced != tt.rotateDataKeys {
+				t.Errorf("data keys %q after Reencrypt(), had %q", newKeys, oldKeys)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			// the old master key is no longer needed
+			s = openTestStore(t, path, testKeyring(t, 2))
+			defer s.Close()
+			checkEncryptedStore(t, s)
+			if m, err := s.GetMember(testGuildID, "200"); err != nil || m.User.Username != "plain" {
+				t.Errorf("GetMember() of a plaintext member = %v, %v, want it readable", m, err)
+			}
+			if err := s.db.View(func(txn *badger.Txn) error {
+				item, err := txn.Get(plainKey)
+				if err != nil {
+					return err
+				}
+				return item.Value(func(v []byte) error {
+					if !isSealed(v) {
+						t.Errorf("plaintext member = %q, want it encrypted", v)
+					}
+					return nil
+				})
+			}); err != nil {
+				t.Fatalf("View() error = %v", err)
+			}
+		})
+	}
+}
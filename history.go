@@ -0,0 +1,133 @@
+package stare
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GuildChange is a single field change made to a guild config. All changes
+// made by one mutation share the same Version.
+type GuildChange struct {
+	GuildID   string    `json:"guild_id" db:"guild_id"`
+	Version   int       `json:"version" db:"version"`
+	ActorID   string    `json:"actor_id" db:"actor_id"`
+	Timestamp time.Time `json:"timestamp" db:"changed_at"`
+	Field     string    `json:"field" db:"field"`
+	OldValue  string    `json:"old_value" db:"old_value"`
+	NewValue  string    `json:"new_value" db:"new_value"`
+}
+
+// guildFieldName returns the name a Guild struct field is recorded under in
+// the history, or "" if the field is not tracked.
+func guildFieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" || name == "-" || name == "id" {
+		return ""
+	}
+	return name
+}
+
+// diffGuilds returns the fields that differ between old and new, with values
+// encoded as JSON. The changes are not yet assigned a version.
+func diffGuilds(old, new *Guild) ([]*GuildChange, error) {
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(new).Elem()
+	t := ov.Type()
+
+	var changes []*GuildChange
+	for i := 0; i < t.NumField(); i++ {
+		name := guildFieldName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		if reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+
+		oldValue, err := json.Marshal(ov.Field(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		newValue, err := json.Marshal(nv.Field(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if string(oldValue) == string(newValue) {
+			continue
+		}
+
+		changes = append(changes, &GuildChange{
+			GuildID:  new.ID,
+			Field:    name,
+			OldValue: string(oldValue),
+			NewValue: string(newValue),
+		})
+	}
+	return changes, nil
+}
+
+// setGuildField sets the field recorded under name to the JSON encoded value.
+func setGuildField(gc *Guild, name, value string) error {
+	v := reflect.ValueOf(gc).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if guildFieldName(t.Field(i)) != name {
+			continue
+		}
+		ptr := reflect.New(t.Field(i).Type)
+		if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+			return err
+		}
+		v.Field(i).Set(ptr.Elem())
+		return nil
+	}
+	return fmt.Errorf("unknown field %q", name)
+}
+
+// stampChanges assigns version, actor and time to a set of changes.
+func stampChanges(changes []*GuildChange, version int, actorID string, ts time.Time) {
+	for _, c := range changes {
+		c.Version = version
+		c.ActorID = actorID
+		c.Timestamp = ts
+	}
+}
+
+// rollbackGuild undoes every change in history made after version, newest
+// first.
+func rollbackGuild(gc *Guild, history []*GuildChange, version int) error {
+	var undo []*GuildChange
+	for _, c := range history {
+		if c.Version > version {
+			undo = append(undo, c)
+		}
+	}
+	if len(undo) == 0 {
+		return fmt.Errorf("nothing to roll back after version %v", version)
+	}
+
+	sort.SliceStable(undo, func(i, j int) bool {
+		return undo[i].Version > undo[j].Version
+	})
+	for _, c := range undo {
+		if err := setGuildField(gc, c.Field, c.OldValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latestVersion returns the highest version in history.
+func latestVersion(history []*GuildChange) int {
+	v := 0
+	for _, c := range history {
+		if c.Version > v {
+			v = c.Version
+		}
+	}
+	return v
+}
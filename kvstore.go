@@ -3,80 +3,302 @@ package stare
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/dgraph-io/badger"
 	"github.com/dgraph-io/badger/options"
+	"github.com/intrntsrfr/meido/pkg/utils"
 	"go.uber.org/zap"
 )
 
-type Store struct {
-	db     *badger.DB
-	logger *ZapLogger
+// MemberStore caches guild members.
+type MemberStore interface {
+	SetMember(m *discordgo.Member) error
+	// GetMember returns ErrNotCached if the member is not cached.
+	GetMember(gid, uid string) (*discordgo.Member, error)
+	DeleteMember(gid, uid string) error
 }
 
-func NewStore(logger *ZapLogger) (*Store, error) {
-	logger = logger.Named("kvstore").(*ZapLogger)
-	badgerLogger := &ZapLogger{
-		log: logger.Named("badger").(*ZapLogger).log.WithOptions(zap.AddCallerSkip(1)),
+// RoleStore caches the roles of guilds, so that changes to a role can be
+// compared with what it was before.
+type RoleStore interface {
+	SetRole(gid string, r *discordgo.Role) error
+	// GetRole returns ErrNotCached if the role is not cached.
+	GetRole(gid, rid string) (*discordgo.Role, error)
+	DeleteRole(gid, rid string) error
+}
+
+// ChannelStore caches the channels of guilds, so that changes to a channel can
+// be compared with what it was before.
+type ChannelStore interface {
+	SetChannel(ch *discordgo.Channel) error
+	// GetChannel returns ErrNotCached if the channel is not cached.
+	GetChannel(gid, cid string) (*discordgo.Channel, error)
+	// GetChannels returns every cached channel and thread of a guild.
+	GetChannels(gid string) ([]*discordgo.Channel, error)
+	DeleteChannel(gid, cid string) error
+}
+
+// MessageStore caches messages and their attachments.
+type MessageStore interface {
+	// SetMessage caches a message, which expires after ttl. Its attachments
+	// are charged to the guild's attachment quota, in bytes.
+	SetMessage(msg *DiscordMessage, ttl time.Duration, attachmentQuota int64) error
+	// GetMessage returns ErrNotCached if the message is not cached. The data
+	// of its attachments is not loaded.
+	GetMessage(gid, cid, mid string) (*DiscordMessage, error)
+	// AddMessageRevision records a new version of the content of a cached
+	// message and returns the updated message. The message keeps its expiry.
+	AddMessageRevision(gid, cid, mid, content string, editedAt time.Time) (*DiscordMessage, error)
+	// QueryMessageLog calls fn with every cached message of a user that
+	// matches q, oldest first. If fn returns an error the query stops, and
+	// the error is returned unless it is ErrStopQuery. If the limit is
+	// reached before the end of the log, a cursor to continue from is
+	// returned. fn may be called while the store holds a read transaction
+	// open, so it should only collect messages, and callers should process
+	// them after the query returns.
+	QueryMessageLog(q MessageQuery, fn func(msg *DiscordMessage) error) (string, error)
+	// QueryChannelLog calls fn with every cached message in a channel that
+	// matches q, oldest first, like QueryMessageLog.
+	QueryChannelLog(q ChannelQuery, fn func(msg *DiscordMessage) error) (string, error)
+	// SearchMessages calls fn with every cached message that matches q,
+	// newest first, like QueryMessageLog. It returns ErrNoSearchTerms if the
+	// text has no words to search for.
+	SearchMessages(q SearchQuery, fn func(msg *DiscordMessage) error) (string, error)
+	// LoadAttachments reads the data of a message's attachments. Attachments
+	// that are no longer stored are left without data.
+	LoadAttachments(msg *DiscordMessage) error
+}
+
+// CacheStore holds everything the bot caches about guilds.
+type CacheStore interface {
+	MemberStore
+	RoleStore
+	ChannelStore
+	MessageStore
+
+	// DeleteGuildData removes everything cached for a guild.
+	DeleteGuildData(gid string) error
+	// SchedulePurge records that a guild's data should be purged at the given
+	// time, replacing any earlier schedule.
+	SchedulePurge(gid string, at time.Time) error
+	// CancelPurge removes a scheduled purge of a guild's data, if there is
+	// one.
+	CancelPurge(gid string) error
+	// DuePurges returns the guilds whose scheduled purge is at or before now.
+	DuePurges(now time.Time) ([]string, error)
+	// SweepBlobs removes stored attachment data that is no longer used, and
+	// returns how much was removed.
+	SweepBlobs() (int, error)
+	// StorageStats returns the storage used by every guild with cached data,
+	// largest first.
+	StorageStats() ([]GuildStorage, error)
+	Close() error
+}
+
+// ErrNotCached is returned when a member or message is not cached.
+var ErrNotCached = errors.New("not cached")
+
+// newCacheStore creates the cache store set in the config.
+func newCacheStore(cfg *utils.Config, logger *ZapLogger) (CacheStore, error) {
+	switch backend := cfg.GetString("store_backend"); backend {
+	case "", "badger":
+		blobs, err := newBlobStore(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create attachment storage: %w", err)
+		}
+		keyring, err := loadKeyring(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load encryption keys: %w", err)
+		}
+		return NewStore(logger, storePath(cfg), blobs, keyring)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported store backend %q", backend)
 	}
+}
 
-	s := &Store{
-		logger: logger,
+// storePath returns the directory of the badger store set in the config.
+func storePath(cfg *utils.Config) string {
+	if path := cfg.GetString("store_path"); path != "" {
+		return path
 	}
+	return "./data"
+}
 
-	opts := badger.DefaultOptions("./data")
+func openBadger(logger *ZapLogger, path string) (*badger.DB, error) {
+	opts := badger.DefaultOptions(path)
 	opts.Truncate = true
 	opts.ValueLogLoadingMode = options.FileIO
-	opts.Logger = badgerLogger
+	opts.Logger = &ZapLogger{
+		log: logger.Named("badger").(*ZapLogger).log.WithOptions(zap.AddCallerSkip(1)),
+	}
+	return badger.Open(opts)
+}
+
+// maxConflictRetries is how many times a transaction is attempted when it
+// conflicts with a concurrent one
+const maxConflictRetries = 3
+
+// Store is a CacheStore backed by badger.
+type Store struct {
+	db       *badger.DB
+	blobs    BlobStore
+	keyring  *Keyring
+	dataKeys dataKeys
+	logger   *ZapLogger
+	// blobLocks order putting and deleting the same blob, see blobLock
+	blobLocks [64]sync.Mutex
+	// blobsInDB is set if blobs are kept in badger, and so are backed up
+	blobsInDB bool
+	// backupMu keeps scheduled and requested backups from running at once
+	backupMu sync.Mutex
+
+	// stopGC stops RunGC, which closes gcDone once it has returned
+	stopGC chan struct{}
+	gcDone chan struct{}
+	usage  usageStats
+
+	searchKeys searchKeys
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+// NewStore opens the store in the directory at path. Attachment data is kept
+// in blobs, or in badger if blobs is nil. If keyring is not nil, the cached
+// data the store persists is encrypted, see encryption.go.
+func NewStore(logger *ZapLogger, path string, blobs BlobStore, keyring *Keyring) (*Store, error) {
+	logger = logger.Named("kvstore").(*ZapLogger)
+
+	s := &Store{
+		keyring:    keyring,
+		dataKeys:   dataKeys{keys: make(map[string]*scopeKeys)},
+		logger:     logger,
+		stopGC:     make(chan struct{}),
+		gcDone:     make(chan struct{}),
+		searchKeys: searchKeys{keys: make(map[string][]byte)},
+	}
 
-	db, err := badger.Open(opts)
+	db, err := openBadger(logger, path)
 	if err != nil {
 		s.logger.Info("failed to open BadgerDB", zap.Error(err))
 		return nil, err
 	}
 	s.db = db
+	s.blobs = blobs
+	if s.blobs == nil {
+		s.blobs = &badgerBlobStore{db: db}
+		s.blobsInDB = true
+	}
+	s.blobs = &sealedBlobStore{BlobStore: s.blobs, store: s}
+
+	if err := s.migrateRecords(); err != nil {
+		s.logger.Error("failed to migrate stored records", zap.Error(err))
+		db.Close()
+		return nil, err
+	}
+	if err := s.migrateIndex(); err != nil {
+		s.logger.Error("failed to migrate message log index", zap.Error(err))
+		db.Close()
+		return nil, err
+	}
+	if err := s.loadUsage(); err != nil {
+		s.logger.Error("failed to load storage usage", zap.Error(err))
+		db.Close()
+		return nil, err
+	}
 
 	go s.RunGC()
 
 	return s, nil
 }
 
+// Close stops the value log GC, saves the storage usage, then flushes and
+// closes the database. It is safe to call more than once.
 func (s *Store) Close() error {
-	return s.db.Close()
+	s.closeOnce.Do(func() {
+		close(s.stopGC)
+		<-s.gcDone
+		if err := s.saveUsage(); err != nil {
+			s.logger.Error("failed to save storage usage", zap.Error(err))
+		}
+		s.closeErr = s.db.Close()
+	})
+	return s.closeErr
+}
+
+// decodeGob decodes legacy records, see records.go.
+func decodeGob(data []byte, v interface{}) error {
+	buffer := bytes.NewReader(data)
+	return gob.NewDecoder(buffer).Decode(v)
 }
 
-func encodeGob(v interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	err := gob.NewEncoder(&buf).Encode(v)
+// encodeMember encodes and encrypts a member to be persisted under key.
+func (s *Store) encodeMember(key []byte, m *discordgo.Member) ([]byte, error) {
+	enc, err := encodeMember(m)
 	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	return s.seal(m.GuildID, key, enc)
 }
 
-func decodeGob(data []byte, v interface{}) error {
-	buffer := bytes.NewReader(data)
-	return gob.NewDecoder(buffer).Decode(v)
+func (s *Store) decodeMember(gid string, key, data []byte) (*discordgo.Member, error) {
+	data, err := s.open(gid, key, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMember(data)
+}
+
+// encodeMessage encodes and encrypts a message to be persisted under key.
+func (s *Store) encodeMessage(key []byte, msg *DiscordMessage) ([]byte, error) {
+	enc, err := encodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(msg.Message.GuildID, key, enc)
+}
+
+func (s *Store) decodeMessage(gid string, key, data []byte) (*DiscordMessage, error) {
+	data, err := s.open(gid, key, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessage(data)
 }
 
 func (s *Store) SetMember(m *discordgo.Member) error {
-	enc, err := encodeGob(m)
+	key := fmt.Sprintf("member:%v:%v", m.GuildID, m.User.ID)
+	enc, err := s.encodeMember([]byte(key), m)
 	if err != nil {
 		s.logger.Error("failed to encode member", zap.Error(err))
 		return err
 	}
 
-	key := fmt.Sprintf("member:%v:%v", m.GuildID, m.User.ID)
-	return s.db.Update(func(txn *badger.Txn) error {
+	added := false
+	err = s.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		added = err == badger.ErrKeyNotFound
 		return txn.Set([]byte(key), enc)
 	})
+	if err == nil && added {
+		s.usage.apply(m.GuildID, &usageDelta{Members: 1})
+	}
+	return err
 }
 
 func (s *Store) GetMember(gid, uid string) (*discordgo.Member, error) {
-	var member discordgo.Member
+	var member *discordgo.Member
 	key := fmt.Sprintf("member:%v:%v", gid, uid)
 	if err := s.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
@@ -88,47 +310,247 @@ func (s *Store) GetMember(gid, uid string) (*discordgo.Member, error) {
 		if err != nil {
 			return err
 		}
-		return decodeGob(value, &member)
+		member, err = s.decodeMember(gid, []byte(key), value)
+		return err
 	}); err != nil {
-		if err != badger.ErrKeyNotFound {
-			s.logger.Error("failed to read value", zap.Error(err))
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotCached
 		}
+		s.logger.Error("failed to read value", zap.Error(err))
 		return nil, err
 	}
 
-	return &member, nil
+	return member, nil
 }
 
 func (s *Store) DeleteMember(gid, uid string) error {
 	key := fmt.Sprintf("member:%v:%v", gid, uid)
-	return s.db.Update(func(txn *badger.Txn) error {
+	removed := false
+	err := s.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		removed = true
 		return txn.Delete([]byte(key))
 	})
+	if err == nil && removed {
+		s.usage.apply(gid, &usageDelta{Members: -1})
+	}
+	return err
 }
 
-func (s *Store) SetMessage(msg *DiscordMessage) error {
-	messageKey := fmt.Sprintf("message:%s:%s:%s", msg.Message.GuildID, msg.Message.ChannelID, msg.Message.ID)
-	enc, err := encodeGob(msg)
+func (s *Store) SetRole(gid string, r *discordgo.Role) error {
+	key := fmt.Sprintf("role:%v:%v", gid, r.ID)
+	enc, err := encodeRole(r)
+	if err != nil {
+		return err
+	}
+	enc, err = s.seal(gid, []byte(key), enc)
 	if err != nil {
-		return fmt.Errorf("failed to encode DiscordMessage: %w", err)
+		return err
 	}
 
-	indexKey := fmt.Sprintf("index:%s:%s:%s:%s", msg.Message.GuildID, msg.Message.Author.ID, msg.Message.Timestamp, msg.Message.ID)
-	indexValue := messageKey
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), enc)
+	})
+}
+
+func (s *Store) GetRole(gid, rid string) (*discordgo.Role, error) {
+	var role *discordgo.Role
+	key := fmt.Sprintf("role:%v:%v", gid, rid)
+	if err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if value, err = s.open(gid, []byte(key), value); err != nil {
+			return err
+		}
+		role, err = decodeRole(value)
+		return err
+	}); err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotCached
+		}
+		s.logger.Error("failed to read role", zap.Error(err))
+		return nil, err
+	}
+	return role, nil
+}
 
+func (s *Store) DeleteRole(gid, rid string) error {
+	key := fmt.Sprintf("role:%v:%v", gid, rid)
 	return s.db.Update(func(txn *badger.Txn) error {
-		entry := badger.NewEntry([]byte(messageKey), enc).WithTTL(24 * time.Hour)
-		if err := txn.SetEntry(entry); err != nil {
+		return txn.Delete([]byte(key))
+	})
+}
+
+func (s *Store) SetChannel(ch *discordgo.Channel) error {
+	key := fmt.Sprintf("channel:%v:%v", ch.GuildID, ch.ID)
+	enc, err := encodeChannel(ch)
+	if err != nil {
+		return err
+	}
+	enc, err = s.seal(ch.GuildID, []byte(key), enc)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), enc)
+	})
+}
+
+func (s *Store) GetChannel(gid, cid string) (*discordgo.Channel, error) {
+	var channel *discordgo.Channel
+	key := fmt.Sprintf("channel:%v:%v", gid, cid)
+	if err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
 			return err
 		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if value, err = s.open(gid, []byte(key), value); err != nil {
+			return err
+		}
+		channel, err = decodeChannel(gid, value)
+		return err
+	}); err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotCached
+		}
+		s.logger.Error("failed to read channel", zap.Error(err))
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (s *Store) GetChannels(gid string) ([]*discordgo.Channel, error) {
+	var channels []*discordgo.Channel
+	prefix := []byte(fmt.Sprintf("channel:%v:", gid))
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if value, err = s.open(gid, item.Key(), value); err != nil {
+				return err
+			}
+			channel, err := decodeChannel(gid, value)
+			if err != nil {
+				return err
+			}
+			channels = append(channels, channel)
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("failed to read channels", zap.Error(err))
+		return nil, err
+	}
+	return channels, nil
+}
 
-		indexEntry := badger.NewEntry([]byte(indexKey), []byte(indexValue)).WithTTL(24 * time.Hour)
-		return txn.SetEntry(indexEntry)
+func (s *Store) DeleteChannel(gid, cid string) error {
+	key := fmt.Sprintf("channel:%v:%v", gid, cid)
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
 	})
 }
 
+// SetMessage caches a message, which expires after ttl. Its attachments are
+// stored separately and charged to the guild's attachment quota.
+func (s *Store) SetMessage(msg *DiscordMessage, ttl time.Duration, attachmentQuota int64) error {
+	messageKey := fmt.Sprintf("message:%s:%s:%s", msg.Message.GuildID, msg.Message.ChannelID, msg.Message.ID)
+	indexKey := logIndexKey(msg.Message.GuildID, msg.Message.Author.ID, msg.Message.ID)
+	chIndexKey := channelIndexKey(msg.Message.GuildID, msg.Message.ChannelID, msg.Message.ID)
+	indexValue := messageKey
+
+	// attachments touch keys shared with other messages, so concurrent writes
+	// may conflict
+	var stored []*Attachment
+	var released []string
+	var usage *usageDelta
+	var err error
+	for attempt := 0; attempt < maxConflictRetries; attempt++ {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			usage = newUsageDelta()
+			// a message that is cached again is only counted once
+			if item, err := txn.Get([]byte(messageKey)); err == nil {
+				usage.removeMessage(item.ExpiresAt())
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+
+			var err error
+			stored, released, err = putAttachments(txn, msg, ttl, attachmentQuota, usage)
+			if err != nil {
+				return err
+			}
+
+			enc, err := s.encodeMessage([]byte(messageKey), msg.withoutAttachmentData())
+			if err != nil {
+				return fmt.Errorf("failed to encode DiscordMessage: %w", err)
+			}
+			entry := badger.NewEntry([]byte(messageKey), enc).WithTTL(ttl)
+			if err := txn.SetEntry(entry); err != nil {
+				return err
+			}
+			usage.addMessage(entry.ExpiresAt)
+
+			indexEntry := badger.NewEntry(indexKey, []byte(indexValue)).WithTTL(ttl)
+			if err := txn.SetEntry(indexEntry); err != nil {
+				return err
+			}
+
+			channelIndexEntry := badger.NewEntry(chIndexKey, []byte(indexValue)).WithTTL(ttl)
+			if err := txn.SetEntry(channelIndexEntry); err != nil {
+				return err
+			}
+
+			searchEntries, err := s.searchEntries(msg.Message.GuildID, msg.Message.ChannelID, msg.Message.ID, messageTexts(msg), entry.ExpiresAt)
+			if err != nil {
+				return err
+			}
+			for _, e := range searchEntries {
+				if err := txn.SetEntry(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.usage.apply(msg.Message.GuildID, usage)
+	s.deleteBlobs(released)
+	s.storeBlobs(stored)
+	return nil
+}
+
 func (s *Store) GetMessage(gid, cid, mid string) (*DiscordMessage, error) {
-	var message DiscordMessage
+	var message *DiscordMessage
 	key := fmt.Sprintf("message:%v:%v:%v", gid, cid, mid)
 	if err := s.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
@@ -139,71 +561,216 @@ func (s *Store) GetMessage(gid, cid, mid string) (*DiscordMessage, error) {
 		if err != nil {
 			return err
 		}
-		return decodeGob(value, &message)
+		message, err = s.decodeMessage(gid, []byte(key), value)
+		return err
 	}); err != nil {
-		if err != badger.ErrKeyNotFound {
-			s.logger.Error("failed to read message", zap.Error(err))
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotCached
+		}
+		s.logger.Error("failed to read message", zap.Error(err))
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// AddMessageRevision records a new version of the content of a cached message
+// and returns the updated message. The message keeps its original expiry.
+func (s *Store) AddMessageRevision(gid, cid, mid, content string, editedAt time.Time) (*DiscordMessage, error) {
+	var message *DiscordMessage
+	key := fmt.Sprintf("message:%v:%v:%v", gid, cid, mid)
+	err := s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if message, err = s.decodeMessage(gid, []byte(key), value); err != nil {
+			return err
+		}
+
+		message.AddRevision(content, editedAt)
+		enc, err := s.encodeMessage([]byte(key), message)
+		if err != nil {
+			return err
+		}
+
+		entry := badger.NewEntry([]byte(key), enc)
+		entry.ExpiresAt = item.ExpiresAt()
+		if err := txn.SetEntry(entry); err != nil {
+			return err
+		}
+
+		// the words of earlier revisions stay searchable
+		searchEntries, err := s.searchEntries(gid, cid, mid, []string{content}, item.ExpiresAt())
+		if err != nil {
+			return err
+		}
+		for _, e := range searchEntries {
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotCached
 		}
+		s.logger.Error("failed to add message revision", zap.Error(err))
 		return nil, err
 	}
 
-	return &message, nil
+	return message, nil
 }
 
-func (s *Store) GetMessageLog(gid, uid string) ([]*DiscordMessage, error) {
-	prefix := fmt.Sprintf("index:%v:%v:", gid, uid)
-	var messages []*DiscordMessage
+// rewriteValues replaces every value under a prefix whose keys have the guild
+// ID as their second part with the value returned by fn, keeping their expiry.
+// If fn returns nil, the value is left as is. It returns how many values were
+// replaced.
+func (s *Store) rewriteValues(prefix []byte, fn func(gid string, key, value []byte) ([]byte, error)) (int, error) {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	n := 0
 	err := s.db.View(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 
-		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
-			var messageKey string
-			value, err := item.ValueCopy(nil)
-			if err != nil {
-				s.logger.Error("failed to read value", zap.Error(err))
+			key := item.KeyCopy(nil)
+			parts := strings.SplitN(string(key), ":", 3)
+			if len(parts) < 3 {
 				continue
 			}
-			messageKey = string(value)
 
-			var message DiscordMessage
-			err = s.db.View(func(txn *badger.Txn) error {
-				item, err := txn.Get([]byte(messageKey))
-				if err != nil {
-					return err
-				}
-				value, err := item.ValueCopy(nil)
-				if err != nil {
-					return err
-				}
-				return decodeGob(value, &message)
-			})
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			replaced, err := fn(parts[1], key, value)
 			if err != nil {
-				s.logger.Error("failed to read message", zap.Error(err))
+				return err
+			}
+			if replaced == nil {
 				continue
 			}
 
-			messages = append(messages, &message)
+			entry := badger.NewEntry(key, replaced)
+			entry.ExpiresAt = item.ExpiresAt()
+			if err := wb.SetEntry(entry); err != nil {
+				return err
+			}
+			n++
 		}
 		return nil
 	})
 	if err != nil {
-		s.logger.Error("failed to read messages", zap.Error(err))
-		return nil, err
+		return 0, err
+	}
+	return n, wb.Flush()
+}
+
+// DeleteGuildData removes every member, role, channel, cached message,
+// attachment and data key of a guild.
+func (s *Store) DeleteGuildData(gid string) error {
+	if err := s.releaseGuildAttachments(gid); err != nil {
+		return err
 	}
+	defer s.forgetDataKeys(gid)
+	defer s.forgetSearchKey(gid)
+	defer s.usage.forget(gid)
+	return s.db.DropPrefix(
+		[]byte(fmt.Sprintf("member:%v:", gid)),
+		[]byte(fmt.Sprintf("role:%v:", gid)),
+		[]byte(fmt.Sprintf("channel:%v:", gid)),
+		[]byte(fmt.Sprintf("message:%v:", gid)),
+		[]byte(fmt.Sprintf("index:%v:", gid)),
+		[]byte(fmt.Sprintf("chindex:%v:", gid)),
+		[]byte(fmt.Sprintf("fts:%v:", gid)),
+		searchKeyKey(gid),
+		dataKeyPrefix(gid),
+	)
+}
 
-	return messages, err
+// SchedulePurge records that a guild's data should be purged at the given
+// time, replacing any earlier schedule.
+func (s *Store) SchedulePurge(gid string, at time.Time) error {
+	key := fmt.Sprintf("purge:%v", gid)
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), []byte(strconv.FormatInt(at.Unix(), 10)))
+	})
+}
+
+// CancelPurge removes a scheduled purge of a guild's data, if there is one.
+func (s *Store) CancelPurge(gid string) error {
+	key := fmt.Sprintf("purge:%v", gid)
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
+// DuePurges returns the guilds whose scheduled purge is at or before now.
+func (s *Store) DuePurges(now time.Time) ([]string, error) {
+	prefix := []byte("purge:")
+	var due []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			at, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				s.logger.Error("invalid purge schedule", zap.String("key", string(item.Key())), zap.Error(err))
+				continue
+			}
+			if at <= now.Unix() {
+				due = append(due, strings.TrimPrefix(string(item.Key()), "purge:"))
+			}
+		}
+		return nil
+	})
+	return due, err
 }
 
+// RunGC periodically cleans up the value log, until the store is closed.
 func (s *Store) RunGC() {
+	defer close(s.gcDone)
 	gcTicker := time.NewTicker(time.Hour)
-	for range gcTicker.C {
+	defer gcTicker.Stop()
+
+	for {
+		select {
+		case <-gcTicker.C:
+		case <-s.stopGC:
+			return
+		}
+
+		// each run rewrites at most one file, so run until there is nothing
+		// left to rewrite
 		for {
 			err := s.db.RunValueLogGC(0.7)
 			if err == badger.ErrNoRewrite {
 				break
 			}
+			if err != nil {
+				s.logger.Warn("failed to run value log GC", zap.Error(err))
+				break
+			}
+			select {
+			case <-s.stopGC:
+				return
+			default:
+			}
 		}
 	}
 }
@@ -0,0 +1,586 @@
+package stare
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+//
+// In-memory implementation of CacheStore
+//
+
+// MemoryStore is a CacheStore that only keeps data in memory, with the same
+// expiry and attachment quota semantics as Store. It is useful for tests and
+// small deployments that do not need the cache to survive restarts.
+type MemoryStore struct {
+	mu sync.Mutex
+	// values are kept encoded, so callers never share them
+	members  map[string][]byte
+	roles    map[string][]byte
+	channels map[string][]byte
+	messages map[string]*memoryMessage
+	// attachments holds the attachments charged to each guild, oldest first
+	attachments map[string][]*memoryAttachment
+	blobs       map[string][]byte
+	purges      map[string]time.Time
+	// usage is counted as data is changed, the same way Store does
+	usage usageStats
+}
+
+type memoryMessage struct {
+	gid       string
+	authorID  string
+	data      []byte
+	expiresAt time.Time
+}
+
+type memoryAttachment struct {
+	hash      string
+	size      int64
+	expiresAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		members:     make(map[string][]byte),
+		roles:       make(map[string][]byte),
+		channels:    make(map[string][]byte),
+		messages:    make(map[string]*memoryMessage),
+		attachments: make(map[string][]*memoryAttachment),
+		blobs:       make(map[string][]byte),
+		purges:      make(map[string]time.Time),
+		usage:       usageStats{guilds: make(map[string]*guildUsage)},
+	}
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) SetMember(mem *discordgo.Member) error {
+	enc, err := encodeMember(mem)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := mem.GuildID + ":" + mem.User.ID
+	if _, ok := m.members[key]; !ok {
+		m.usage.apply(mem.GuildID, &usageDelta{Members: 1})
+	}
+	m.members[key] = enc
+	return nil
+}
+
+func (m *MemoryStore) GetMember(gid, uid string) (*discordgo.Member, error) {
+	m.mu.Lock()
+	enc, ok := m.members[gid+":"+uid]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrNotCached
+	}
+
+	return decodeMember(enc)
+}
+
+func (m *MemoryStore) DeleteMember(gid, uid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.members[gid+":"+uid]; ok {
+		delete(m.members, gid+":"+uid)
+		m.usage.apply(gid, &usageDelta{Members: -1})
+	}
+	return nil
+}
+
+func (m *MemoryStore) SetRole(gid string, r *discordgo.Role) error {
+	enc, err := encodeRole(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roles[gid+":"+r.ID] = enc
+	return nil
+}
+
+func (m *MemoryStore) GetRole(gid, rid string) (*discordgo.Role, error) {
+	m.mu.Lock()
+	enc, ok := m.roles[gid+":"+rid]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrNotCached
+	}
+
+	return decodeRole(enc)
+}
+
+func (m *MemoryStore) DeleteRole(gid, rid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.roles, gid+":"+rid)
+	return nil
+}
+
+func (m *MemoryStore) SetChannel(ch *discordgo.Channel) error {
+	enc, err := encodeChannel(ch)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.channels[ch.GuildID+":"+ch.ID] = enc
+	return nil
+}
+
+func (m *MemoryStore) GetChannel(gid, cid string) (*discordgo.Channel, error) {
+	m.mu.Lock()
+	enc, ok := m.channels[gid+":"+cid]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrNotCached
+	}
+
+	return decodeChannel(gid, enc)
+}
+
+func (m *MemoryStore) GetChannels(gid string) ([]*discordgo.Channel, error) {
+	m.mu.Lock()
+	var encoded [][]byte
+	for key, enc := range m.channels {
+		if strings.HasPrefix(key, gid+":") {
+			encoded = append(encoded, enc)
+		}
+	}
+	m.mu.Unlock()
+
+	channels := make([]*discordgo.Channel, 0, len(encoded))
+	for _, enc := range encoded {
+		ch, err := decodeChannel(gid, enc)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, ch)
+	}
+	return channels, nil
+}
+
+func (m *MemoryStore) DeleteChannel(gid, cid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.channels, gid+":"+cid)
+	return nil
+}
+
+func memoryMessageKey(gid, cid, mid string) string {
+	return gid + ":" + cid + ":" + mid
+}
+
+func (m *MemoryStore) SetMessage(msg *DiscordMessage, ttl time.Duration, attachmentQuota int64) error {
+	gid := msg.Message.GuildID
+	expiresAt := time.Now().Add(ttl)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneLocked()
+
+	usage := newUsageDelta()
+	defer m.usage.apply(gid, usage)
+	for _, a := range msg.Attachments {
+		if a.Data == nil {
+			continue
+		}
+		if a.Hash == "" {
+			a.Hash = hashAttachment(a.Data)
+		}
+		m.putAttachmentLocked(gid, a, expiresAt, attachmentQuota, usage)
+	}
+
+	enc, err := encodeMessage(msg.withoutAttachmentData())
+	if err != nil {
+		return err
+	}
+
+	key := memoryMessageKey(gid, msg.Message.ChannelID, msg.Message.ID)
+	// a message that is cached again is only counted once
+	if old, err := m.getMessageLocked(gid, msg.Message.ChannelID, msg.Message.ID); err == nil {
+		usage.removeMessage(unixExpiry(old.expiresAt))
+	}
+	usage.addMessage(unixExpiry(expiresAt))
+
+	m.messages[key] = &memoryMessage{
+		gid:       gid,
+		authorID:  msg.Message.Author.ID,
+		data:      enc,
+		expiresAt: expiresAt,
+	}
+	return nil
+}
+
+// unixExpiry returns an expiry as the unix time usage is counted by.
+func unixExpiry(t time.Time) uint64 {
+	return uint64(t.Unix())
+}
+
+// putAttachmentLocked charges an attachment to a guild's quota, evicting the
+// guild's oldest attachments if needed. Changes to the guild's usage are added
+// to usage.
+func (m *MemoryStore) putAttachmentLocked(gid string, a *Attachment, expiresAt time.Time, quota int64, usage *usageDelta) {
+	// the guild is only charged once for the same content
+	for _, ma := range m.attachments[gid] {
+		if ma.hash == a.Hash {
+			if expiresAt.After(ma.expiresAt) {
+				usage.removeAttachment(ma.size, unixExpiry(ma.expiresAt))
+				usage.addAttachment(ma.size, unixExpiry(expiresAt))
+				ma.expiresAt = expiresAt
+			}
+			return
+		}
+	}
+
+	size := int64(len(a.Data))
+	if size > quota {
+		return
+	}
+
+	var used int64
+	for _, ma := range m.attachments[gid] {
+		used += ma.size
+	}
+	for used+size > quota {
+		evicted := m.attachments[gid][0]
+		m.attachments[gid] = m.attachments[gid][1:]
+		m.releaseBlobLocked(evicted.hash)
+		usage.removeAttachment(evicted.size, unixExpiry(evicted.expiresAt))
+		used -= evicted.size
+	}
+
+	m.attachments[gid] = append(m.attachments[gid], &memoryAttachment{
+		hash:      a.Hash,
+		size:      size,
+		expiresAt: expiresAt,
+	})
+	usage.addAttachment(size, unixExpiry(expiresAt))
+	m.blobs[a.Hash] = a.Data
+}
+
+// releaseBlobLocked removes the data of an attachment if no guild is charged
+// for it anymore.
+func (m *MemoryStore) releaseBlobLocked(hash string) {
+	for _, list := range m.attachments {
+		for _, ma := range list {
+			if ma.hash == hash {
+				return
+			}
+		}
+	}
+	delete(m.blobs, hash)
+}
+
+// pruneLocked removes expired messages and attachments, and returns how many
+// attachments were removed. The usage is not changed, as the counts of items
+// drop out once the hour they expire in has passed.
+func (m *MemoryStore) pruneLocked() int {
+	now := time.Now()
+	for key, msg := range m.messages {
+		if !now.Before(msg.expiresAt) {
+			delete(m.messages, key)
+		}
+	}
+
+	var expired []string
+	for gid, list := range m.attachments {
+		kept := list[:0]
+		for _, ma := range list {
+			if now.Before(ma.expiresAt) {
+				kept = append(kept, ma)
+			} else {
+				expired = append(expired, ma.hash)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.attachments, gid)
+		} else {
+			m.attachments[gid] = kept
+		}
+	}
+
+	removed := 0
+	for _, hash := range expired {
+		if _, ok := m.blobs[hash]; ok {
+			m.releaseBlobLocked(hash)
+			if _, ok := m.blobs[hash]; !ok {
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// getMessageLocked returns a cached message that has not expired.
+func (m *MemoryStore) getMessageLocked(gid, cid, mid string) (*memoryMessage, error) {
+	msg, ok := m.messages[memoryMessageKey(gid, cid, mid)]
+	if !ok || !time.Now().Before(msg.expiresAt) {
+		return nil, ErrNotCached
+	}
+	return msg, nil
+}
+
+func (m *MemoryStore) GetMessage(gid, cid, mid string) (*DiscordMessage, error) {
+	m.mu.Lock()
+	msg, err := m.getMessageLocked(gid, cid, mid)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeMessage(msg.data)
+}
+
+func (m *MemoryStore) AddMessageRevision(gid, cid, mid, content string, editedAt time.Time) (*DiscordMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg, err := m.getMessageLocked(gid, cid, mid)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := decodeMessage(msg.data)
+	if err != nil {
+		return nil, err
+	}
+	message.AddRevision(content, editedAt)
+	enc, err := encodeMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	msg.data = enc
+	return message, nil
+}
+
+func (m *MemoryStore) QueryMessageLog(q MessageQuery, fn func(msg *DiscordMessage) error) (string, error) {
+	return m.queryMessages(q.After, q.Before, q.Limit, q.Cursor, func(msg *memoryMessage, cid string) bool {
+		return msg.gid == q.GuildID && msg.authorID == q.UserID &&
+			(len(q.ChannelIDs) == 0 || slices.Contains(q.ChannelIDs, cid))
+	}, fn)
+}
+
+func (m *MemoryStore) QueryChannelLog(q ChannelQuery, fn func(msg *DiscordMessage) error) (string, error) {
+	return m.queryMessages(q.After, q.Before, q.Limit, q.Cursor, func(msg *memoryMessage, cid string) bool {
+		return msg.gid == q.GuildID && cid == q.ChannelID
+	}, fn)
+}
+
+// queryMessages calls fn with every cached message sent in a time range that
+// matches filter, oldest first.
+func (m *MemoryStore) queryMessages(after, before time.Time, limit int, cursor string, filter func(msg *memoryMessage, cid string) bool, fn func(msg *DiscordMessage) error) (string, error) {
+	from, to := padTime(after), padTime(before)
+
+	type match struct {
+		id   string
+		data []byte
+	}
+	m.mu.Lock()
+	var matches []match
+	now := time.Now()
+	for key, msg := range m.messages {
+		if !now.Before(msg.expiresAt) {
+			continue
+		}
+		// <gid>:<cid>:<mid>
+		parts := strings.Split(key, ":")
+		id := padID(parts[2])
+		if id < from || (cursor != "" && id <= cursor) || (to != "" && id >= to) {
+			continue
+		}
+		if !filter(msg, parts[1]) {
+			continue
+		}
+		matches = append(matches, match{id, msg.data})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].id < matches[j].id
+	})
+	for i, ma := range matches {
+		if limit > 0 && i == limit {
+			return matches[i-1].id, nil
+		}
+		message, err := decodeMessage(ma.data)
+		if err != nil {
+			return "", err
+		}
+		if err := fn(message); err != nil {
+			if err == ErrStopQuery {
+				return "", nil
+			}
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+func (m *MemoryStore) SearchMessages(q SearchQuery, fn func(msg *DiscordMessage) error) (string, error) {
+	words := searchWords(q.Text)
+	if len(words) == 0 {
+		return "", ErrNoSearchTerms
+	}
+	from, to := padTime(q.After), padTime(q.Before)
+
+	type match struct {
+		id      string
+		message *DiscordMessage
+	}
+	m.mu.Lock()
+	var matches []match
+	now := time.Now()
+	for key, msg := range m.messages {
+		if !now.Before(msg.expiresAt) || msg.gid != q.GuildID {
+			continue
+		}
+		if q.AuthorID != "" && msg.authorID != q.AuthorID {
+			continue
+		}
+		// <gid>:<cid>:<mid>
+		parts := strings.Split(key, ":")
+		id := padID(parts[2])
+		if id < from || (q.Cursor != "" && id >= q.Cursor) || (to != "" && id >= to) {
+			continue
+		}
+		if len(q.ChannelIDs) > 0 && !slices.Contains(q.ChannelIDs, parts[1]) {
+			continue
+		}
+		message, err := decodeMessage(msg.data)
+		if err != nil {
+			m.mu.Unlock()
+			return "", err
+		}
+		indexed := searchWords(messageTexts(message)...)
+		if !containsAll(indexed, words) {
+			continue
+		}
+		matches = append(matches, match{id, message})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].id > matches[j].id
+	})
+	for i, ma := range matches {
+		if q.Limit > 0 && i == q.Limit {
+			return matches[i-1].id, nil
+		}
+		if err := fn(ma.message); err != nil {
+			if err == ErrStopQuery {
+				return "", nil
+			}
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// containsAll reports whether every word of words is in list.
+func containsAll(list, words []string) bool {
+	for _, w := range words {
+		if !slices.Contains(list, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *MemoryStore) LoadAttachments(msg *DiscordMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range msg.Attachments {
+		if a.Data != nil || a.Hash == "" {
+			continue
+		}
+		if data, ok := m.blobs[a.Hash]; ok {
+			a.Data = data
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteGuildData(gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.members {
+		if strings.HasPrefix(key, gid+":") {
+			delete(m.members, key)
+		}
+	}
+	for key := range m.roles {
+		if strings.HasPrefix(key, gid+":") {
+			delete(m.roles, key)
+		}
+	}
+	for key := range m.channels {
+		if strings.HasPrefix(key, gid+":") {
+			delete(m.channels, key)
+		}
+	}
+	for key, msg := range m.messages {
+		if msg.gid == gid {
+			delete(m.messages, key)
+		}
+	}
+
+	list := m.attachments[gid]
+	delete(m.attachments, gid)
+	for _, ma := range list {
+		m.releaseBlobLocked(ma.hash)
+	}
+	m.usage.forget(gid)
+	return nil
+}
+
+func (m *MemoryStore) SchedulePurge(gid string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.purges[gid] = at
+	return nil
+}
+
+func (m *MemoryStore) CancelPurge(gid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.purges, gid)
+	return nil
+}
+
+func (m *MemoryStore) DuePurges(now time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []string
+	for gid, at := range m.purges {
+		if !at.After(now) {
+			due = append(due, gid)
+		}
+	}
+	return due, nil
+}
+
+// SweepBlobs removes expired messages and attachments.
+func (m *MemoryStore) SweepBlobs() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pruneLocked(), nil
+}
+
+// StorageStats returns the storage used by every guild with cached data. It
+// only reads the usage counts, so it does not wait for writes to the store.
+func (m *MemoryStore) StorageStats() ([]GuildStorage, error) {
+	return m.usage.stats(), nil
+}
@@ -0,0 +1,677 @@
+package stare
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dgraph-io/badger"
+	"go.uber.org/zap/zaptest"
+)
+
+// TestCacheStores runs the same tests against every CacheStore.
+func TestCacheStores(t *testing.T) {
+	stores := []struct {
+		name     string
+		newStore func(t *testing.T) CacheStore
+	}{
+		{"Store", func(t *testing.T) CacheStore {
+			return newTestStore(t, nil)
+		}},
+		{"EncryptedStore", func(t *testing.T) CacheStore {
+			keyring, err := NewKeyring([][]byte{bytes.Repeat([]byte{1}, 32)})
+			if err != nil {
+				t.Fatalf("NewKeyring() error = %v", err)
+			}
+			return newTestStore(t, keyring)
+		}},
+		{"MemoryStore", func(t *testing.T) CacheStore {
+			return NewMemoryStore()
+		}},
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s CacheStore)
+	}{
+		{"Member", testStoreMember},
+		{"Role", testStoreRole},
+		{"Channel", testStoreChannel},
+		{"Message", testStoreMessage},
+		{"MessageRevision", testStoreMessageRevision},
+		{"QueryMessageLog", testStoreQueryMessageLog},
+		{"QueryChannelLog", testStoreQueryChannelLog},
+		{"SearchMessages", testStoreSearchMessages},
+		{"AttachmentQuota", testStoreAttachmentQuota},
+		{"DeleteGuildData", testStoreDeleteGuildData},
+		{"StorageStats", testStoreStorageStats},
+		{"Purges", testStorePurges},
+	}
+
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					s := st.newStore(t)
+					t.Cleanup(func() {
+						if err := s.Close(); err != nil {
+							t.Errorf("Close() error = %v", err)
+						}
+					})
+					tt.fn(t, s)
+				})
+			}
+		})
+	}
+}
+
+func newTestStore(t *testing.T, keyring *Keyring) *Store {
+	t.Helper()
+	s, err := NewStore(&ZapLogger{zaptest.NewLogger(t)}, t.TempDir(), nil, keyring)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	return s
+}
+
+// mustSetMessages caches messages for a day, with a quota of 1mb of
+// attachments.
+func mustSetMessages(t *testing.T, s CacheStore, msgs ...*discordgo.Message) {
+	t.Helper()
+	for _, msg := range msgs {
+		if err := s.SetMessage(&DiscordMessage{Message: msg}, 24*time.Hour, 1024*1024); err != nil {
+			t.Fatalf("SetMessage(%v) error = %v", msg.ID, err)
+		}
+	}
+}
+
+func testStoreMember(t *testing.T, s CacheStore) {
+	if _, err := s.GetMember(testGuildID, "100"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetMember() error = %v, want %v", err, ErrNotCached)
+	}
+
+	mem := &discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: "100", Username: "user"}, Roles: []string{"30"}}
+	if err := s.SetMember(mem); err != nil {
+		t.Fatalf("SetMember() error = %v", err)
+	}
+	got, err := s.GetMember(testGuildID, "100")
+	if err != nil {
+		t.Fatalf("GetMember() error = %v", err)
+	}
+	if got.User.Username != "user" || !slices.Equal(got.Roles, mem.Roles) {
+		t.Errorf("GetMember() = %+v, want %+v", got, mem)
+	}
+
+	if err := s.DeleteMember(testGuildID, "100"); err != nil {
+		t.Fatalf("DeleteMember() error = %v", err)
+	}
+	if _, err := s.GetMember(testGuildID, "100"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetMember() error = %v, want %v", err, ErrNotCached)
+	}
+}
+
+func testStoreRole(t *testing.T, s CacheStore) {
+	role := &discordgo.Role{ID: "30", Name: "mods", Permissions: discordgo.PermissionBanMembers}
+	if err := s.SetRole(testGuildID, role); err != nil {
+		t.Fatalf("SetRole() error = %v", err)
+	}
+	got, err := s.GetRole(testGuildID, "30")
+	if err != nil {
+		t.Fatalf("GetRole() error = %v", err)
+	}
+	if got.Name != "mods" || got.Permissions != role.Permissions {
+		t.Errorf("GetRole() = %+v, want %+v", got, role)
+	}
+	if _, err := s.GetRole("2", "30"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetRole() of another guild error = %v, want %v", err, ErrNotCached)
+	}
+
+	if err := s.DeleteRole(testGuildID, "30"); err != nil {
+		t.Fatalf("DeleteRole() error = %v", err)
+	}
+	if _, err := s.GetRole(testGuildID, "30"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetRole() error = %v, want %v", err, ErrNotCached)
+	}
+}
+
+func testStoreChannel(t *testing.T, s CacheStore) {
+	ch := &discordgo.Channel{
+		ID:      "10",
+		GuildID: testGuildID,
+		Name:    "general",
+		PermissionOverwrites: []*discordgo.PermissionOverwrite{
+			{ID: testGuildID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionSendMessages},
+		},
+	}
+	if err := s.SetChannel(ch); err != nil {
+		t.Fatalf("SetChannel() error = %v", err)
+	}
+	got, err := s.GetChannel(testGuildID, "10")
+	if err != nil {
+		t.Fatalf("GetChannel() error = %v", err)
+	}
+	if got.Name != "general" || got.GuildID != testGuildID || len(got.PermissionOverwrites) != 1 ||
+		got.PermissionOverwrites[0].Deny != discordgo.PermissionSendMessages {
+		t.Errorf("GetChannel() = %+v, want %+v", got, ch)
+	}
+
+	// threads are cached with the channels of their guild
+	thread := &discordgo.Channel{ID: "20", GuildID: testGuildID, ParentID: "10", Type: discordgo.ChannelTypeGuildPrivateThread}
+	other := &discordgo.Channel{ID: "30", GuildID: "2", Name: "other"}
+	for _, c := range []*discordgo.Channel{thread, other} {
+		if err := s.SetChannel(c); err != nil {
+			t.Fatalf("SetChannel() error = %v", err)
+		}
+	}
+	channels, err := s.GetChannels(testGuildID)
+	if err != nil {
+		t.Fatalf("GetChannels() error = %v", err)
+	}
+	slices.SortFunc(channels, func(a, b *discordgo.Channel) int { return strings.Compare(a.ID, b.ID) })
+	if len(channels) != 2 || channels[0].Name != "general" ||
+		channels[1].ParentID != "10" || channels[1].Type != discordgo.ChannelTypeGuildPrivateThread {
+		t.Errorf("GetChannels() = %+v, want the channel and its thread", channels)
+	}
+
+	if err := s.DeleteChannel(testGuildID, "10"); err != nil {
+		t.Fatalf("DeleteChannel() error = %v", err)
+	}
+	if _, err := s.GetChannel(testGuildID, "10"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetChannel() error = %v, want %v", err, ErrNotCached)
+	}
+}
+
+func testStoreMessage(t *testing.T, s CacheStore) {
+	msg := testMessage(0, "10", "hello")
+	if _, err := s.GetMessage(testGuildID, "10", msg.ID); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetMessage() error = %v, want %v", err, ErrNotCached)
+	}
+
+	data := []byte("attachment")
+	err := s.SetMessage(&DiscordMessage{
+		Message:     msg,
+		Attachments: []*Attachment{{Filename: "a.txt", Size: len(data), Data: data}},
+	}, 24*time.Hour, 1024)
+	if err != nil {
+		t.Fatalf("SetMessage() error = %v", err)
+	}
+
+	got, err := s.GetMessage(testGuildID, "10", msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if got.Message.Content != "hello" || got.Message.Author.ID != "100" {
+		t.Errorf("GetMessage() = %+v, want %+v", got.Message, msg)
+	}
+	if len(got.Attachments) != 1 || got.Attachments[0].Data != nil {
+		t.Fatalf("GetMessage().Attachments = %+v, want one attachment without its data", got.Attachments)
+	}
+	if err := s.LoadAttachments(got); err != nil {
+		t.Fatalf("LoadAttachments() error = %v", err)
+	}
+	if !bytes.Equal(got.Attachments[0].Data, data) {
+		t.Errorf("LoadAttachments() data = %q, want %q", got.Attachments[0].Data, data)
+	}
+}
+
+func testStoreMessageRevision(t *testing.T, s CacheStore) {
+	msg := testMessage(0, "10", "first")
+	mustSetMessages(t, s, msg)
+
+	if _, err := s.AddMessageRevision(testGuildID, "10", "1", "second", time.Now()); !errors.Is(err, ErrNotCached) {
+		t.Errorf("AddMessageRevision() of an uncached message error = %v, want %v", err, ErrNotCached)
+	}
+	edited := msg.Timestamp.Add(time.Minute)
+	if _, err := s.AddMessageRevision(testGuildID, "10", msg.ID, "second", edited); err != nil {
+		t.Fatalf("AddMessageRevision() error = %v", err)
+	}
+
+	got, err := s.GetMessage(testGuildID, "10", msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	history := got.History()
+	if got.Message.Content != "second" || len(history) != 2 || history[0].Content != "first" ||
+		!history[1].Timestamp.Equal(edited) {
+		t.Errorf("GetMessage() = %q with history %+v, want the second revision", got.Message.Content, history)
+	}
+}
+
+// collectContents runs a query page by page, and returns the content of the
+// messages of every page.
+func collectContents(t *testing.T, query func(cursor string, fn func(msg *DiscordMessage) error) (string, error)) [][]string {
+	t.Helper()
+	var pages [][]string
+	cursor := ""
+	for {
+		var page []string
+		next, err := query(cursor, func(msg *DiscordMessage) error {
+			page = append(page, msg.Message.Content)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("query error = %v", err)
+		}
+		pages = append(pages, page)
+		if next == "" {
+			return pages
+		}
+		if len(pages) > 10 {
+			t.Fatalf("query did not finish after %v pages", len(pages))
+		}
+		cursor = next
+	}
+}
+
+func testStoreQueryMessageLog(t *testing.T, s CacheStore) {
+	// the messages of user 100 alternate between two channels, and user 200
+	// has a message in between
+	for i := 0; i < 7; i++ {
+		mustSetMessages(t, s, testMessage(i, fmt.Sprint(10+i%2), fmt.Sprint(i)))
+	}
+	other := testMessage(7, "10", "7")
+	other.Author = &discordgo.User{ID: "200"}
+	mustSetMessages(t, s, other)
+	base := testMessage(0, "10", "").Timestamp
+
+	tests := []struct {
+		name string
+		q    MessageQuery
+		want [][]string
+	}{
+		{"All", MessageQuery{}, [][]string{{"0", "1", "2", "3", "4", "5", "6"}}},
+		{"Paged", MessageQuery{Limit: 3}, [][]string{{"0", "1", "2"}, {"3", "4", "5"}, {"6"}}},
+		{"ExactPages", MessageQuery{Limit: 7}, [][]string{{"0", "1", "2", "3", "4", "5", "6"}}},
+		{"Channels", MessageQuery{ChannelIDs: []string{"11"}, Limit: 2}, [][]string{{"1", "3"}, {"5"}}},
+		{"TimeRange", MessageQuery{After: base.Add(2 * time.Second), Before: base.Add(5 * time.Second)}, [][]string{{"2", "3", "4"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := collectContents(t, func(cursor string, fn func(msg *DiscordMessage) error) (string, error) {
+				q := tt.q
+				q.GuildID, q.UserID, q.Cursor = testGuildID, "100", cursor
+				return s.QueryMessageLog(q, fn)
+			})
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("QueryMessageLog() pages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// a query that is stopped returns no error
+	n := 0
+	_, err := s.QueryMessageLog(MessageQuery{GuildID: testGuildID, UserID: "100"}, func(msg *DiscordMessage) error {
+		n++
+		return ErrStopQuery
+	})
+	if err != nil || n != 1 {
+		t.Errorf("QueryMessageLog() stopped after %v messages with error %v, want 1 and nil", n, err)
+	}
+}
+
+func testStoreQueryChannelLog(t *testing.T, s CacheStore) {
+	for i := 0; i < 5; i++ {
+		msg := testMessage(i, "10", fmt.Sprint(i))
+		msg.Author = &discordgo.User{ID: fmt.Sprint(100 + i)}
+		mustSetMessages(t, s, msg)
+	}
+	mustSetMessages(t, s, testMessage(5, "11", "5"))
+
+	got := collectContents(t, func(cursor string, fn func(msg *DiscordMessage) error) (string, error) {
+		return s.QueryChannelLog(ChannelQuery{GuildID: testGuildID, ChannelID: "10", Limit: 2, Cursor: cursor}, fn)
+	})
+	if want := "[[0 1] [2 3] [4]]"; fmt.Sprint(got) != want {
+		t.Errorf("QueryChannelLog() pages = %v, want %v", got, want)
+	}
+}
+
+func testStoreSearchMessages(t *testing.T, s CacheStore) {
+	contents := []string{
+		"hello world",
+		"Hello there, World!",
+		"goodbye world",
+		"hello again",
+		"world says hello",
+	}
+	for i, content := range contents {
+		msg := testMessage(i, "10", content)
+		if i == 4 {
+			msg.ChannelID = "11"
+			msg.Author = &discordgo.User{ID: "200"}
+		}
+		mustSetMessages(t, s, msg)
+	}
+	// edits are searchable by both their old and new content
+	if _, err := s.AddMessageRevision(testGuildID, "10", testMessage(2, "10", "").ID, "farewell", time.Now()); err != nil {
+		t.Fatalf("AddMessageRevision() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		q    SearchQuery
+		want [][]string
+	}{
+		{"AllWords", SearchQuery{Text: "hello world"}, [][]string{{"world says hello", "Hello there, World!", "hello world"}}},
+		{"Paged", SearchQuery{Text: "world", Limit: 2}, [][]string{{"world says hello", "farewell"}, {"Hello there, World!", "hello world"}}},
+		{"OldContent", SearchQuery{Text: "goodbye"}, [][]string{{"farewell"}}},
+		{"NewContent", SearchQuery{Text: "FAREWELL"}, [][]string{{"farewell"}}},
+		{"Author", SearchQuery{Text: "hello", AuthorID: "200"}, [][]string{{"world says hello"}}},
+		{"Channels", SearchQuery{Text: "hello", ChannelIDs: []string{"10"}}, [][]string{{"hello again", "Hello there, World!", "hello world"}}},
+		{"NoMatch", SearchQuery{Text: "nothing"}, [][]string{nil}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := collectContents(t, func(cursor string, fn func(msg *DiscordMessage) error) (string, error) {
+				q := tt.q
+				q.GuildID, q.Cursor = testGuildID, cursor
+				return s.SearchMessages(q, fn)
+			})
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("SearchMessages() pages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := s.SearchMessages(SearchQuery{GuildID: testGuildID, Text: "a"}, func(msg *DiscordMessage) error {
+		return nil
+	}); !errors.Is(err, ErrNoSearchTerms) {
+		t.Errorf("SearchMessages() error = %v, want %v", err, ErrNoSearchTerms)
+	}
+	if _, err := s.SearchMessages(SearchQuery{GuildID: "2", Text: "hello"}, func(msg *DiscordMessage) error {
+		t.Errorf("SearchMessages() of another guild returned %q", msg.Message.Content)
+		return nil
+	}); err != nil {
+		t.Errorf("SearchMessages() error = %v", err)
+	}
+}
+
+func testStoreAttachmentQuota(t *testing.T, s CacheStore) {
+	const quota = 10
+	set := func(i int, data string) *DiscordMessage {
+		t.Helper()
+		msg := &DiscordMessage{
+			Message:     testMessage(i, "10", ""),
+			Attachments: []*Attachment{{Filename: "a.txt", Size: len(data), Data: []byte(data)}},
+		}
+		if err := s.SetMessage(msg, 24*time.Hour, quota); err != nil {
+			t.Fatalf("SetMessage() error = %v", err)
+		}
+		return msg
+	}
+	loaded := func(msg *DiscordMessage) string {
+		t.Helper()
+		got, err := s.GetMessage(testGuildID, "10", msg.Message.ID)
+		if err != nil {
+			t.Fatalf("GetMessage() error = %v", err)
+		}
+		if err := s.LoadAttachments(got); err != nil {
+			t.Fatalf("LoadAttachments() error = %v", err)
+		}
+		return string(got.Attachments[0].Data)
+	}
+
+	first := set(0, "aaaaaa")
+	// the same content is only charged once
+	again := set(1, "aaaaaa")
+	second := set(2, "bbbbbb")
+	tooLarge := set(3, "ccccccccccc")
+
+	tests := []struct {
+		name string
+		msg  *DiscordMessage
+		want string
+	}{
+		{"Evicted", first, ""},
+		{"EvictedForEveryMessage", again, ""},
+		{"Kept", second, "bbbbbb"},
+		{"LargerThanQuota", tooLarge, ""},
+	}
+	for _, tt := range tests {
+		if got := loaded(tt.msg); got != tt.want {
+			t.Errorf("%v: attachment data = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	usage, err := s.StorageStats()
+	if err != nil {
+		t.Fatalf("StorageStats() error = %v", err)
+	}
+	if len(usage) != 1 || usage[0].AttachmentBytes != 6 || usage[0].Messages != 4 {
+		t.Errorf("StorageStats() = %+v, want 4 messages and 6 bytes of attachments", usage)
+	}
+}
+
+func testStoreDeleteGuildData(t *testing.T, s CacheStore) {
+	kept := testMessage(1, "10", "kept")
+	kept.GuildID = "2"
+	mustSetMessages(t, s, testMessage(0, "10", "hello"), kept)
+	for _, gid := range []string{testGuildID, "2"} {
+		if err := s.SetMember(&discordgo.Member{GuildID: gid, User: &discordgo.User{ID: "100"}}); err != nil {
+			t.Fatalf("SetMember() error = %v", err)
+		}
+		if err := s.SetRole(gid, &discordgo.Role{ID: "30"}); err != nil {
+			t.Fatalf("SetRole() error = %v", err)
+		}
+	}
+
+	if err := s.DeleteGuildData(testGuildID); err != nil {
+		t.Fatalf("DeleteGuildData() error = %v", err)
+	}
+
+	if _, err := s.GetMessage(testGuildID, "10", testMessage(0, "10", "").ID); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetMessage() error = %v, want %v", err, ErrNotCached)
+	}
+	if _, err := s.GetMember(testGuildID, "100"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetMember() error = %v, want %v", err, ErrNotCached)
+	}
+	if _, err := s.GetRole(testGuildID, "30"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("GetRole() error = %v, want %v", err, ErrNotCached)
+	}
+	if _, err := s.SearchMessages(SearchQuery{GuildID: testGuildID, Text: "hello"}, func(msg *DiscordMessage) error {
+		t.Errorf("SearchMessages() returned %q of a deleted guild", msg.Message.Content)
+		return nil
+	}); err != nil {
+		t.Errorf("SearchMessages() error = %v", err)
+	}
+
+	if _, err := s.GetMessage("2", "10", kept.ID); err != nil {
+		t.Errorf("GetMessage() of another guild error = %v", err)
+	}
+	if _, err := s.GetMember("2", "100"); err != nil {
+		t.Errorf("GetMember() of another guild error = %v", err)
+	}
+	usage, err := s.StorageStats()
+	if err != nil {
+		t.Fatalf("StorageStats() error = %v", err)
+	}
+	if len(usage) != 1 || usage[0].GuildID != "2" {
+		t.Errorf("StorageStats() = %+v, want only guild 2", usage)
+	}
+}
+
+func testStoreStorageStats(t *testing.T, s CacheStore) {
+	for _, uid := range []string{"100", "101", "100"} {
+		if err := s.SetMember(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: uid}}); err != nil {
+			t.Fatalf("SetMember() error = %v", err)
+		}
+	}
+	if err := s.DeleteMember(testGuildID, "101"); err != nil {
+		t.Fatalf("DeleteMember() error = %v", err)
+	}
+	if err := s.DeleteMember(testGuildID, "102"); err != nil {
+		t.Fatalf("DeleteMember() error = %v", err)
+	}
+	// caching a message again does not count it twice
+	mustSetMessages(t, s, testMessage(0, "10", "a"), testMessage(1, "10", "b"), testMessage(0, "10", "a"))
+
+	usage, err := s.StorageStats()
+	if err != nil {
+		t.Fatalf("StorageStats() error = %v", err)
+	}
+	want := []GuildStorage{{GuildID: testGuildID, Members: 1, Messages: 2}}
+	if !reflect.DeepEqual(usage, want) {
+		t.Errorf("StorageStats() = %+v, want %+v", usage, want)
+	}
+}
+
+func testStorePurges(t *testing.T, s CacheStore) {
+	now := time.Now()
+	for gid, at := range map[string]time.Time{"1": now.Add(-time.Hour), "2": now.Add(time.Hour), "3": now.Add(-time.Minute)} {
+		if err := s.SchedulePurge(gid, at); err != nil {
+			t.Fatalf("SchedulePurge() error = %v", err)
+		}
+	}
+	if err := s.CancelPurge("3"); err != nil {
+		t.Fatalf("CancelPurge() error = %v", err)
+	}
+
+	due, err := s.DuePurges(now)
+	if err != nil {
+		t.Fatalf("DuePurges() error = %v", err)
+	}
+	if !slices.Equal(due, []string{"1"}) {
+		t.Errorf("DuePurges() = %v, want [1]", due)
+	}
+}
+
+func TestStoreQuerySkipsUnreadableMessages(t *testing.T) {
+	s := newTestStore(t, nil)
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		mustSetMessages(t, s, testMessage(i, "10", fmt.Sprint(i)))
+	}
+	// the index entries of the last messages point to a message that cannot
+	// be decoded, and messages that are gone
+	err := s.db.Update(func(txn *badger.Txn) error {
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("message:%v:10:%v", testGuildID, testMessage(i, "10", "").ID))
+		}
+		if err := txn.Set(key(2), []byte("not a message")); err != nil {
+			return err
+		}
+		if err := txn.Delete(key(3)); err != nil {
+			return err
+		}
+		return txn.Delete(key(4))
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	// no cursor is returned when no other message could be read
+	got := collectContents(t, func(cursor string, fn func(msg *DiscordMessage) error) (string, error) {
+		return s.QueryChannelLog(ChannelQuery{GuildID: testGuildID, ChannelID: "10", Limit: 2, Cursor: cursor}, fn)
+	})
+	if want := "[[0 1]]"; fmt.Sprint(got) != want {
+		t.Errorf("QueryChannelLog() pages = %v, want %v", got, want)
+	}
+}
+
+func TestStoreMigrateIndex(t *testing.T) {
+	path := t.TempDir()
+	s := openTestStore(t, path, nil)
+	for i := 0; i < 3; i++ {
+		msg := testMessage(i, fmt.Sprint(10+i%2), fmt.Sprintf("hello %v", i))
+		mustSetMessages(t, s, msg)
+	}
+
+	// replace the indexes with the user index of version 1, keyed by the
+	// message timestamp as text
+	err := s.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete([]byte(indexVersionKey)); err != nil {
+			return err
+		}
+		for _, prefix := range []string{"index:", "chindex:", "fts:"} {
+			if err := deletePrefix(txn, []byte(prefix)); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < 3; i++ {
+			msg := testMessage(i, fmt.Sprint(10+i%2), "")
+			key := fmt.Sprintf("index:%s:%s:%s:%s", msg.GuildID, msg.Author.ID, msg.Timestamp, msg.ID)
+			value := fmt.Sprintf("message:%s:%s:%s", msg.GuildID, msg.ChannelID, msg.ID)
+			if err := txn.Set([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	s = openTestStore(t, path, nil)
+	defer s.Close()
+	tests := []struct {
+		name  string
+		query func(fn func(msg *DiscordMessage) error) (string, error)
+		want  string
+	}{
+		{"QueryMessageLog", func(fn func(msg *DiscordMessage) error) (string, error) {
+			return s.QueryMessageLog(MessageQuery{GuildID: testGuildID, UserID: "100"}, fn)
+		}, "[[hello 0 hello 1 hello 2]]"},
+		{"QueryChannelLog", func(fn func(msg *DiscordMessage) error) (string, error) {
+			return s.QueryChannelLog(ChannelQuery{GuildID: testGuildID, ChannelID: "10"}, fn)
+		}, "[[hello 0 hello 2]]"},
+		{"SearchMessages", func(fn func(msg *DiscordMessage) error) (string, error) {
+			return s.SearchMessages(SearchQuery{GuildID: testGuildID, Text: "hello"}, fn)
+		}, "[[hello 2 hello 1 hello 0]]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := collectContents(t, func(cursor string, fn func(msg *DiscordMessage) error) (string, error) {
+				return tt.query(fn)
+			})
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("pages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the entries of version 1 are removed
+	err = s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("index:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if key := string(it.Item().Key()); strings.Count(key, ":") > 3 {
+				t.Errorf("index entry %q of version 1 was kept", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View() error = %v", err)
+	}
+}
+
+// deletePrefix deletes every key under a prefix.
+func deletePrefix(txn *badger.Txn, prefix []byte) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var keys [][]byte
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
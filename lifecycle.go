@@ -0,0 +1,119 @@
+package stare
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/intrntsrfr/meido/pkg/mio/discord"
+	"go.uber.org/zap"
+)
+
+// ErrShutdownTimeout is returned by Shutdown if event handlers or background
+// jobs were still running when its context was done.
+var ErrShutdownTimeout = errors.New("timed out waiting for handlers to finish")
+
+// lifecycle tracks the event handlers, commands and background jobs of the
+// bot, so that shutting down can wait for them to finish.
+type lifecycle struct {
+	mu      sync.Mutex
+	closing bool
+	// handlers counts event handlers and commands that are running, jobs
+	// counts background jobs
+	handlers sync.WaitGroup
+	jobs     sync.WaitGroup
+	// stopJobs cancels the context of background jobs
+	stopJobs context.CancelFunc
+}
+
+// begin registers an event handler or command as running. It reports false
+// once the bot is shutting down, in which case the event must be dropped.
+func (l *lifecycle) begin() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return false
+	}
+	l.handlers.Add(1)
+	return true
+}
+
+// tracked wraps an event handler so that shutting down waits for it, and no
+// new events are handled once the bot is shutting down.
+func tracked[T any](b *Bot, h func(*discordgo.Session, T)) func(*discordgo.Session, T) {
+	return func(s *discordgo.Session, e T) {
+		if !b.lifecycle.begin() {
+			return
+		}
+		defer b.lifecycle.handlers.Done()
+		h(s, e)
+	}
+}
+
+// trackedCommand wraps a command handler so that shutting down waits for it.
+// Commands used once the bot is shutting down are refused.
+func trackedCommand(l *lifecycle, run func(*discord.DiscordApplicationCommand)) func(*discord.DiscordApplicationCommand) {
+	return func(d *discord.DiscordApplicationCommand) {
+		if !l.begin() {
+			d.RespondEphemeral("The bot is restarting, try again in a moment")
+			return
+		}
+		defer l.handlers.Done()
+		run(d)
+	}
+}
+
+// goJob runs a background job until ctx is done, and lets shutting down wait
+// for it.
+func (b *Bot) goJob(ctx context.Context, job func(context.Context)) {
+	b.lifecycle.jobs.Add(1)
+	go func() {
+		defer b.lifecycle.jobs.Done()
+		job(ctx)
+	}()
+}
+
+// Shutdown stops the bot. It stops accepting events and commands and
+// disconnects from Discord, then waits for running event handlers, which
+// includes their log deliveries, commands, which includes requested backups,
+// and background jobs until ctx is done. Once they have finished, the cache
+// store is flushed and closed. If they have not finished in time, the store
+// is left open and ErrShutdownTimeout is returned; badger recovers any
+// unflushed writes the next time it is opened.
+func (b *Bot) Shutdown(ctx context.Context) error {
+	b.lifecycle.mu.Lock()
+	if b.lifecycle.closing {
+		b.lifecycle.mu.Unlock()
+		return nil
+	}
+	b.lifecycle.closing = true
+	b.lifecycle.mu.Unlock()
+
+	b.logger.Info("shutting down")
+	b.Bot.Close()
+	if b.lifecycle.stopJobs != nil {
+		b.lifecycle.stopJobs()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.lifecycle.handlers.Wait()
+		b.lifecycle.jobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		b.logger.Error("timed out waiting for handlers to finish, leaving the store open")
+		return ErrShutdownTimeout
+	}
+
+	if err := b.store.Close(); err != nil {
+		b.logger.Error("failed to close store", zap.Error(err))
+		return err
+	}
+	b.logger.Info("shut down")
+	return nil
+}
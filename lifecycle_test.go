@@ -0,0 +1,64 @@
+package stare
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/intrntsrfr/meido/pkg/mio/discord"
+)
+
+func TestShutdownWaitsForCommands(t *testing.T) {
+	b := newTestBot(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	cmd := trackedCommand(&b.lifecycle, func(d *discord.DiscordApplicationCommand) {
+		close(started)
+		<-release
+	})
+	go cmd(nil)
+	<-started
+
+	done := make(chan error)
+	go func() {
+		done <- b.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown() = %v while a command was running, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+
+	// events that arrive while shutting down are dropped
+	ran := false
+	tracked(b, func(s *discordgo.Session, d *discordgo.Ready) {
+		ran = true
+	})(nil, &discordgo.Ready{})
+	if ran {
+		t.Errorf("event handled after Shutdown()")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	b := newTestBot(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	cmd := trackedCommand(&b.lifecycle, func(d *discord.DiscordApplicationCommand) {
+		close(started)
+		<-release
+	})
+	go cmd(nil)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("Shutdown() error = %v, want %v", err, ErrShutdownTimeout)
+	}
+}
@@ -0,0 +1,341 @@
+package stare
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"go.uber.org/zap"
+)
+
+// Messages are indexed by message ID, which sorts by time as IDs are
+// snowflakes. The value of an index entry is the message key:
+//
+//	index:<gid>:<uid>:<zero padded mid>     messages of a user
+//	chindex:<gid>:<cid>:<zero padded mid>   messages in a channel
+
+// MessageQuery selects messages from the message log of a user.
+type MessageQuery struct {
+	GuildID string
+	UserID  string
+	// After and Before limit the messages to those sent in the time range.
+	// Zero values leave the range open.
+	After  time.Time
+	Before time.Time
+	// ChannelIDs limits the messages to those sent in these channels, if set
+	ChannelIDs []string
+	// Limit is the most messages to return, or 0 for no limit
+	Limit int
+	// Cursor continues a previous query after the last message it returned
+	Cursor string
+}
+
+// ChannelQuery selects the messages sent in a channel.
+type ChannelQuery struct {
+	GuildID   string
+	ChannelID string
+	// After and Before limit the messages to those sent in the time range.
+	// Zero values leave the range open.
+	After  time.Time
+	Before time.Time
+	// Limit is the most messages to return, or 0 for no limit
+	Limit int
+	// Cursor continues a previous query after the last message it returned
+	Cursor string
+}
+
+// ErrStopQuery can be returned by the callback of a query to stop it without
+// the query returning an error.
+var ErrStopQuery = errors.New("stop query")
+
+// discordEpoch is the first millisecond of snowflake IDs, in unix time
+const discordEpoch = 1420070400000
+
+// snowflakeAt returns the lowest snowflake ID created at t.
+func snowflakeAt(t time.Time) uint64 {
+	ms := t.UnixMilli() - discordEpoch
+	if ms < 0 {
+		return 0
+	}
+	return uint64(ms) << 22
+}
+
+// padID pads a snowflake ID so IDs sort as strings.
+func padID(id string) string {
+	return fmt.Sprintf("%020s", id)
+}
+
+// padTime returns the padded lowest snowflake ID created at t, or an empty
+// string if t is zero.
+func padTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return padID(strconv.FormatUint(snowflakeAt(t), 10))
+}
+
+func logIndexPrefix(gid, uid string) []byte {
+	return []byte(fmt.Sprintf("index:%v:%v:", gid, uid))
+}
+
+func logIndexKey(gid, uid, mid string) []byte {
+	return append(logIndexPrefix(gid, uid), padID(mid)...)
+}
+
+func channelIndexPrefix(gid, cid string) []byte {
+	return []byte(fmt.Sprintf("chindex:%v:%v:", gid, cid))
+}
+
+func channelIndexKey(gid, cid, mid string) []byte {
+	return append(channelIndexPrefix(gid, cid), padID(mid)...)
+}
+
+// indexRange is a range of an index to query, by padded message ID.
+type indexRange struct {
+	prefix []byte
+	// from is the first ID in the range, and to the first ID after it
+	from, to string
+	limit    int
+	cursor   string
+	// filter skips messages by channel ID, if set
+	filter func(cid string) bool
+}
+
+// queryIndex calls fn with every message in an index range, reading within a
+// single transaction. It returns a cursor if the limit was reached and another
+// message in the range could still be read.
+func (s *Store) queryIndex(gid string, r indexRange, fn func(msg *DiscordMessage) error) (string, error) {
+	start := r.prefix
+	if r.cursor != "" {
+		start = append(slices.Clone(r.prefix), r.cursor...)
+	} else if r.from != "" {
+		start = append(slices.Clone(r.prefix), r.from...)
+	}
+	var end []byte
+	if r.to != "" {
+		end = append(slices.Clone(r.prefix), r.to...)
+	}
+
+	var cursor, last string
+	n := 0
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(start); it.ValidForPrefix(r.prefix); it.Next() {
+			item := it.Item()
+			if end != nil && bytes.Compare(item.Key(), end) >= 0 {
+				break
+			}
+			suffix := string(item.Key()[len(r.prefix):])
+			if suffix == r.cursor {
+				continue
+			}
+
+			messageKey, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			// message:<gid>:<cid>:<mid>
+			parts := strings.Split(string(messageKey), ":")
+			if len(parts) != 4 {
+				continue
+			}
+			if r.filter != nil && !r.filter(parts[2]) {
+				continue
+			}
+
+			msgItem, err := txn.Get(messageKey)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			value, err := msgItem.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			msg, err := s.decodeMessage(gid, messageKey, value)
+			if err != nil {
+				s.logger.Error("failed to read message", zap.String("key", string(messageKey)), zap.Error(err))
+				continue
+			}
+			// the cursor is only returned once another message has been read,
+			// so the next page is not empty
+			if r.limit > 0 && n == r.limit {
+				cursor = last
+				return nil
+			}
+
+			if err := fn(msg); err != nil {
+				return err
+			}
+			n++
+			last = suffix
+		}
+		return nil
+	})
+	if err == ErrStopQuery {
+		err = nil
+	}
+	return cursor, err
+}
+
+// QueryMessageLog calls fn with every cached message of a user that matches
+// q, oldest first, reading within a single transaction. If fn returns an
+// error the query stops, and the error is returned unless it is ErrStopQuery.
+// If the limit is reached before the end of the log, a cursor to continue
+// from is returned.
+func (s *Store) QueryMessageLog(q MessageQuery, fn func(msg *DiscordMessage) error) (string, error) {
+	r := indexRange{
+		prefix: logIndexPrefix(q.GuildID, q.UserID),
+		from:   padTime(q.After),
+		to:     padTime(q.Before),
+		limit:  q.Limit,
+		cursor: q.Cursor,
+	}
+	if len(q.ChannelIDs) > 0 {
+		r.filter = func(cid string) bool {
+			return slices.Contains(q.ChannelIDs, cid)
+		}
+	}
+	return s.queryIndex(q.GuildID, r, fn)
+}
+
+// QueryChannelLog calls fn with every cached message in a channel that
+// matches q, oldest first, like QueryMessageLog.
+func (s *Store) QueryChannelLog(q ChannelQuery, fn func(msg *DiscordMessage) error) (string, error) {
+	return s.queryIndex(q.GuildID, indexRange{
+		prefix: channelIndexPrefix(q.GuildID, q.ChannelID),
+		from:   padTime(q.After),
+		to:     padTime(q.Before),
+		limit:  q.Limit,
+		cursor: q.Cursor,
+	}, fn)
+}
+
+// indexVersionKey holds the version of the message log index
+const indexVersionKey = "meta:index_version"
+
+// indexVersion is the current version of the message indexes. In version 1
+// the user index was the only index, and its keys held the message timestamp
+// formatted as text, which does not sort.
+const indexVersion byte = 2
+
+// migrateIndex rewrites the user index entries of version 1 and adds the
+// channel and search indexes of their messages. It only runs once.
+func (s *Store) migrateIndex() error {
+	var migrated byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(indexVersionKey))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			if len(v) > 0 {
+				migrated = v[0]
+			}
+			return nil
+		})
+	})
+	if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	if migrated >= indexVersion {
+		return nil
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	n := 0
+	err = s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("index:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			// index:<gid>:<uid>:<timestamp>:<mid>, where the timestamp has
+			// colons of its own
+			parts := strings.Split(string(item.Key()), ":")
+			if len(parts) <= 4 {
+				continue
+			}
+			gid, uid, mid := parts[1], parts[2], parts[len(parts)-1]
+
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			// message:<gid>:<cid>:<mid>
+			messageKey := strings.Split(string(value), ":")
+			if len(messageKey) != 4 {
+				continue
+			}
+
+			for _, key := range [][]byte{logIndexKey(gid, uid, mid), channelIndexKey(gid, messageKey[2], mid)} {
+				entry := badger.NewEntry(key, value)
+				entry.ExpiresAt = item.ExpiresAt()
+				if err := wb.SetEntry(entry); err != nil {
+					return err
+				}
+			}
+			if err := wb.Delete(item.KeyCopy(nil)); err != nil {
+				return err
+			}
+			n++
+		}
+
+		prefix = []byte("message:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			// message:<gid>:<cid>:<mid>
+			parts := strings.Split(string(item.Key()), ":")
+			if len(parts) != 4 {
+				continue
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			msg, err := s.decodeMessage(parts[1], item.Key(), value)
+			if err != nil {
+				s.logger.Error("failed to read message", zap.String("key", string(item.Key())), zap.Error(err))
+				continue
+			}
+			entries, err := s.searchEntries(parts[1], parts[2], parts[3], messageTexts(msg), item.ExpiresAt())
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := wb.SetEntry(entry); err != nil {
+					return err
+				}
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(indexVersionKey), []byte{indexVersion})
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.Info("migrated message indexes", zap.Int("version", int(indexVersion)), zap.Int("migrated", n))
+	return nil
+}
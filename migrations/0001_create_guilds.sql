@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS guilds (
+    id             TEXT PRIMARY KEY,
+    msg_edit_log   TEXT NOT NULL DEFAULT '',
+    msg_delete_log TEXT NOT NULL DEFAULT '',
+    ban_log        TEXT NOT NULL DEFAULT '',
+    unban_log      TEXT NOT NULL DEFAULT '',
+    join_log       TEXT NOT NULL DEFAULT '',
+    leave_log      TEXT NOT NULL DEFAULT ''
+);
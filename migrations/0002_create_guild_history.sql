@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS guild_history (
+    guild_id   TEXT NOT NULL REFERENCES guilds (id) ON DELETE CASCADE,
+    version    INTEGER NOT NULL,
+    field      TEXT NOT NULL,
+    actor_id   TEXT NOT NULL DEFAULT '',
+    old_value  TEXT NOT NULL,
+    new_value  TEXT NOT NULL,
+    changed_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (guild_id, version, field)
+);
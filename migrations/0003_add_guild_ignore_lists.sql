@@ -0,0 +1,4 @@
+ALTER TABLE guilds ADD COLUMN ignored_channels TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE guilds ADD COLUMN ignored_categories TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE guilds ADD COLUMN ignored_users TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE guilds ADD COLUMN ignored_roles TEXT NOT NULL DEFAULT '[]';
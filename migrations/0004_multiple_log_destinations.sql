@@ -0,0 +1,7 @@
+UPDATE guilds SET
+    msg_edit_log   = CASE WHEN msg_edit_log = '' THEN '[]' ELSE '["' || msg_edit_log || '"]' END,
+    msg_delete_log = CASE WHEN msg_delete_log = '' THEN '[]' ELSE '["' || msg_delete_log || '"]' END,
+    ban_log        = CASE WHEN ban_log = '' THEN '[]' ELSE '["' || ban_log || '"]' END,
+    unban_log      = CASE WHEN unban_log = '' THEN '[]' ELSE '["' || unban_log || '"]' END,
+    join_log       = CASE WHEN join_log = '' THEN '[]' ELSE '["' || join_log || '"]' END,
+    leave_log      = CASE WHEN leave_log = '' THEN '[]' ELSE '["' || leave_log || '"]' END;
@@ -0,0 +1 @@
+ALTER TABLE guilds ADD COLUMN log_webhooks TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1 @@
+ALTER TABLE guilds ADD COLUMN message_retention_hours INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE guilds ADD COLUMN role_log TEXT NOT NULL DEFAULT '[]';
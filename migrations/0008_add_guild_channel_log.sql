@@ -0,0 +1 @@
+ALTER TABLE guilds ADD COLUMN channel_log TEXT NOT NULL DEFAULT '[]';
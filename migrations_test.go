@@ -0,0 +1,84 @@
+package stare
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+func TestMigrateLogDestinations(t *testing.T) {
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	// every connection to :memory: opens a new database
+	conn.SetMaxOpenConns(1)
+	defer conn.Close()
+	db := &SqlDB{conn: conn, driver: "sqlite3", log: zap.NewNop()}
+
+	// log channels were stored as a single ID, or '' if unset, before 0004
+	if err := db.migrateTo(3); err != nil {
+		t.Fatalf("migrateTo() error = %v", err)
+	}
+	rows := []struct {
+		id, edit, del, ban, unban, join, leave string
+	}{
+		{"1", "10", "11", "12", "13", "14", "15"},
+		{"2", "", "", "", "", "", ""},
+		{"3", "10", "", "10", "", "20", ""},
+	}
+	for _, r := range rows {
+		_, err := conn.Exec(`INSERT INTO guilds (id, msg_edit_log, msg_delete_log, ban_log, unban_log, join_log, leave_log, ignored_channels)
+			VALUES (?, ?, ?, ?, ?, ?, ?, '["30"]')`, r.id, r.edit, r.del, r.ban, r.unban, r.join, r.leave)
+		if err != nil {
+			t.Fatalf("Exec() error = %v", err)
+		}
+	}
+
+	if err := db.migrate(); err != nil {
+		t.Fatalf("migrate() error = %v", err)
+	}
+
+	list := func(ids ...string) StringList { return ids }
+	tests := []struct {
+		id                                 string
+		edit, del, ban, unban, join, leave StringList
+	}{
+		{"1", list("10"), list("11"), list("12"), list("13"), list("14"), list("15")},
+		{"2", nil, nil, nil, nil, nil, nil},
+		{"3", list("10"), nil, list("10"), nil, list("20"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			gc, err := db.GetGuild(tt.id)
+			if err != nil {
+				t.Fatalf("GetGuild() error = %v", err)
+			}
+			got := []StringList{gc.MsgEditLog, gc.MsgDeleteLog, gc.BanLog, gc.UnbanLog, gc.JoinLog, gc.LeaveLog}
+			want := []StringList{tt.edit, tt.del, tt.ban, tt.unban, tt.join, tt.leave}
+			for i := range got {
+				if !slices.Equal(got[i], want[i]) {
+					t.Errorf("GetGuild() log channels = %q, want %q", got, want)
+					break
+				}
+			}
+			if len(gc.RoleLog) != 0 || len(gc.ChannelLog) != 0 || len(gc.LogWebhooks) != 0 {
+				t.Errorf("GetGuild() = %+v, want no role or channel logs and no webhooks", gc)
+			}
+			if !slices.Equal(gc.IgnoredChannels, list("30")) {
+				t.Errorf("GetGuild() ignored channels = %q, want %q", gc.IgnoredChannels, list("30"))
+			}
+		})
+	}
+
+	// the migrated lists are stored as JSON arrays
+	var stored string
+	if err := conn.Get(&stored, "SELECT join_log FROM guilds WHERE id = '3'"); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if stored != `["20"]` {
+		t.Errorf("join_log = %q, want %q", stored, `["20"]`)
+	}
+}
@@ -0,0 +1,204 @@
+package stare
+
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// permissionNames are the names of permission bits, in the order Discord lists
+// them.
+var permissionNames = []struct {
+	bit  int64
+	name string
+}{
+	{discordgo.PermissionAdministrator, "Administrator"},
+	{discordgo.PermissionViewChannel, "View Channels"},
+	{discordgo.PermissionManageChannels, "Manage Channels"},
+	{discordgo.PermissionManageRoles, "Manage Roles"},
+	{discordgo.PermissionManageEmojis, "Manage Expressions"},
+	{discordgo.PermissionViewAuditLogs, "View Audit Log"},
+	{discordgo.PermissionViewGuildInsights, "View Server Insights"},
+	{discordgo.PermissionManageWebhooks, "Manage Webhooks"},
+	{discordgo.PermissionManageServer, "Manage Server"},
+	{discordgo.PermissionCreateInstantInvite, "Create Invite"},
+	{discordgo.PermissionChangeNickname, "Change Nickname"},
+	{discordgo.PermissionManageNicknames, "Manage Nicknames"},
+	{discordgo.PermissionKickMembers, "Kick Members"},
+	{discordgo.PermissionBanMembers, "Ban Members"},
+	{discordgo.PermissionModerateMembers, "Timeout Members"},
+	{discordgo.PermissionSendMessages, "Send Messages"},
+	{discordgo.PermissionSendMessagesInThreads, "Send Messages in Threads"},
+	{discordgo.PermissionCreatePublicThreads, "Create Public Threads"},
+	{discordgo.PermissionCreatePrivateThreads, "Create Private Threads"},
+	{discordgo.PermissionEmbedLinks, "Embed Links"},
+	{discordgo.PermissionAttachFiles, "Attach Files"},
+	{discordgo.PermissionAddReactions, "Add Reactions"},
+	{discordgo.PermissionUseExternalEmojis, "Use External Emoji"},
+	{discordgo.PermissionUseExternalStickers, "Use External Stickers"},
+	{discordgo.PermissionMentionEveryone, "Mention Everyone"},
+	{discordgo.PermissionManageMessages, "Manage Messages"},
+	{discordgo.PermissionManageThreads, "Manage Threads"},
+	{discordgo.PermissionReadMessageHistory, "Read Message History"},
+	{discordgo.PermissionSendTTSMessages, "Send Text-to-Speech Messages"},
+	{discordgo.PermissionUseSlashCommands, "Use Application Commands"},
+	{discordgo.PermissionVoiceConnect, "Connect"},
+	{discordgo.PermissionVoiceSpeak, "Speak"},
+	{discordgo.PermissionVoiceStreamVideo, "Video"},
+	{discordgo.PermissionUseActivities, "Use Activities"},
+	{discordgo.PermissionVoiceUseVAD, "Use Voice Activity"},
+	{discordgo.PermissionVoicePrioritySpeaker, "Priority Speaker"},
+	{discordgo.PermissionVoiceMuteMembers, "Mute Members"},
+	{discordgo.PermissionVoiceDeafenMembers, "Deafen Members"},
+	{discordgo.PermissionVoiceMoveMembers, "Move Members"},
+	{discordgo.PermissionVoiceRequestToSpeak, "Request to Speak"},
+	{discordgo.PermissionManageEvents, "Manage Events"},
+}
+
+// permissionBits returns the bits set in perms, named bits first in the order
+// Discord lists them.
+func permissionBits(perms int64) []int64 {
+	var list []int64
+	for _, p := range permissionNames {
+		if perms&p.bit != 0 {
+			list = append(list, p.bit)
+			perms &^= p.bit
+		}
+	}
+	for perms != 0 {
+		bit := int64(1) << bits.TrailingZeros64(uint64(perms))
+		list = append(list, bit)
+		perms &^= bit
+	}
+	return list
+}
+
+// permissionName returns the name of a permission bit. Bits without a name
+// are named by their number.
+func permissionName(bit int64) string {
+	for _, p := range permissionNames {
+		if p.bit == bit {
+			return p.name
+		}
+	}
+	return fmt.Sprintf("Permission 1<<%v", bits.TrailingZeros64(uint64(bit)))
+}
+
+// permissionList returns the names of the permissions in perms.
+func permissionList(perms int64) []string {
+	var names []string
+	for _, bit := range permissionBits(perms) {
+		names = append(names, permissionName(bit))
+	}
+	return names
+}
+
+// formatPermissions returns the names of the permissions in perms as text.
+func formatPermissions(perms int64) string {
+	if perms == 0 {
+		return "None"
+	}
+	return strings.Join(permissionList(perms), ", ")
+}
+
+// formatPermissionDiff describes the permissions added and removed between old
+// and new, one change per line, or "" if they are the same.
+func formatPermissionDiff(old, new int64) string {
+	text := strings.Builder{}
+	for _, name := range permissionList(new &^ old) {
+		text.WriteString("+ " + name + "\n")
+	}
+	for _, name := range permissionList(old &^ new) {
+		text.WriteString("- " + name + "\n")
+	}
+	return text.String()
+}
+
+// overwriteTarget returns a mention of the role or member a permission
+// overwrite applies to.
+func overwriteTarget(gid string, o *discordgo.PermissionOverwrite) string {
+	switch {
+	case o.Type == discordgo.PermissionOverwriteTypeMember:
+		return fmt.Sprintf("<@%v>", o.ID)
+	case o.ID == gid:
+		return "@everyone"
+	default:
+		return fmt.Sprintf("<@&%v>", o.ID)
+	}
+}
+
+// formatOverwrites describes the permission overwrites of a channel, one role
+// or member per line.
+func formatOverwrites(gid string, overwrites []*discordgo.PermissionOverwrite) string {
+	if len(overwrites) == 0 {
+		return "None"
+	}
+	text := strings.Builder{}
+	for _, o := range overwrites {
+		fmt.Fprintf(&text, "%v: allow %v; deny %v\n", overwriteTarget(gid, o), formatPermissions(o.Allow), formatPermissions(o.Deny))
+	}
+	return text.String()
+}
+
+// overwriteState returns whether an overwrite allows, denies or inherits a
+// permission. o may be nil.
+func overwriteState(o *discordgo.PermissionOverwrite, bit int64) string {
+	switch {
+	case o == nil:
+		return "Inherit"
+	case o.Allow&bit != 0:
+		return "Allow"
+	case o.Deny&bit != 0:
+		return "Deny"
+	default:
+		return "Inherit"
+	}
+}
+
+// formatOverwriteDiff describes how the permission overwrites of a channel
+// changed, per role and member, or returns "" if they are the same.
+func formatOverwriteDiff(gid string, old, new []*discordgo.PermissionOverwrite) string {
+	find := func(list []*discordgo.PermissionOverwrite, id string) *discordgo.PermissionOverwrite {
+		for _, o := range list {
+			if o.ID == id {
+				return o
+			}
+		}
+		return nil
+	}
+
+	text := strings.Builder{}
+	seen := make(map[string]bool)
+	for _, o := range append(slices.Clone(old), new...) {
+		if seen[o.ID] {
+			continue
+		}
+		seen[o.ID] = true
+
+		before, after := find(old, o.ID), find(new, o.ID)
+		var changed int64
+		status := ""
+		switch {
+		case before == nil:
+			changed = after.Allow | after.Deny
+			status = " (added)"
+		case after == nil:
+			changed = before.Allow | before.Deny
+			status = " (removed)"
+		default:
+			changed = (before.Allow ^ after.Allow) | (before.Deny ^ after.Deny)
+			if changed == 0 {
+				continue
+			}
+		}
+
+		fmt.Fprintf(&text, "%v%v\n", overwriteTarget(gid, o), status)
+		for _, bit := range permissionBits(changed) {
+			fmt.Fprintf(&text, "- %v: %v → %v\n", permissionName(bit), overwriteState(before, bit), overwriteState(after, bit))
+		}
+	}
+	return text.String()
+}
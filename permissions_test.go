@@ -0,0 +1,88 @@
+package stare
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestFormatPermissionDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new int64
+		want     string
+	}{
+		{"Same", discordgo.PermissionBanMembers, discordgo.PermissionBanMembers, ""},
+		{"Added", 0, discordgo.PermissionBanMembers | discordgo.PermissionAdministrator, "+ Administrator\n+ Ban Members\n"},
+		{"Removed", discordgo.PermissionKickMembers, 0, "- Kick Members\n"},
+		{"Both", discordgo.PermissionKickMembers, discordgo.PermissionBanMembers, "+ Ban Members\n- Kick Members\n"},
+		{"Unnamed", 0, 1 << 60, "+ Permission 1<<60\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatPermissionDiff(tt.old, tt.new); got != tt.want {
+				t.Errorf("formatPermissionDiff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatOverwriteDiff(t *testing.T) {
+	const gid = "1"
+	everyone := func(allow, deny int64) *discordgo.PermissionOverwrite {
+		return &discordgo.PermissionOverwrite{ID: gid, Type: discordgo.PermissionOverwriteTypeRole, Allow: allow, Deny: deny}
+	}
+	member := func(allow, deny int64) *discordgo.PermissionOverwrite {
+		return &discordgo.PermissionOverwrite{ID: "100", Type: discordgo.PermissionOverwriteTypeMember, Allow: allow, Deny: deny}
+	}
+	role := func(allow, deny int64) *discordgo.PermissionOverwrite {
+		return &discordgo.PermissionOverwrite{ID: "30", Type: discordgo.PermissionOverwriteTypeRole, Allow: allow, Deny: deny}
+	}
+	const send, view = discordgo.PermissionSendMessages, discordgo.PermissionViewChannel
+
+	tests := []struct {
+		name     string
+		old, new []*discordgo.PermissionOverwrite
+		want     string
+	}{
+		{
+			name: "Same",
+			old:  []*discordgo.PermissionOverwrite{everyone(0, send)},
+			new:  []*discordgo.PermissionOverwrite{everyone(0, send)},
+			want: "",
+		},
+		{
+			name: "Changed",
+			old:  []*discordgo.PermissionOverwrite{everyone(0, send)},
+			new:  []*discordgo.PermissionOverwrite{everyone(send, view)},
+			want: "@everyone\n- View Channels: Inherit → Deny\n- Send Messages: Deny → Allow\n",
+		},
+		{
+			name: "Added",
+			old:  nil,
+			new:  []*discordgo.PermissionOverwrite{member(send, 0)},
+			want: "<@100> (added)\n- Send Messages: Inherit → Allow\n",
+		},
+		{
+			name: "Removed",
+			old:  []*discordgo.PermissionOverwrite{role(0, view)},
+			new:  nil,
+			want: "<@&30> (removed)\n- View Channels: Deny → Inherit\n",
+		},
+		{
+			name: "OnlyChangedTargets",
+			old:  []*discordgo.PermissionOverwrite{everyone(0, send), role(view, 0)},
+			new:  []*discordgo.PermissionOverwrite{role(view, 0), everyone(0, 0)},
+			want: "@everyone\n- Send Messages: Deny → Inherit\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatOverwriteDiff(gid, tt.old, tt.new); got != tt.want {
+				t.Errorf("formatOverwriteDiff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package stare
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultPurgeGracePeriod is how long a guild's data is kept after the bot
+	// is removed from it, unless configured otherwise
+	defaultPurgeGracePeriod = 72 * time.Hour
+	// purgeCheckInterval is how often scheduled purges are checked
+	purgeCheckInterval = 10 * time.Minute
+)
+
+// purgeGracePeriod returns the configured time to wait after the bot is removed
+// from a guild before its data is purged.
+func (b *Bot) purgeGracePeriod() time.Duration {
+	str := b.config.GetString("purge_grace_period")
+	if str == "" {
+		return defaultPurgeGracePeriod
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d < 0 {
+		b.logger.Warn("invalid purge grace period, using default", zap.String("value", str))
+		return defaultPurgeGracePeriod
+	}
+	return d
+}
+
+// runPurges periodically purges the data of guilds whose grace period has
+// passed, until ctx is done.
+func (b *Bot) runPurges(ctx context.Context) {
+	ticker := time.NewTicker(purgeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		b.purgeDueGuilds()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *Bot) purgeDueGuilds() {
+	due, err := b.store.DuePurges(time.Now())
+	if err != nil {
+		b.logger.Error("failed to get scheduled purges", zap.Error(err))
+		return
+	}
+
+	for _, gid := range due {
+		// the bot may have been added back without the purge being cancelled
+		if _, err := b.Bot.Discord.Guild(gid); err == nil {
+			if err := b.store.CancelPurge(gid); err != nil {
+				b.logger.Error("failed to cancel purge", zap.String("guildID", gid), zap.Error(err))
+			}
+			continue
+		}
+
+		if err := b.purgeGuild(gid); err != nil {
+			b.logger.Error("failed to purge guild data", zap.String("guildID", gid), zap.Error(err))
+			continue
+		}
+		b.logger.Info("purged guild data", zap.String("guildID", gid))
+	}
+}
+
+// purgeGuild removes the settings and every piece of cached data of a guild.
+func (b *Bot) purgeGuild(gid string) error {
+	if err := b.db.DeleteGuild(gid); err != nil && !errors.Is(err, ErrGuildNotFound) {
+		return err
+	}
+	if err := b.store.DeleteGuildData(gid); err != nil {
+		return err
+	}
+	return b.store.CancelPurge(gid)
+}
@@ -0,0 +1,120 @@
+package stare
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestGuildDeleteHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		unavailable bool
+		scheduled   bool
+	}{
+		{"Outage", true, false},
+		{"Removed", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			b.config.Set("purge_grace_period", "1h")
+			s, _ := newTestSession(t)
+
+			guildDeleteHandler(b)(s, &discordgo.GuildDelete{Guild: &discordgo.Guild{ID: "2", Unavailable: tt.unavailable}})
+
+			due, err := b.store.DuePurges(time.Now().Add(time.Hour + time.Minute))
+			if err != nil {
+				t.Fatalf("DuePurges() error = %v", err)
+			}
+			if got := slices.Contains(due, "2"); got != tt.scheduled {
+				t.Errorf("DuePurges() = %v, want a purge scheduled = %v", due, tt.scheduled)
+			}
+			if due, _ := b.store.DuePurges(time.Now()); len(due) != 0 {
+				t.Errorf("DuePurges() = %v, want nothing due before the grace period", due)
+			}
+		})
+	}
+}
+
+func TestGuildCreateCancelsPurge(t *testing.T) {
+	b := newTestBot(t)
+	b.config.Set("purge_grace_period", "1h")
+	s, _ := newTestSession(t)
+
+	guildDeleteHandler(b)(s, &discordgo.GuildDelete{Guild: &discordgo.Guild{ID: "2"}})
+	guildCreateHandler(b)(s, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "2"}})
+
+	due, err := b.store.DuePurges(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("DuePurges() error = %v", err)
+	}
+	if len(due) != 0 {
+		t.Errorf("DuePurges() = %v, want the purge cancelled", due)
+	}
+}
+
+func TestPurgeDueGuilds(t *testing.T) {
+	b := newTestBot(t)
+	b.config.Set("purge_grace_period", "1h")
+	s, _ := newTestSession(t)
+
+	// guild 2 was removed, testGuildID was added back before its purge was
+	// cancelled
+	for _, gid := range []string{testGuildID, "2"} {
+		if gid != testGuildID {
+			if err := b.db.CreateGuild(gid); err != nil {
+				t.Fatalf("CreateGuild() error = %v", err)
+			}
+		}
+		if err := b.store.SetMember(&discordgo.Member{GuildID: gid, User: &discordgo.User{ID: "100"}}); err != nil {
+			t.Fatalf("SetMember() error = %v", err)
+		}
+		msg := testMessage(0, "10", "hello")
+		msg.GuildID = gid
+		if err := b.store.SetMessage(&DiscordMessage{Message: msg}, 24*time.Hour, 1024); err != nil {
+			t.Fatalf("SetMessage() error = %v", err)
+		}
+		guildDeleteHandler(b)(s, &discordgo.GuildDelete{Guild: &discordgo.Guild{ID: gid}})
+	}
+
+	kept := func(gid string) bool {
+		t.Helper()
+		_, errGuild := b.db.GetGuild(gid)
+		_, errMember := b.store.GetMember(gid, "100")
+		_, errMessage := b.store.GetMessage(gid, "10", testMessage(0, "10", "").ID)
+		if (errGuild == nil) != (errMember == nil) || (errMember == nil) != (errMessage == nil) {
+			t.Errorf("guild %v: GetGuild() error = %v, GetMember() error = %v, GetMessage() error = %v, want all or none of the data purged",
+				gid, errGuild, errMember, errMessage)
+		}
+		return errGuild == nil
+	}
+
+	// nothing is purged during the grace period
+	b.purgeDueGuilds()
+	for _, gid := range []string{testGuildID, "2"} {
+		if !kept(gid) {
+			t.Errorf("guild %v was purged during the grace period", gid)
+		}
+	}
+
+	// the grace period has passed
+	for _, gid := range []string{testGuildID, "2"} {
+		if err := b.store.SchedulePurge(gid, time.Now().Add(-time.Minute)); err != nil {
+			t.Fatalf("SchedulePurge() error = %v", err)
+		}
+	}
+	b.purgeDueGuilds()
+	if kept("2") {
+		t.Errorf("guild 2 was not purged after the grace period")
+	}
+	if !kept(testGuildID) {
+		t.Errorf("guild %v was purged, but the bot is in it", testGuildID)
+	}
+	if due, err := b.store.DuePurges(time.Now()); err != nil || len(due) != 0 {
+		t.Errorf("DuePurges() = %v, %v, want no purges left", due, err)
+	}
+}
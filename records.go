@@ -0,0 +1,455 @@
+package stare
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dgraph-io/badger"
+	"go.uber.org/zap"
+)
+
+// Members, roles, channels and messages are persisted as our own record types
+// rather than the discordgo types, so that upgrading discordgo cannot make
+// stored data undecodable. A record is laid out as:
+//
+//	recordMagic | version | JSON encoded record
+//
+// Version 0 is the legacy format, a gob encoded discordgo.Member or
+// DiscordMessage without a header. A gob stream never starts with recordMagic.
+// Older versions are still decoded, and rewritten to the current one by
+// migrateRecords.
+
+const (
+	recordMagic byte = 0xa5
+	// recordVersion is the version new records are written with
+	recordVersion byte = 1
+)
+
+var errUnknownRecordVersion = errors.New("unknown record version")
+
+// recordHeader returns the version of an encoded record, and its payload.
+func recordHeader(data []byte) (byte, []byte) {
+	if len(data) < 2 || data[0] != recordMagic {
+		return 0, data
+	}
+	return data[1], data[2:]
+}
+
+func encodeRecord(v any) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{recordMagic, recordVersion}, payload...), nil
+}
+
+type userRecord struct {
+	ID            string `json:"id"`
+	Username      string `json:"u"`
+	Discriminator string `json:"d,omitempty"`
+	GlobalName    string `json:"gn,omitempty"`
+	Avatar        string `json:"a,omitempty"`
+	Bot           bool   `json:"b,omitempty"`
+}
+
+func newUserRecord(u *discordgo.User) userRecord {
+	if u == nil {
+		return userRecord{}
+	}
+	return userRecord{
+		ID:            u.ID,
+		Username:      u.Username,
+		Discriminator: u.Discriminator,
+		GlobalName:    u.GlobalName,
+		Avatar:        u.Avatar,
+		Bot:           u.Bot,
+	}
+}
+
+func (r userRecord) user() *discordgo.User {
+	return &discordgo.User{
+		ID:            r.ID,
+		Username:      r.Username,
+		Discriminator: r.Discriminator,
+		GlobalName:    r.GlobalName,
+		Avatar:        r.Avatar,
+		Bot:           r.Bot,
+	}
+}
+
+//
+// Members
+//
+
+type memberRecord struct {
+	GuildID  string     `json:"g"`
+	User     userRecord `json:"u"`
+	Nick     string     `json:"n,omitempty"`
+	Avatar   string     `json:"a,omitempty"`
+	Roles    []string   `json:"r,omitempty"`
+	JoinedAt time.Time  `json:"j"`
+}
+
+func encodeMember(m *discordgo.Member) ([]byte, error) {
+	return encodeRecord(&memberRecord{
+		GuildID:  m.GuildID,
+		User:     newUserRecord(m.User),
+		Nick:     m.Nick,
+		Avatar:   m.Avatar,
+		Roles:    m.Roles,
+		JoinedAt: m.JoinedAt,
+	})
+}
+
+func decodeMember(data []byte) (*discordgo.Member, error) {
+	version, payload := recordHeader(data)
+	switch version {
+	case 0:
+		var m discordgo.Member
+		if err := decodeGob(payload, &m); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	case 1:
+		var r memberRecord
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return nil, err
+		}
+		return &discordgo.Member{
+			GuildID:  r.GuildID,
+			User:     r.User.user(),
+			Nick:     r.Nick,
+			Avatar:   r.Avatar,
+			Roles:    r.Roles,
+			JoinedAt: r.JoinedAt,
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w %v", errUnknownRecordVersion, version)
+	}
+}
+
+//
+// Roles
+//
+
+type roleRecord struct {
+	ID          string `json:"id"`
+	Name        string `json:"n"`
+	Color       int    `json:"c,omitempty"`
+	Hoist       bool   `json:"h,omitempty"`
+	Mentionable bool   `json:"m,omitempty"`
+	Managed     bool   `json:"mg,omitempty"`
+	Position    int    `json:"p,omitempty"`
+	Permissions int64  `json:"pm,string"`
+}
+
+func encodeRole(r *discordgo.Role) ([]byte, error) {
+	return encodeRecord(&roleRecord{
+		ID:          r.ID,
+		Name:        r.Name,
+		Color:       r.Color,
+		Hoist:       r.Hoist,
+		Mentionable: r.Mentionable,
+		Managed:     r.Managed,
+		Position:    r.Position,
+		Permissions: r.Permissions,
+	})
+}
+
+// decodeRole decodes a role record. Roles were first stored with version 1,
+// so there is no legacy format.
+func decodeRole(data []byte) (*discordgo.Role, error) {
+	version, payload := recordHeader(data)
+	if version != 1 {
+		return nil, fmt.Errorf("%w %v", errUnknownRecordVersion, version)
+	}
+	var r roleRecord
+	if err := json.Unmarshal(payload, &r); err != nil {
+		return nil, err
+	}
+	return &discordgo.Role{
+		ID:          r.ID,
+		Name:        r.Name,
+		Color:       r.Color,
+		Hoist:       r.Hoist,
+		Mentionable: r.Mentionable,
+		Managed:     r.Managed,
+		Position:    r.Position,
+		Permissions: r.Permissions,
+	}, nil
+}
+
+//
+// Channels
+//
+
+type channelRecord struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"n"`
+	Topic            string            `json:"t,omitempty"`
+	Type             int               `json:"ty"`
+	NSFW             bool              `json:"ns,omitempty"`
+	ParentID         string            `json:"p,omitempty"`
+	Position         int               `json:"ps,omitempty"`
+	RateLimitPerUser int               `json:"rl,omitempty"`
+	Overwrites       []overwriteRecord `json:"o,omitempty"`
+}
+
+type overwriteRecord struct {
+	ID    string `json:"id"`
+	Type  int    `json:"ty"`
+	Allow int64  `json:"a,string"`
+	Deny  int64  `json:"d,string"`
+}
+
+func encodeChannel(ch *discordgo.Channel) ([]byte, error) {
+	r := &channelRecord{
+		ID:               ch.ID,
+		Name:             ch.Name,
+		Topic:            ch.Topic,
+		Type:             int(ch.Type),
+		NSFW:             ch.NSFW,
+		ParentID:         ch.ParentID,
+		Position:         ch.Position,
+		RateLimitPerUser: ch.RateLimitPerUser,
+	}
+	for _, o := range ch.PermissionOverwrites {
+		r.Overwrites = append(r.Overwrites, overwriteRecord{
+			ID:    o.ID,
+			Type:  int(o.Type),
+			Allow: o.Allow,
+			Deny:  o.Deny,
+		})
+	}
+	return encodeRecord(r)
+}
+
+// decodeChannel decodes a channel record. Channels were first stored with
+// version 1, so there is no legacy format.
+func decodeChannel(gid string, data []byte) (*discordgo.Channel, error) {
+	version, payload := recordHeader(data)
+	if version != 1 {
+		return nil, fmt.Errorf("%w %v", errUnknownRecordVersion, version)
+	}
+	var r channelRecord
+	if err := json.Unmarshal(payload, &r); err != nil {
+		return nil, err
+	}
+	ch := &discordgo.Channel{
+		ID:               r.ID,
+		GuildID:          gid,
+		Name:             r.Name,
+		Topic:            r.Topic,
+		Type:             discordgo.ChannelType(r.Type),
+		NSFW:             r.NSFW,
+		ParentID:         r.ParentID,
+		Position:         r.Position,
+		RateLimitPerUser: r.RateLimitPerUser,
+	}
+	for _, o := range r.Overwrites {
+		ch.PermissionOverwrites = append(ch.PermissionOverwrites, &discordgo.PermissionOverwrite{
+			ID:    o.ID,
+			Type:  discordgo.PermissionOverwriteType(o.Type),
+			Allow: o.Allow,
+			Deny:  o.Deny,
+		})
+	}
+	return ch, nil
+}
+
+//
+// Messages
+//
+
+type messageRecord struct {
+	ID          string             `json:"id"`
+	ChannelID   string             `json:"c"`
+	GuildID     string             `json:"g"`
+	Author      userRecord         `json:"u"`
+	Content     string             `json:"t,omitempty"`
+	Timestamp   time.Time          `json:"ts"`
+	Attachments []attachmentRecord `json:"at,omitempty"`
+	Revisions   []revisionRecord   `json:"rv,omitempty"`
+}
+
+type attachmentRecord struct {
+	Filename string `json:"f"`
+	Size     int    `json:"s"`
+	Hash     string `json:"h,omitempty"`
+	// Data is only set for attachments that are not stored separately
+	Data []byte `json:"d,omitempty"`
+}
+
+type revisionRecord struct {
+	Content   string    `json:"t"`
+	Timestamp time.Time `json:"ts"`
+}
+
+func encodeMessage(msg *DiscordMessage) ([]byte, error) {
+	m := msg.Message
+	r := &messageRecord{
+		ID:        m.ID,
+		ChannelID: m.ChannelID,
+		GuildID:   m.GuildID,
+		Author:    newUserRecord(m.Author),
+		Content:   m.Content,
+		Timestamp: m.Timestamp,
+	}
+	for _, a := range msg.Attachments {
+		r.Attachments = append(r.Attachments, attachmentRecord{
+			Filename: a.Filename,
+			Size:     a.Size,
+			Hash:     a.Hash,
+			Data:     a.Data,
+		})
+	}
+	for _, rev := range msg.Revisions {
+		r.Revisions = append(r.Revisions, revisionRecord{
+			Content:   rev.Content,
+			Timestamp: rev.Timestamp,
+		})
+	}
+	return encodeRecord(r)
+}
+
+func decodeMessage(data []byte) (*DiscordMessage, error) {
+	version, payload := recordHeader(data)
+	switch version {
+	case 0:
+		var msg DiscordMessage
+		if err := decodeGob(payload, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	case 1:
+		var r messageRecord
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return nil, err
+		}
+		msg := &DiscordMessage{
+			Message: &discordgo.Message{
+				ID:        r.ID,
+				ChannelID: r.ChannelID,
+				GuildID:   r.GuildID,
+				Author:    r.Author.user(),
+				Content:   r.Content,
+				Timestamp: r.Timestamp,
+			},
+			Attachments: []*Attachment{},
+		}
+		for _, a := range r.Attachments {
+			msg.Attachments = append(msg.Attachments, &Attachment{
+				Filename: a.Filename,
+				Size:     a.Size,
+				Hash:     a.Hash,
+				Data:     a.Data,
+			})
+		}
+		for _, rev := range r.Revisions {
+			msg.Revisions = append(msg.Revisions, &MessageRevision{
+				Content:   rev.Content,
+				Timestamp: rev.Timestamp,
+			})
+		}
+		return msg, nil
+	default:
+		return nil, fmt.Errorf("%w %v", errUnknownRecordVersion, version)
+	}
+}
+
+// upgradeRecord decodes a stored member or message record of any version,
+// depending on its key, and encodes it with the current version. ok is false
+// if the record already has the current version.
+func upgradeRecord(key string, data []byte) (upgraded []byte, ok bool, err error) {
+	if version, _ := recordHeader(data); version == recordVersion {
+		return nil, false, nil
+	}
+
+	switch {
+	case strings.HasPrefix(key, "member:"):
+		m, err := decodeMember(data)
+		if err != nil {
+			return nil, false, err
+		}
+		upgraded, err = encodeMember(m)
+		return upgraded, err == nil, err
+	case strings.HasPrefix(key, "message:"):
+		msg, err := decodeMessage(data)
+		if err != nil {
+			return nil, false, err
+		}
+		upgraded, err = encodeMessage(msg)
+		return upgraded, err == nil, err
+	default:
+		return nil, false, fmt.Errorf("no record type for key %q", key)
+	}
+}
+
+// recordVersionKey holds the version every stored record has been migrated to
+const recordVersionKey = "meta:record_version"
+
+// migrateRecords rewrites stored records of older versions with the current
+// version. It only runs once per version. Records that cannot be decoded are
+// left as they are, and expire like any other.
+func (s *Store) migrateRecords() error {
+	var migrated byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(recordVersionKey))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			if len(v) > 0 {
+				migrated = v[0]
+			}
+			return nil
+		})
+	})
+	if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	if migrated >= recordVersion {
+		return nil
+	}
+
+	total, failed := 0, 0
+	for _, prefix := range []string{"member:", "message:"} {
+		n, err := s.rewriteValues([]byte(prefix), func(gid string, key, value []byte) ([]byte, error) {
+			plain, err := s.open(gid, key, value)
+			if err != nil {
+				return nil, err
+			}
+			upgraded, ok, err := upgradeRecord(string(key), plain)
+			if err != nil {
+				s.logger.Warn("failed to migrate record", zap.String("key", string(key)), zap.Error(err))
+				failed++
+				return nil, nil
+			}
+			if !ok {
+				return nil, nil
+			}
+			return s.seal(gid, key, upgraded)
+		})
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+
+	err = s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(recordVersionKey), []byte{recordVersion})
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.Info("migrated stored records",
+		zap.Int("version", int(recordVersion)),
+		zap.Int("migrated", total),
+		zap.Int("failed", failed),
+	)
+	return nil
+}
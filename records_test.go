@@ -0,0 +1,204 @@
+package stare
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func encodeGobForTest(t *testing.T, v any) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		t.Fatalf("gob Encode() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestMemberRecord(t *testing.T) {
+	joined := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	member := &discordgo.Member{
+		GuildID:  "1",
+		User:     &discordgo.User{ID: "100", Username: "user", GlobalName: "User", Avatar: "abc", Bot: true},
+		Nick:     "nick",
+		Roles:    []string{"30", "31"},
+		JoinedAt: joined,
+	}
+
+	tests := []struct {
+		name   string
+		encode func(t *testing.T) []byte
+	}{
+		{"Current", func(t *testing.T) []byte {
+			data, err := encodeMember(member)
+			if err != nil {
+				t.Fatalf("encodeMember() error = %v", err)
+			}
+			return data
+		}},
+		{"LegacyGob", func(t *testing.T) []byte {
+			return encodeGobForTest(t, member)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.encode(t)
+			got, err := decodeMember(data)
+			if err != nil {
+				t.Fatalf("decodeMember() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, member) {
+				t.Errorf("decodeMember() = %+v, want %+v", got, member)
+			}
+
+			upgraded, ok, err := upgradeRecord("member:1:100", data)
+			if err != nil {
+				t.Fatalf("upgradeRecord() error = %v", err)
+			}
+			if version, _ := recordHeader(data); ok != (version != recordVersion) {
+				t.Errorf("upgradeRecord() ok = %v, want records of older versions upgraded", ok)
+			}
+			if ok {
+				if version, _ := recordHeader(upgraded); version != recordVersion {
+					t.Errorf("upgradeRecord() version = %v, want %v", version, recordVersion)
+				}
+				if got, err := decodeMember(upgraded); err != nil || !reflect.DeepEqual(got, member) {
+					t.Errorf("decodeMember(upgraded) = %+v, %v, want %+v", got, err, member)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageRecord(t *testing.T) {
+	sent := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg := &DiscordMessage{
+		Message: &discordgo.Message{
+			ID:        "1000",
+			ChannelID: "10",
+			GuildID:   "1",
+			Author:    &discordgo.User{ID: "100", Username: "user"},
+			Content:   "second",
+			Timestamp: sent,
+		},
+		Attachments: []*Attachment{
+			{Filename: "a.txt", Size: 4, Hash: hashAttachment([]byte("data"))},
+			{Filename: "b.txt", Size: 5, Data: []byte("inline")},
+		},
+		Revisions: []*MessageRevision{
+			{Content: "first", Timestamp: sent},
+			{Content: "second", Timestamp: sent.Add(time.Minute)},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		encode func(t *testing.T) []byte
+	}{
+		{"Current", func(t *testing.T) []byte {
+			data, err := encodeMessage(msg)
+			if err != nil {
+				t.Fatalf("encodeMessage() error = %v", err)
+			}
+			return data
+		}},
+		{"LegacyGob", func(t *testing.T) []byte {
+			return encodeGobForTest(t, msg)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.encode(t)
+			got, err := decodeMessage(data)
+			if err != nil {
+				t.Fatalf("decodeMessage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, msg) {
+				t.Errorf("decodeMessage() = %+v, want %+v", got, msg)
+			}
+
+			upgraded, ok, err := upgradeRecord("message:1:10:1000", data)
+			if err != nil {
+				t.Fatalf("upgradeRecord() error = %v", err)
+			}
+			if ok {
+				if got, err := decodeMessage(upgraded); err != nil || !reflect.DeepEqual(got, msg) {
+					t.Errorf("decodeMessage(upgraded) = %+v, %v, want %+v", got, err, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestRoleRecord(t *testing.T) {
+	role := &discordgo.Role{
+		ID:          "30",
+		Name:        "mods",
+		Color:       0xff0000,
+		Hoist:       true,
+		Mentionable: true,
+		Position:    3,
+		Permissions: discordgo.PermissionBanMembers | discordgo.PermissionKickMembers,
+	}
+
+	data, err := encodeRole(role)
+	if err != nil {
+		t.Fatalf("encodeRole() error = %v", err)
+	}
+	if got, err := decodeRole(data); err != nil || !reflect.DeepEqual(got, role) {
+		t.Errorf("decodeRole() = %+v, %v, want %+v", got, err, role)
+	}
+}
+
+func TestChannelRecord(t *testing.T) {
+	channel := &discordgo.Channel{
+		ID:               "10",
+		GuildID:          "1",
+		Name:             "general",
+		Topic:            "talk",
+		Type:             discordgo.ChannelTypeGuildText,
+		NSFW:             true,
+		ParentID:         "5",
+		Position:         2,
+		RateLimitPerUser: 30,
+		PermissionOverwrites: []*discordgo.PermissionOverwrite{
+			{ID: "1", Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionSendMessages},
+			{ID: "100", Type: discordgo.PermissionOverwriteTypeMember, Allow: discordgo.PermissionSendMessages},
+		},
+	}
+
+	data, err := encodeChannel(channel)
+	if err != nil {
+		t.Fatalf("encodeChannel() error = %v", err)
+	}
+	if got, err := decodeChannel("1", data); err != nil || !reflect.DeepEqual(got, channel) {
+		t.Errorf("decodeChannel() = %+v, %v, want %+v", got, err, channel)
+	}
+}
+
+func TestDecodeUnknownRecordVersion(t *testing.T) {
+	data := []byte{recordMagic, recordVersion + 1, '{', '}'}
+	decoders := []struct {
+		name   string
+		decode func([]byte) error
+	}{
+		{"Member", func(data []byte) error { _, err := decodeMember(data); return err }},
+		{"Role", func(data []byte) error { _, err := decodeRole(data); return err }},
+		{"Channel", func(data []byte) error { _, err := decodeChannel("1", data); return err }},
+		{"Message", func(data []byte) error { _, err := decodeMessage(data); return err }},
+	}
+	for _, d := range decoders {
+		t.Run(d.name, func(t *testing.T) {
+			if err := d.decode(data); !errors.Is(err, errUnknownRecordVersion) {
+				t.Errorf("decode error = %v, want %v", err, errUnknownRecordVersion)
+			}
+		})
+	}
+}
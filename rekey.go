@@ -0,0 +1,216 @@
+package stare
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+	"github.com/intrntsrfr/meido/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// RekeyResult holds what was re-encrypted by a rekey.
+type RekeyResult struct {
+	DataKeys int
+	Values   int
+	Blobs    int
+}
+
+// Rekey opens the store set in the config and re-encrypts it with the current
+// master key. The bot must not be running, as the store can only be opened
+// once.
+func Rekey(cfg *utils.Config, rotateDataKeys bool) (*RekeyResult, error) {
+	logger := newLogger("rekey")
+
+	blobs, err := newBlobStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if keyring == nil {
+		return nil, errors.New("no encryption key is configured")
+	}
+
+	s, err := NewStore(logger, storePath(cfg), blobs, keyring)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.Reencrypt(rotateDataKeys)
+}
+
+// Reencrypt encrypts every data key with the current master key, and every
+// persisted value and blob with the current data key of its scope, including
+// values written before encryption was enabled.
+// If rotateDataKeys is set, new data keys are created first and the old ones
+// are removed afterwards.
+func (s *Store) Reencrypt(rotateDataKeys bool) (*RekeyResult, error) {
+	if s.keyring == nil {
+		return nil, errors.New("no encryption key is configured")
+	}
+	res := &RekeyResult{}
+
+	oldKeys, scopes, err := s.dataKeyIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	if rotateDataKeys {
+		err := s.db.Update(func(txn *badger.Txn) error {
+			for _, scope := range scopes {
+				if err := s.newDataKey(txn, scope); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, scope := range scopes {
+		if _, err := s.scopeKeys(scope, true); err != nil {
+			return nil, err
+		}
+	}
+
+	// wrap every data key with the current master key
+	err = s.db.Update(func(txn *badger.Txn) error {
+		keys, _ := listDataKeys(txn)
+		for _, key := range keys {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			scope := dataKeyScope(key)
+			dek, err := s.keyring.open(scope, key, value)
+			if err != nil {
+				return err
+			}
+			wrapped, err := s.keyring.seal(scope, key, dek)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(key, wrapped); err != nil {
+				return err
+			}
+			res.DataKeys++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, prefix := range []string{"member:", "role:", "channel:", "message:", "ftskey:"} {
+		n, err := s.reencryptValues([]byte(prefix))
+		res.Values += n
+		if err != nil {
+			return res, err
+		}
+	}
+
+	var hashes []string
+	if err := s.blobs.Keys(func(hash string) error {
+		hashes = append(hashes, hash)
+		return nil
+	}); err != nil {
+		return res, err
+	}
+	for _, hash := range hashes {
+		data, err := s.blobs.Get(hash)
+		if err != nil {
+			return res, err
+		}
+		if err := s.blobs.Put(hash, data); err != nil {
+			return res, err
+		}
+		res.Blobs++
+	}
+
+	if rotateDataKeys {
+		err := s.db.Update(func(txn *badger.Txn) error {
+			for _, key := range oldKeys {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return res, err
+		}
+		for _, scope := range scopes {
+			s.forgetDataKeys(scope)
+		}
+	}
+
+	s.logger.Info("re-encrypted store",
+		zap.Int("dataKeys", res.DataKeys),
+		zap.Int("values", res.Values),
+		zap.Int("blobs", res.Blobs),
+	)
+	return res, nil
+}
+
+// reencryptValues re-encrypts every value under a prefix, keeping their
+// expiry.
+func (s *Store) reencryptValues(prefix []byte) (int, error) {
+	return s.rewriteValues(prefix, func(gid string, key, value []byte) ([]byte, error) {
+		plain, err := s.open(gid, key, value)
+		if err != nil {
+			return nil, err
+		}
+		return s.seal(gid, key, plain)
+	})
+}
+
+// dataKeyIDs returns the keys of every stored data key, and the scopes they
+// belong to.
+func (s *Store) dataKeyIDs() ([][]byte, []string, error) {
+	var keys [][]byte
+	var scopes []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		keys, scopes = listDataKeys(txn)
+		return nil
+	})
+	return keys, scopes, err
+}
+
+// listDataKeys returns the keys of the data keys visible to txn, and the
+// scopes they belong to.
+func listDataKeys(txn *badger.Txn) ([][]byte, []string) {
+	prefix := []byte("dek:")
+	var keys [][]byte
+	var scopes []string
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().KeyCopy(nil)
+		keys = append(keys, key)
+		scope := dataKeyScope(key)
+		if len(scopes) == 0 || scopes[len(scopes)-1] != scope {
+			scopes = append(scopes, scope)
+		}
+	}
+	return keys, scopes
+}
+
+// dataKeyScope returns the scope of a data key from its key, dek:<scope>:<id>.
+func dataKeyScope(key []byte) string {
+	parts := strings.Split(string(key), ":")
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,68 @@
+package stare
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/intrntsrfr/meido/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultMessageRetention is how long messages are cached for in guilds
+	// that have not configured it
+	defaultMessageRetention = 24 * time.Hour
+	// minMessageRetention is the shortest retention a guild can configure
+	minMessageRetention = time.Hour
+	// defaultMaxMessageRetention is the longest retention a guild can
+	// configure, unless the operator sets a different maximum
+	defaultMaxMessageRetention = 30 * 24 * time.Hour
+)
+
+// maxMessageRetention returns the longest retention guilds are allowed to
+// configure, as set by the operator. A maximum shorter than the minimum
+// retention is raised to it.
+func maxMessageRetention(cfg *utils.Config) time.Duration {
+	d, err := time.ParseDuration(cfg.GetString("max_message_retention"))
+	if err != nil {
+		return defaultMaxMessageRetention
+	}
+	return max(d, minMessageRetention)
+}
+
+// checkMaxMessageRetention warns about a maximum retention that is not used
+// as configured. It is checked once at startup, as the maximum is looked up
+// for every cached message.
+func (b *Bot) checkMaxMessageRetention() {
+	str := b.config.GetString("max_message_retention")
+	if str == "" {
+		return
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		b.logger.Warn("invalid max message retention, using default", zap.String("value", str))
+	} else if d < minMessageRetention {
+		b.logger.Warn("max message retention is shorter than the minimum, using the minimum",
+			zap.String("value", str), zap.Duration("minimum", minMessageRetention))
+	}
+}
+
+// messageRetention returns how long messages in a guild are cached for. gc may
+// be nil, in which case the default is used.
+func (b *Bot) messageRetention(gc *Guild) time.Duration {
+	d := defaultMessageRetention
+	if gc != nil && gc.MessageRetentionHours > 0 {
+		d = time.Duration(gc.MessageRetentionHours) * time.Hour
+	}
+	return min(max(d, minMessageRetention), maxMessageRetention(b.config))
+}
+
+// formatRetention formats a retention as days if it is a whole number of
+// days, and as hours otherwise.
+func formatRetention(d time.Duration) string {
+	hours := int(d.Hours())
+	if hours >= 24 && hours%24 == 0 {
+		return fmt.Sprintf("%vd", hours/24)
+	}
+	return fmt.Sprintf("%vh", hours)
+}
@@ -0,0 +1,48 @@
+package stare
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intrntsrfr/meido/pkg/utils"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMaxMessageRetention(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+		warn  bool
+	}{
+		{"Unset", "", defaultMaxMessageRetention, false},
+		{"Configured", "168h", 7 * 24 * time.Hour, false},
+		{"Minimum", "1h", minMessageRetention, false},
+		{"BelowMinimum", "30m", minMessageRetention, true},
+		{"Invalid", "a week", defaultMaxMessageRetention, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := utils.NewConfig()
+			cfg.Set("max_message_retention", tt.value)
+			if got := maxMessageRetention(cfg); got != tt.want {
+				t.Errorf("maxMessageRetention() = %v, want %v", got, tt.want)
+			}
+
+			core, logs := observer.New(zapcore.WarnLevel)
+			b := &Bot{config: cfg, logger: &ZapLogger{zap.New(core)}}
+			b.checkMaxMessageRetention()
+			if warned := logs.Len() > 0; warned != tt.warn {
+				t.Errorf("checkMaxMessageRetention() warned = %v, want %v", warned, tt.warn)
+			}
+
+			// guilds asking for more than the maximum get the maximum
+			if got := b.messageRetention(&Guild{MessageRetentionHours: 24 * 365}); got != tt.want {
+				t.Errorf("messageRetention() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
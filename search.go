@@ -0,0 +1,293 @@
+package stare
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/dgraph-io/badger"
+	"go.uber.org/zap"
+)
+
+// Cached messages are searchable through an inverted index of the words in
+// their content, including the content of earlier revisions:
+//
+//	fts:<gid>:<word>:<zero padded mid>   the value is the message key
+//	ftskey:<gid>:                        the guild's search key
+//
+// Words are stored as an HMAC with the guild's search key, which is encrypted
+// like any other value, so the index does not reveal message content. Index
+// entries expire with their message.
+
+// SearchQuery selects cached messages whose content has every word of a text.
+type SearchQuery struct {
+	GuildID string
+	Text    string
+	// AuthorID limits the messages to those sent by a user, if set
+	AuthorID string
+	// ChannelIDs limits the messages to those sent in these channels, if set
+	ChannelIDs []string
+	// After and Before limit the messages to those sent in the time range.
+	// Zero values leave the range open.
+	After  time.Time
+	Before time.Time
+	// Limit is the most messages to return, or 0 for no limit
+	Limit int
+	// Cursor continues a previous search after the last message it returned
+	Cursor string
+}
+
+// ErrNoSearchTerms is returned when a search text has no words that are
+// indexed.
+var ErrNoSearchTerms = errors.New("the search text has no words of at least 2 characters")
+
+const (
+	// minSearchWordLength and maxSearchWordLength are the lengths of the
+	// words that are indexed, in characters and bytes
+	minSearchWordLength = 2
+	maxSearchWordLength = 64
+	// maxSearchWords is the most words of a message that are indexed
+	maxSearchWords = 256
+)
+
+// searchWords returns the unique words of texts that are indexed, lowercased.
+func searchWords(texts ...string) []string {
+	var words []string
+	for _, text := range texts {
+		fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		for _, w := range fields {
+			if len([]rune(w)) < minSearchWordLength || len(w) > maxSearchWordLength || slices.Contains(words, w) {
+				continue
+			}
+			words = append(words, w)
+			if len(words) == maxSearchWords {
+				return words
+			}
+		}
+	}
+	return words
+}
+
+// messageTexts returns the content of a message and its earlier revisions.
+func messageTexts(msg *DiscordMessage) []string {
+	texts := []string{msg.Message.Content}
+	for _, rev := range msg.Revisions {
+		texts = append(texts, rev.Content)
+	}
+	return texts
+}
+
+// searchKeys caches the search key of each guild.
+type searchKeys struct {
+	sync.Mutex
+	keys map[string][]byte
+}
+
+func searchKeyKey(gid string) []byte {
+	return []byte("ftskey:" + gid + ":")
+}
+
+// searchKey returns the search key of a guild, creating it if it has none.
+func (s *Store) searchKey(gid string) ([]byte, error) {
+	s.searchKeys.Lock()
+	defer s.searchKeys.Unlock()
+	if key, ok := s.searchKeys.keys[gid]; ok {
+		return key, nil
+	}
+
+	var key []byte
+	var err error
+	for attempt := 0; attempt < maxConflictRetries; attempt++ {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(searchKeyKey(gid))
+			if err == nil {
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				key, err = s.open(gid, searchKeyKey(gid), value)
+				return err
+			}
+			if err != badger.ErrKeyNotFound {
+				return err
+			}
+
+			key = make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return err
+			}
+			sealed, err := s.seal(gid, searchKeyKey(gid), key)
+			if err != nil {
+				return err
+			}
+			return txn.Set(searchKeyKey(gid), sealed)
+		})
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.searchKeys.keys[gid] = key
+	return key, nil
+}
+
+func (s *Store) forgetSearchKey(gid string) {
+	s.searchKeys.Lock()
+	defer s.searchKeys.Unlock()
+	delete(s.searchKeys.keys, gid)
+}
+
+func searchPrefix(gid string, key []byte, word string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(word))
+	return []byte(fmt.Sprintf("fts:%v:%v:", gid, hex.EncodeToString(mac.Sum(nil)[:16])))
+}
+
+// searchEntries returns the index entries of the words in texts for a
+// message, which expire at expiresAt.
+func (s *Store) searchEntries(gid, cid, mid string, texts []string, expiresAt uint64) ([]*badger.Entry, error) {
+	words := searchWords(texts...)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	key, err := s.searchKey(gid)
+	if err != nil {
+		return nil, err
+	}
+
+	messageKey := []byte(fmt.Sprintf("message:%v:%v:%v", gid, cid, mid))
+	entries := make([]*badger.Entry, 0, len(words))
+	for _, w := range words {
+		entry := badger.NewEntry(append(searchPrefix(gid, key, w), padID(mid)...), messageKey)
+		entry.ExpiresAt = expiresAt
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// SearchMessages calls fn with every cached message that matches q, newest
+// first, reading within a single transaction. If fn returns an error the
+// search stops, and the error is returned unless it is ErrStopQuery. If the
+// limit is reached before the last match, a cursor to continue from is
+// returned.
+func (s *Store) SearchMessages(q SearchQuery, fn func(msg *DiscordMessage) error) (string, error) {
+	words := searchWords(q.Text)
+	if len(words) == 0 {
+		return "", ErrNoSearchTerms
+	}
+	key, err := s.searchKey(q.GuildID)
+	if err != nil {
+		return "", err
+	}
+
+	// the longest word is likely the least common one, so its entries are
+	// walked and the other words are looked up
+	sort.SliceStable(words, func(i, j int) bool {
+		return len(words[i]) > len(words[j])
+	})
+	prefixes := make([][]byte, len(words))
+	for i, w := range words {
+		prefixes[i] = searchPrefix(q.GuildID, key, w)
+	}
+	prefix := prefixes[0]
+
+	from, to := padTime(q.After), padTime(q.Before)
+	start := append(slices.Clone(prefix), 0xff)
+	if q.Cursor != "" {
+		start = append(slices.Clone(prefix), q.Cursor...)
+	} else if to != "" {
+		start = append(slices.Clone(prefix), to...)
+	}
+
+	var cursor, last string
+	n := 0
+	err = s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+	entries:
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			mid := string(item.Key()[len(prefix):])
+			if mid == q.Cursor || (to != "" && mid >= to) {
+				continue
+			}
+			if mid < from {
+				break
+			}
+
+			for _, p := range prefixes[1:] {
+				_, err := txn.Get(append(slices.Clone(p), mid...))
+				if err == badger.ErrKeyNotFound {
+					continue entries
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			messageKey, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			// message:<gid>:<cid>:<mid>
+			parts := strings.Split(string(messageKey), ":")
+			if len(parts) != 4 {
+				continue
+			}
+			if len(q.ChannelIDs) > 0 && !slices.Contains(q.ChannelIDs, parts[2]) {
+				continue
+			}
+
+			msgItem, err := txn.Get(messageKey)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			value, err := msgItem.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			msg, err := s.decodeMessage(q.GuildID, messageKey, value)
+			if err != nil {
+				s.logger.Error("failed to read message", zap.String("key", string(messageKey)), zap.Error(err))
+				continue
+			}
+			if q.AuthorID != "" && msg.Message.Author.ID != q.AuthorID {
+				continue
+			}
+
+			if q.Limit > 0 && n == q.Limit {
+				cursor = last
+				return nil
+			}
+			if err := fn(msg); err != nil {
+				return err
+			}
+			n++
+			last = mid
+		}
+		return nil
+	})
+	if err == ErrStopQuery {
+		err = nil
+	}
+	return cursor, err
+}
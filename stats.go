@@ -0,0 +1,317 @@
+package stare
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"go.uber.org/zap"
+)
+
+// Storage usage is counted per guild in memory, and updated as writes are
+// committed. Messages and attachments expire, so they are counted by the hour
+// they expire in, and an hour's count is dropped once it has passed. Counts
+// may include items that expired less than an hour ago.
+//
+// The counts are saved when the store is closed, and loaded and removed when
+// it is opened:
+//
+//	stats:<gid>        the usage of a guild
+//	meta:stats_saved   the usage was saved by the last close
+//
+// If the store was not closed cleanly, the counts are rebuilt by scanning the
+// store once.
+
+// GuildStorage is the storage used by a guild.
+type GuildStorage struct {
+	GuildID         string
+	Members         int64
+	Messages        int64
+	AttachmentBytes int64
+}
+
+const statsSavedKey = "meta:stats_saved"
+
+// guildUsage holds the counts of a guild. messages and attachmentBytes are
+// keyed by the unix time of the hour their items expire in.
+type guildUsage struct {
+	Members         int64           `json:"m"`
+	Messages        map[int64]int64 `json:"msg,omitempty"`
+	AttachmentBytes map[int64]int64 `json:"att,omitempty"`
+}
+
+// usageDelta holds the changes a transaction makes to a guild's usage, to be
+// applied once it is committed.
+type usageDelta guildUsage
+
+func newUsageDelta() *usageDelta {
+	return &usageDelta{
+		Messages:        make(map[int64]int64),
+		AttachmentBytes: make(map[int64]int64),
+	}
+}
+
+// expiryHour returns the hour an item expiring at expiresAt, in unix time, is
+// counted in.
+func expiryHour(expiresAt uint64) int64 {
+	const hour = int64(time.Hour / time.Second)
+	return (int64(expiresAt) + hour - 1) / hour * hour
+}
+
+func (d *usageDelta) addMessage(expiresAt uint64) {
+	d.Messages[expiryHour(expiresAt)]++
+}
+
+func (d *usageDelta) removeMessage(expiresAt uint64) {
+	d.Messages[expiryHour(expiresAt)]--
+}
+
+func (d *usageDelta) addAttachment(size int64, expiresAt uint64) {
+	d.AttachmentBytes[expiryHour(expiresAt)] += size
+}
+
+func (d *usageDelta) removeAttachment(size int64, expiresAt uint64) {
+	d.AttachmentBytes[expiryHour(expiresAt)] -= size
+}
+
+// usageStats counts the storage used by every guild.
+type usageStats struct {
+	sync.Mutex
+	guilds map[string]*guildUsage
+}
+
+func (u *usageStats) guildLocked(gid string) *guildUsage {
+	g, ok := u.guilds[gid]
+	if !ok {
+		g = &guildUsage{
+			Messages:        make(map[int64]int64),
+			AttachmentBytes: make(map[int64]int64),
+		}
+		u.guilds[gid] = g
+	}
+	return g
+}
+
+// apply adds the changes of a committed transaction to a guild's usage.
+func (u *usageStats) apply(gid string, d *usageDelta) {
+	u.Lock()
+	defer u.Unlock()
+	g := u.guildLocked(gid)
+	g.Members += d.Members
+	for hour, n := range d.Messages {
+		g.Messages[hour] += n
+	}
+	for hour, n := range d.AttachmentBytes {
+		g.AttachmentBytes[hour] += n
+	}
+}
+
+func (u *usageStats) forget(gid string) {
+	u.Lock()
+	defer u.Unlock()
+	delete(u.guilds, gid)
+}
+
+// sumUnexpired drops the counts of hours that have passed, and returns the
+// sum of the others.
+func sumUnexpired(counts map[int64]int64, now int64) int64 {
+	var total int64
+	for hour, n := range counts {
+		if hour <= now {
+			delete(counts, hour)
+			continue
+		}
+		total += n
+	}
+	return total
+}
+
+// StorageStats returns the storage used by every guild with cached data.
+func (s *Store) StorageStats() ([]GuildStorage, error) {
+	return s.usage.stats(), nil
+}
+
+// stats returns the usage of every guild, and drops the counts of guilds that
+// no longer use any storage.
+func (u *usageStats) stats() []GuildStorage {
+	u.Lock()
+	defer u.Unlock()
+
+	now := time.Now().Unix()
+	stats := make([]GuildStorage, 0, len(u.guilds))
+	for gid, g := range u.guilds {
+		gs := GuildStorage{
+			GuildID:         gid,
+			Members:         g.Members,
+			Messages:        sumUnexpired(g.Messages, now),
+			AttachmentBytes: sumUnexpired(g.AttachmentBytes, now),
+		}
+		if gs == (GuildStorage{GuildID: gid}) {
+			delete(u.guilds, gid)
+			continue
+		}
+		stats = append(stats, gs)
+	}
+	sortGuildStorage(stats)
+	return stats
+}
+
+// sortGuildStorage sorts guilds by the storage they use, largest first.
+func sortGuildStorage(stats []GuildStorage) {
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.AttachmentBytes != b.AttachmentBytes {
+			return a.AttachmentBytes > b.AttachmentBytes
+		}
+		if a.Messages != b.Messages {
+			return a.Messages > b.Messages
+		}
+		return a.GuildID < b.GuildID
+	})
+}
+
+// loadUsage loads the usage saved by the last close, or rebuilds it if the
+// store was not closed cleanly. The saved usage is removed, so that it is not
+// trusted again if the store is not closed cleanly this time.
+func (s *Store) loadUsage() error {
+	s.usage.guilds = make(map[string]*guildUsage)
+
+	saved := false
+	var keys [][]byte
+	prefix := []byte("stats:")
+	err := s.db.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(statsSavedKey)); err == nil {
+			saved = true
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			keys = append(keys, item.KeyCopy(nil))
+			if !saved {
+				continue
+			}
+			g := &guildUsage{}
+			err := item.Value(func(v []byte) error {
+				return json.Unmarshal(v, g)
+			})
+			if err != nil {
+				return err
+			}
+			if g.Messages == nil {
+				g.Messages = make(map[int64]int64)
+			}
+			if g.AttachmentBytes == nil {
+				g.AttachmentBytes = make(map[int64]int64)
+			}
+			s.usage.guilds[strings.TrimPrefix(string(item.Key()), string(prefix))] = g
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !saved {
+		if err := s.rebuildUsage(); err != nil {
+			return err
+		}
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range append(keys, []byte(statsSavedKey)) {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// rebuildUsage counts the usage of every guild by scanning the store.
+func (s *Store) rebuildUsage() error {
+	start := time.Now()
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// member:<gid>:<uid>
+		prefix := []byte("member:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			parts := strings.Split(string(it.Item().Key()), ":")
+			if len(parts) == 3 {
+				s.usage.guildLocked(parts[1]).Members++
+			}
+		}
+
+		// message:<gid>:<cid>:<mid>
+		prefix = []byte("message:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			parts := strings.Split(string(it.Item().Key()), ":")
+			if len(parts) == 4 {
+				s.usage.guildLocked(parts[1]).Messages[expiryHour(it.Item().ExpiresAt())]++
+			}
+		}
+
+		// attusage:<gid>:<time>:<hash>
+		prefix = []byte("attusage:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			parts := strings.Split(string(item.Key()), ":")
+			if len(parts) != 4 {
+				continue
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			size, _ := strconv.ParseInt(string(value), 10, 64)
+			s.usage.guildLocked(parts[1]).AttachmentBytes[expiryHour(item.ExpiresAt())] += size
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.Info("rebuilt storage usage",
+		zap.Int("guilds", len(s.usage.guilds)),
+		zap.Duration("took", time.Since(start)),
+	)
+	return nil
+}
+
+// saveUsage saves the usage of every guild, to be loaded when the store is
+// opened again.
+func (s *Store) saveUsage() error {
+	s.usage.Lock()
+	defer s.usage.Unlock()
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	now := time.Now().Unix()
+	for gid, g := range s.usage.guilds {
+		sumUnexpired(g.Messages, now)
+		sumUnexpired(g.AttachmentBytes, now)
+		value, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		if err := wb.Set([]byte("stats:"+gid), value); err != nil {
+			return err
+		}
+	}
+	if err := wb.Set([]byte(statsSavedKey), []byte{}); err != nil {
+		return err
+	}
+	return wb.Flush()
+}
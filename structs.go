@@ -3,6 +3,7 @@ package stare
 import (
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -10,12 +11,25 @@ import (
 type DiscordMessage struct {
 	Message     *discordgo.Message
 	Attachments []*Attachment
+	// Revisions holds every version of the message content, oldest first.
+	// Message.Content is always the latest one.
+	Revisions []*MessageRevision
+}
+
+// MessageRevision is a version of the content of a message.
+type MessageRevision struct {
+	Content   string
+	Timestamp time.Time
 }
 
 func NewDiscordMessage(msg *discordgo.Message, maxSize int) *DiscordMessage {
 	m := &DiscordMessage{
 		Message:     msg,
 		Attachments: []*Attachment{},
+		Revisions: []*MessageRevision{{
+			Content:   msg.Content,
+			Timestamp: msg.Timestamp,
+		}},
 	}
 
 	for _, a := range msg.Attachments {
@@ -31,12 +45,49 @@ func NewDiscordMessage(msg *discordgo.Message, maxSize int) *DiscordMessage {
 		m.Attachments = append(m.Attachments, &Attachment{
 			Filename: a.Filename,
 			Size:     a.Size,
+			Hash:     hashAttachment(data),
 			Data:     data,
 		})
 	}
 	return m
 }
 
+// History returns every version of the message content, oldest first.
+func (m *DiscordMessage) History() []*MessageRevision {
+	if len(m.Revisions) == 0 {
+		// cached before revisions were tracked
+		return []*MessageRevision{{
+			Content:   m.Message.Content,
+			Timestamp: m.Message.Timestamp,
+		}}
+	}
+	return m.Revisions
+}
+
+// AddRevision records a new version of the message content.
+func (m *DiscordMessage) AddRevision(content string, editedAt time.Time) {
+	m.Revisions = append(m.History(), &MessageRevision{
+		Content:   content,
+		Timestamp: editedAt,
+	})
+	m.Message.Content = content
+}
+
+// withoutAttachmentData returns a copy of the message without the data of
+// attachments that are stored separately.
+func (m *DiscordMessage) withoutAttachmentData() *DiscordMessage {
+	c := *m
+	c.Attachments = make([]*Attachment, 0, len(m.Attachments))
+	for _, a := range m.Attachments {
+		ac := *a
+		if ac.Hash != "" {
+			ac.Data = nil
+		}
+		c.Attachments = append(c.Attachments, &ac)
+	}
+	return &c
+}
+
 func GetAttachment(url string) ([]byte, error) {
 	res, err := http.Get(url)
 	if err != nil {
@@ -47,8 +98,12 @@ func GetAttachment(url string) ([]byte, error) {
 	return io.ReadAll(res.Body)
 }
 
+// Attachment is a file attached to a message. Data is stored separately under
+// Hash, and is only set once loaded. Messages cached before attachments were
+// stored separately have Data and no Hash.
 type Attachment struct {
 	Filename string
 	Size     int
+	Hash     string
 	Data     []byte
 }